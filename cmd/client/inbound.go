@@ -1,6 +1,8 @@
 package main
 
 import (
+	"anytls/proxy/session"
+	std_bufio "bufio"
 	"context"
 	"net"
 	"runtime/debug"
@@ -10,6 +12,7 @@ import (
 	"github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/uot"
 	"github.com/sagernet/sing/protocol/socks"
+	"github.com/sagernet/sing/protocol/socks/socks5"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,10 +24,20 @@ func handleTcpConnection(ctx context.Context, c net.Conn, s *myClient) {
 	}()
 	defer c.Close()
 
-	socks.HandleConnection(ctx, c, nil, s, M.Metadata{
+	metadata := M.Metadata{
 		Source:      M.SocksaddrFromNet(c.RemoteAddr()),
 		Destination: M.SocksaddrFromNet(c.LocalAddr()),
-	})
+	}
+	reader := std_bufio.NewReader(c)
+	version, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if version[0] == socks5.Version {
+		s.handleSocks5(ctx, c, reader, metadata)
+	} else {
+		socks.HandleConnection0(ctx, c, reader, nil, s, metadata)
+	}
 }
 
 // sing socks inbound
@@ -42,7 +55,18 @@ func (c *myClient) NewConnection(ctx context.Context, conn net.Conn, metadata M.
 }
 
 func (c *myClient) NewPacketConnection(ctx context.Context, conn network.PacketConn, metadata M.Metadata) error {
-	proxyC, err := c.CreateProxy(ctx, uot.RequestDestination(2))
+	packetC, err := c.balancer.CreatePacketConn(ctx)
+	if err == nil {
+		defer packetC.Close()
+		return bufio.CopyPacketConn(ctx, conn, packetC)
+	}
+	if err != session.ErrDatagramNotSupported {
+		logrus.Errorln("CreatePacketConn:", err)
+		return err
+	}
+
+	// older servers, udp over tcp
+	proxyC, err := c.CreateUoTProxy(ctx, uot.RequestDestination(2))
 	if err != nil {
 		logrus.Errorln("CreateProxy:", err)
 		return err
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/uot"
+)
+
+// echoPackets sends the packets of conn back to their destination
+func echoPackets(conn network.PacketConn) {
+	for {
+		buffer := buf.NewPacket()
+		addr, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			return
+		}
+		conn.WritePacket(buffer, addr)
+	}
+}
+
+// testServer serves a session on conn after the authentication of the client, its streams are udp over tcp
+// echoed back. The server supports datagrams if datagram is set.
+func testServer(conn net.Conn, datagram bool, used chan<- string) {
+	defer conn.Close()
+	auth := make([]byte, len(passwordSha256)+2)
+	if _, err := io.ReadFull(conn, auth); err != nil {
+		return
+	}
+	paddingLen := binary.BigEndian.Uint16(auth[len(passwordSha256):])
+	if _, err := io.CopyN(io.Discard, conn, int64(paddingLen)); err != nil {
+		return
+	}
+	config := &session.ServerConfig{}
+	if datagram {
+		config.OnPacketConn = func(conn *session.PacketConn) {
+			used <- "datagram"
+			echoPackets(conn)
+		}
+	}
+	server := session.NewServerSession(conn, func(stream *session.Stream) {
+		defer stream.Close()
+		destination, err := M.SocksaddrSerializer.ReadAddrPort(stream)
+		if err != nil || destination != uot.RequestDestination(2) {
+			return
+		}
+		request, err := uot.ReadRequest(stream)
+		if err != nil {
+			return
+		}
+		stream.HandshakeSuccess()
+		used <- "uot"
+		echoPackets(uot.NewConn(stream, *request))
+	}, padding.NewStorage(nil), config)
+	server.Run()
+	server.Close()
+}
+
+func TestNewPacketConnection(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		datagram bool
+	}{
+		{"datagram", true},
+		// older servers
+		{"uot", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			used := make(chan string, 1)
+			c := NewMyClient(ctx, []*serverScheme{newServerScheme("test", "")}, func(ctx context.Context, server string) (net.Conn, error) {
+				conn, peer := net.Pipe()
+				go testServer(peer, test.datagram, used)
+				return conn, nil
+			})
+
+			inbound, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer inbound.Close()
+			sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sender.Close()
+			go c.NewPacketConnection(ctx, bufio.NewPacketConn(inbound), M.Metadata{
+				Destination: M.ParseSocksaddr("1.2.3.4:53"),
+			})
+
+			// the packets of the sender go to the echo server, addressed to the sender
+			if _, err := sender.WriteTo([]byte("hello"), inbound.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			sender.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, 64)
+			n, from, err := sender.ReadFrom(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b[:n]) != "hello" || from.String() != inbound.LocalAddr().String() {
+				t.Fatalf("got %q from %s", b[:n], from)
+			}
+			if path := <-used; path != test.name {
+				t.Fatalf("packets carried by %s, want %s", path, test.name)
+			}
+		})
+	}
+}
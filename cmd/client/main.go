@@ -2,6 +2,7 @@ package main
 
 import (
 	"anytls/proxy"
+	"anytls/proxy/transport"
 	"anytls/util"
 	"context"
 	"crypto/sha256"
@@ -18,14 +19,25 @@ var passwordSha256 []byte
 
 func main() {
 	listen := flag.String("l", "127.0.0.1:1080", "socks5 listen port")
-	serverAddr := flag.String("s", "127.0.0.1:8443", "server address")
+	serverAddr := flag.String("s", "127.0.0.1:8443", "server address, or comma separated addresses to use the fastest healthy one")
 	sni := flag.String("sni", "", "SNI")
 	password := flag.String("p", "", "password")
+	transportKind := flag.String("transport", "tcp", "transport of the sessions: tcp, ws (WebSocket) or h2 (HTTP/2)")
+	httpPath := flag.String("path", "/", "HTTP path of the ws and h2 transports")
+	host := flag.String("host", "", "HTTP Host header of the ws and h2 transports, the SNI or the server address by default")
+	paddingCache := flag.String("padding-cache", defaultSchemeCacheDir(), "directory caching the padding schemes pushed by the servers, empty to disable")
+	var reverse reverseFlags
+	flag.Var(&reverse, "R", "reverse tunnel [bind_address:]port:host:hostport, can be repeated")
 	flag.Parse()
 
 	if *password == "" {
 		logrus.Fatalln("please set password")
 	}
+	switch *transportKind {
+	case "tcp", "ws", "h2":
+	default:
+		logrus.Fatalln("unknown transport:", *transportKind)
+	}
 
 	logLevel, err := logrus.ParseLevel(os.Getenv("LOG_LEVEL"))
 	if err != nil {
@@ -37,7 +49,16 @@ func main() {
 	passwordSha256 = sum[:]
 
 	logrus.Infoln("[Client]", util.ProgramVersionName)
-	logrus.Infoln("[Client] socks5", *listen, "=>", *serverAddr)
+	var servers []string
+	for _, server := range strings.Split(*serverAddr, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		logrus.Fatalln("please set server address")
+	}
+	logrus.Infoln("[Client] socks5", *listen, "=>", strings.Join(servers, ", "), "transport", *transportKind)
 
 	listener, err := net.Listen("tcp", *listen)
 	if err != nil {
@@ -60,15 +81,56 @@ func main() {
 		}
 	}
 
+	httpHost := func(server string) string {
+		if *host != "" {
+			return *host
+		}
+		if *sni != "" {
+			return *sni
+		}
+		return server
+	}
+	// the certificates of the servers identify their cached schemes
+	schemes := make([]*serverScheme, 0, len(servers))
+	tlsConfigs := make(map[string]*tls.Config)
+	for _, server := range servers {
+		scheme := newServerScheme(server, *paddingCache)
+		schemes = append(schemes, scheme)
+		tlsConfigs[server] = tlsConfig.Clone()
+		tlsConfigs[server].VerifyConnection = scheme.verifyConnection
+	}
+	http2Dialers := make(map[string]*transport.HTTP2Dialer)
+	if *transportKind == "h2" {
+		for _, server := range servers {
+			http2Dialers[server] = transport.NewHTTP2Dialer(server, httpHost(server), *httpPath, tlsConfigs[server], proxy.SystemDialer)
+		}
+	}
+
 	ctx := context.Background()
-	client := NewMyClient(ctx, func(ctx context.Context) (net.Conn, error) {
-		conn, err := proxy.SystemDialer.DialContext(ctx, "tcp", *serverAddr)
+	client := NewMyClient(ctx, schemes, func(ctx context.Context, server string) (net.Conn, error) {
+		if *transportKind == "h2" {
+			return http2Dialers[server].Dial(ctx)
+		}
+		conn, err := proxy.SystemDialer.DialContext(ctx, "tcp", server)
 		if err != nil {
 			return nil, err
 		}
-		conn = tls.Client(conn, tlsConfig)
+		conn = tls.Client(conn, tlsConfigs[server])
+		if *transportKind == "ws" {
+			wsConn, err := transport.DialWebSocket(ctx, conn, httpHost(server), *httpPath)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return wsConn, nil
+		}
 		return conn, nil
 	})
+	if len(reverse) > 0 {
+		if err := client.StartReverse(ctx, reverse); err != nil {
+			logrus.Fatalln(err)
+		}
+	}
 
 	for {
 		c, err := listener.Accept()
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"anytls/proxy/padding"
 	"anytls/proxy/session"
 	"anytls/util"
 	"context"
@@ -15,21 +14,47 @@ import (
 )
 
 type myClient struct {
-	dialOut       util.DialOutFunc
-	sessionClient *session.Client
+	balancer *session.Balancer
 }
 
-func NewMyClient(ctx context.Context, dialOut util.DialOutFunc) *myClient {
-	s := &myClient{
-		dialOut: dialOut,
+// NewMyClient keeps a session client per server and opens the streams on the best one,
+// dialOut connects to the given server
+func NewMyClient(ctx context.Context, servers []*serverScheme, dialOut func(ctx context.Context, server string) (net.Conn, error)) *myClient {
+	s := &myClient{}
+	balancerServers := make([]session.BalancerServer, 0, len(servers))
+	for _, scheme := range servers {
+		dial := func(ctx context.Context) (net.Conn, error) {
+			return dialOut(ctx, scheme.server)
+		}
+		// each server pushes its own scheme
+		client := session.NewClient(ctx, s.createOutboundConnection(dial, scheme), scheme.padding, time.Second*30, time.Second*30, 5,
+			session.KeepaliveConfig{Interval: time.Second * 15, Timeout: time.Second * 5, MaxMissed: 3})
+		client.OnPaddingUpdate(scheme.save)
+		balancerServers = append(balancerServers, session.BalancerServer{
+			Name:   scheme.server,
+			Client: client,
+		})
 	}
-	s.sessionClient = session.NewClient(ctx, s.createOutboundConnection, &padding.DefaultPaddingFactory, time.Second*30, time.Second*30, 5)
+	s.balancer = session.NewBalancer(ctx, balancerServers, session.BalancerConfig{})
 	return s
 }
 
+// handshakeTimeout bounds the wait for the server to connect to the destination
+const handshakeTimeout = time.Second * 10
+
+// CreateProxy opens a stream to destination and waits until the server has connected to it
 func (c *myClient) CreateProxy(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
-	logrus.Infof("[Client] CreateProxy destination type: %T, value: %s", destination, destination.String())
-	conn, err := c.sessionClient.CreateStream(ctx)
+	logrus.Infof("[Client] CreateProxy destination: %s", destination.String())
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	return c.balancer.CreateStream(ctx, session.WithHandshake(destination))
+}
+
+// CreateUoTProxy opens a stream for udp over tcp, the server only reports its outbound
+// after the first packet, so it is not waited for
+func (c *myClient) CreateUoTProxy(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
+	logrus.Infof("[Client] CreateUoTProxy destination: %s", destination.String())
+	conn, err := c.balancer.CreateStream(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -42,18 +67,34 @@ func (c *myClient) CreateProxy(ctx context.Context, destination M.Socksaddr) (ne
 	return conn, nil
 }
 
-func (c *myClient) createOutboundConnection(ctx context.Context) (net.Conn, error) {
-	conn, err := c.dialOut(ctx)
+// createOutboundConnection authenticates the connections of dialOut, padded with the scheme of its server
+func (c *myClient) createOutboundConnection(dialOut util.DialOutFunc, scheme *serverScheme) util.DialOutFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		return c.authenticate(ctx, dialOut, scheme)
+	}
+}
+
+func (c *myClient) authenticate(ctx context.Context, dialOut util.DialOutFunc, scheme *serverScheme) (net.Conn, error) {
+	conn, err := dialOut(ctx)
 	if err != nil {
 		return nil, err
 	}
+	// the certificate of the server tells which cached scheme pads the authentication and the session
+	if tlsConn, ok := conn.(interface{ HandshakeContext(context.Context) error }); ok {
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	scheme.load()
+	paddingF := scheme.padding.Load()
 
 	b := buf.NewPacket()
 	defer b.Release()
 
 	b.Write(passwordSha256)
 	var paddingLen int
-	if pad := padding.DefaultPaddingFactory.Load().GenerateRecordPayloadSizes(0); len(pad) > 0 {
+	if pad := paddingF.GenerateRecordPayloadSizes(0); len(pad) > 0 && pad[0] > 0 {
 		paddingLen = pad[0]
 	}
 	binary.BigEndian.PutUint16(b.Extend(2), uint16(paddingLen))
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"anytls/proxy"
+	"anytls/proxy/session"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+// reverseFlags collects the -R flags
+type reverseFlags []string
+
+func (f *reverseFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *reverseFlags) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// parseReverse parses [bind_address:]port:host:hostport like ssh -R,
+// the remote listen address binds all interfaces of the server when bind_address is omitted
+func parseReverse(spec string) (remote, local string, err error) {
+	parts := splitHostPorts(spec)
+	switch len(parts) {
+	case 3:
+		remote = net.JoinHostPort("", parts[0])
+	case 4:
+		remote = net.JoinHostPort(parts[0], parts[1])
+	default:
+		return "", "", fmt.Errorf("invalid reverse tunnel %q, want [bind_address:]port:host:hostport", spec)
+	}
+	local = net.JoinHostPort(parts[len(parts)-2], parts[len(parts)-1])
+	return
+}
+
+// splitHostPorts splits s by the colons outside of brackets, and removes the brackets of IPv6 addresses
+func splitHostPorts(s string) []string {
+	var parts []string
+	var depth, start int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, strings.Trim(s[start:i], "[]"))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.Trim(s[start:], "[]"))
+}
+
+// StartReverse registers the reverse tunnels on the servers
+func (c *myClient) StartReverse(ctx context.Context, specs []string) error {
+	binds := make([]session.ReverseBind, 0, len(specs))
+	for _, spec := range specs {
+		remote, local, err := parseReverse(spec)
+		if err != nil {
+			return err
+		}
+		logrus.Infoln("[Client] reverse", remote, "=>", local)
+		binds = append(binds, session.ReverseBind{
+			Address: remote,
+			Handler: func(stream *session.Stream, source M.Socksaddr) {
+				handleReverseStream(ctx, stream, source, local)
+			},
+		})
+	}
+	// every server exposes the tunnels, so they survive the failure of one
+	for _, server := range c.balancer.Servers() {
+		go server.Client.Reverse(binds)
+	}
+	return nil
+}
+
+func handleReverseStream(ctx context.Context, stream *session.Stream, source M.Socksaddr, local string) {
+	defer stream.Close()
+
+	conn, err := proxy.SystemDialer.DialContext(ctx, "tcp", local)
+	if err != nil {
+		logrus.Warnln("[Client] reverse dial", local, "failed:", err)
+		stream.HandshakeFailure(err)
+		return
+	}
+	defer conn.Close()
+	stream.HandshakeSuccess()
+
+	logrus.Debugln("[Client] reverse", source, "=>", local)
+	bufio.CopyConn(ctx, stream, conn)
+}
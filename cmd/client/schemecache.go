@@ -0,0 +1,135 @@
+package main
+
+import (
+	"anytls/proxy/padding"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sagernet/sing/common/atomic"
+	"github.com/sirupsen/logrus"
+)
+
+// serverScheme keeps the scheme of a server, and the last scheme it pushed on disk so that the first
+// session after a restart uses it instead of the default one. The cached schemes are keyed by the address
+// and the certificate fingerprint of the server: a server with another certificate is not trusted with
+// the scheme of the previous one.
+type serverScheme struct {
+	server  string
+	dir     string // no cache if empty
+	padding *atomic.TypedValue[*padding.PaddingFactory]
+
+	// fingerprint is the sha256 of the certificate of the last handshake
+	fingerprint atomic.TypedValue[string]
+	// loaded is the fingerprint whose cached scheme was looked up
+	loaded     string
+	loadedLock sync.Mutex
+}
+
+func newServerScheme(server, dir string) *serverScheme {
+	return &serverScheme{
+		server:  server,
+		dir:     dir,
+		padding: padding.NewStorage(nil),
+	}
+}
+
+// defaultSchemeCacheDir returns the directory of the cached schemes in the user cache directory
+func defaultSchemeCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "anytls", "padding")
+}
+
+// verifyConnection is the tls.Config.VerifyConnection of the server, it only records the fingerprint
+func (s *serverScheme) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) > 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		s.fingerprint.Store(hex.EncodeToString(sum[:]))
+	}
+	return nil
+}
+
+func (s *serverScheme) file(fingerprint string) string {
+	sum := sha256.Sum256([]byte(s.server + "\n" + fingerprint))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16])+".txt")
+}
+
+// load uses the cached scheme of the server after a handshake with a certificate not seen before
+func (s *serverScheme) load() {
+	fingerprint := s.fingerprint.Load()
+	if s.dir == "" || fingerprint == "" {
+		return
+	}
+	s.loadedLock.Lock()
+	defer s.loadedLock.Unlock()
+	if fingerprint == s.loaded {
+		return
+	}
+	s.loaded = fingerprint
+
+	// the scheme of the previous certificate is not used for another one
+	file := s.file(fingerprint)
+	rawScheme, err := os.ReadFile(file)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logrus.Warnln("[Client] read cached padding scheme:", err)
+		}
+		s.padding.Store(padding.DefaultPaddingFactory())
+		return
+	}
+	// parsed like the schemes pushed by the server, a scheme the session used is never dropped for a warning
+	p := padding.NewPaddingFactory(rawScheme)
+	if p == nil {
+		_, _, err := padding.ParseScheme(rawScheme)
+		logrus.Warnln("[Client] invalid cached padding scheme", file, "removed:", err)
+		os.Remove(file)
+		s.padding.Store(padding.DefaultPaddingFactory())
+		return
+	}
+	s.padding.Store(p)
+	logrus.Infof("[Client] use cached padding scheme %s of %s", p.Md5, s.server)
+}
+
+// save caches a scheme pushed by the server, the file is replaced at once so that it is never read half written
+func (s *serverScheme) save(p *padding.PaddingFactory) {
+	fingerprint := s.fingerprint.Load()
+	if s.dir == "" || fingerprint == "" {
+		return
+	}
+	s.loadedLock.Lock()
+	defer s.loadedLock.Unlock()
+	s.loaded = fingerprint
+
+	if err := s.write(s.file(fingerprint), p.RawScheme); err != nil {
+		logrus.Warnln("[Client] cache padding scheme:", err)
+	}
+}
+
+func (s *serverScheme) write(file string, rawScheme []byte) error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".padding-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(rawScheme)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"anytls/proxy/padding"
+)
+
+func TestSchemeCache(t *testing.T) {
+	dir := t.TempDir()
+	pushed := padding.NewPaddingFactory([]byte("stop=2\n0=30\n1=100-200"))
+	// used by NewPaddingFactory, which skips the item ParseScheme reports as an error
+	lenient := padding.NewPaddingFactory([]byte("stop=2\n0=30\n1=100-200,zz\nunknown=1"))
+
+	cached := func(server, fingerprint string) *padding.PaddingFactory {
+		s := newServerScheme(server, dir)
+		s.fingerprint.Store(fingerprint)
+		s.load()
+		return s.padding.Load()
+	}
+	save := func(server, fingerprint string, p *padding.PaddingFactory) *serverScheme {
+		s := newServerScheme(server, dir)
+		s.fingerprint.Store(fingerprint)
+		s.save(p)
+		return s
+	}
+
+	save("a.example:443", "cert1", pushed)
+	if p := cached("a.example:443", "cert1"); p.Md5 != pushed.Md5 {
+		t.Fatalf("cached scheme %s, want %s", p.Md5, pushed.Md5)
+	}
+	if p := cached("a.example:443", "cert2"); p != padding.DefaultPaddingFactory() {
+		t.Fatalf("scheme %s used for another certificate", p.Md5)
+	}
+	if p := cached("b.example:443", "cert1"); p != padding.DefaultPaddingFactory() {
+		t.Fatalf("scheme %s used for another server", p.Md5)
+	}
+
+	s := save("a.example:443", "cert1", lenient)
+	if p := cached("a.example:443", "cert1"); p.Md5 != lenient.Md5 {
+		t.Fatalf("scheme with issues not used: %s", p.Md5)
+	}
+	if _, err := os.Stat(s.file("cert1")); err != nil {
+		t.Fatalf("scheme with issues removed: %s", err)
+	}
+
+	if err := os.WriteFile(s.file("cert1"), []byte("stop=x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if p := cached("a.example:443", "cert1"); p != padding.DefaultPaddingFactory() {
+		t.Fatalf("invalid cached scheme used: %s", p.Md5)
+	}
+	if _, err := os.Stat(s.file("cert1")); !os.IsNotExist(err) {
+		t.Fatalf("invalid cached scheme not removed: %v", err)
+	}
+}
+
+func TestSchemeCacheLoadedOnce(t *testing.T) {
+	dir := t.TempDir()
+	pushed := padding.NewPaddingFactory([]byte("stop=1\n0=30"))
+	s := newServerScheme("a.example:443", dir)
+	s.fingerprint.Store("cert1")
+	s.load()
+	if p := s.padding.Load(); p != padding.DefaultPaddingFactory() {
+		t.Fatalf("scheme %s without cache", p.Md5)
+	}
+
+	// the scheme pushed during the session is kept by the next handshakes with the same certificate
+	s.padding.Store(pushed)
+	s.save(pushed)
+	s.load()
+	if p := s.padding.Load(); p != pushed {
+		t.Fatalf("scheme %s after a new handshake, want %s", p.Md5, pushed.Md5)
+	}
+
+	s.fingerprint.Store("cert2")
+	s.load()
+	if p := s.padding.Load(); p != padding.DefaultPaddingFactory() {
+		t.Fatalf("scheme %s kept for a new certificate", p.Md5)
+	}
+
+	// no cache directory
+	s = newServerScheme("a.example:443", "")
+	s.fingerprint.Store("cert1")
+	s.load()
+	s.save(pushed)
+	if p := s.padding.Load(); p != padding.DefaultPaddingFactory() {
+		t.Fatalf("scheme %s without cache directory", p.Md5)
+	}
+}
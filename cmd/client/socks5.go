@@ -0,0 +1,135 @@
+package main
+
+import (
+	"anytls/proxy/session"
+	std_bufio "bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/protocol/socks"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+	"github.com/sirupsen/logrus"
+)
+
+// handleSocks5 serves a socks5 connection without authentication.
+// Unlike socks.HandleConnection, which replies success before the handler runs,
+// CONNECT is replied after the server has connected to the destination,
+// with the reply code matching its result.
+func (c *myClient) handleSocks5(ctx context.Context, conn net.Conn, reader *std_bufio.Reader, metadata M.Metadata) error {
+	if _, err := reader.ReadByte(); err != nil {
+		return err
+	}
+	if _, err := socks5.ReadAuthRequest0(reader); err != nil {
+		return err
+	}
+	err := socks5.WriteAuthResponse(conn, socks5.AuthResponse{
+		Method: socks5.AuthTypeNotRequired,
+	})
+	if err != nil {
+		return err
+	}
+	request, err := socks5.ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+	metadata.Protocol = "socks5"
+	metadata.Destination = request.Destination
+
+	switch request.Command {
+	case socks5.CommandConnect:
+		return c.handleSocks5Connect(ctx, conn, reader, metadata)
+	case socks5.CommandUDPAssociate:
+		return c.handleSocks5Associate(ctx, conn, metadata)
+	default:
+		socks5.WriteResponse(conn, socks5.Response{
+			ReplyCode: socks5.ReplyCodeUnsupported,
+		})
+		return errors.New("socks5: unsupported command")
+	}
+}
+
+func (c *myClient) handleSocks5Connect(ctx context.Context, conn net.Conn, reader *std_bufio.Reader, metadata M.Metadata) error {
+	logrus.Infof("[Client] inbound metadata.Destination type: %T, value: %s", metadata.Destination, metadata.Destination.String())
+	proxyC, err := c.CreateProxy(ctx, metadata.Destination)
+	if err != nil {
+		logrus.Errorln("CreateProxy:", err)
+		socks5.WriteResponse(conn, socks5.Response{
+			ReplyCode: socks5ReplyCode(err),
+		})
+		return err
+	}
+	defer proxyC.Close()
+
+	bind := M.SocksaddrFromNet(conn.LocalAddr())
+	if stream, ok := proxyC.(*session.Stream); ok && stream.BoundAddr().IsValid() {
+		bind = stream.BoundAddr()
+	}
+	err = socks5.WriteResponse(conn, socks5.Response{
+		ReplyCode: socks5.ReplyCodeSuccess,
+		Bind:      bind,
+	})
+	if err != nil {
+		return err
+	}
+
+	if n := reader.Buffered(); n > 0 {
+		// sent by the socks client before the reply
+		cached := buf.NewSize(n)
+		cached.ReadFullFrom(reader, n)
+		conn = bufio.NewCachedConn(conn, cached)
+	}
+	return bufio.CopyConn(ctx, conn, proxyC)
+}
+
+// handleSocks5Associate is the UDP ASSOCIATE of socks.HandleConnection
+func (c *myClient) handleSocks5Associate(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	udpConn, err := net.ListenUDP(M.NetworkFromNetAddr("udp", M.AddrFromNet(conn.LocalAddr())), net.UDPAddrFromAddrPort(netip.AddrPortFrom(M.AddrFromNet(conn.LocalAddr()), 0)))
+	if err != nil {
+		socks5.WriteResponse(conn, socks5.Response{
+			ReplyCode: socks5.ReplyCodeFailure,
+		})
+		return err
+	}
+	defer udpConn.Close()
+	err = socks5.WriteResponse(conn, socks5.Response{
+		ReplyCode: socks5.ReplyCodeSuccess,
+		Bind:      M.SocksaddrFromNet(udpConn.LocalAddr()),
+	})
+	if err != nil {
+		return err
+	}
+	var innerError error
+	done := make(chan struct{})
+	associatePacketConn := socks.NewAssociatePacketConn(bufio.NewServerPacketConn(udpConn), metadata.Destination, conn)
+	go func() {
+		innerError = c.NewPacketConnection(ctx, associatePacketConn, metadata)
+		close(done)
+	}()
+	_, err = io.Copy(io.Discard, conn)
+	associatePacketConn.Close()
+	<-done
+	return errors.Join(innerError, err)
+}
+
+// socks5ReplyCode maps the error of CreateProxy to a socks5 reply
+func socks5ReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, session.ErrNotAllowed):
+		return socks5.ReplyCodeNotAllowed
+	case errors.Is(err, session.ErrNetworkUnreachable):
+		return socks5.ReplyCodeNetworkUnreachable
+	case errors.Is(err, session.ErrHostUnreachable), errors.Is(err, session.ErrDNSFailure),
+		errors.Is(err, session.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return socks5.ReplyCodeHostUnreachable
+	case errors.Is(err, session.ErrConnectionRefused):
+		return socks5.ReplyCodeConnectionRefused
+	default:
+		return socks5.ReplyCodeFailure
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"anytls/proxy/session"
+
+	"github.com/sagernet/sing/protocol/socks/socks5"
+)
+
+func TestSocks5ReplyCode(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		reply byte
+	}{
+		{&session.RemoteError{Code: session.CodeGeneralFailure, Message: "x"}, socks5.ReplyCodeFailure},
+		{&session.RemoteError{Code: session.CodeNotAllowed, Message: "x"}, socks5.ReplyCodeNotAllowed},
+		{&session.RemoteError{Code: session.CodeNetworkUnreachable, Message: "x"}, socks5.ReplyCodeNetworkUnreachable},
+		{&session.RemoteError{Code: session.CodeHostUnreachable, Message: "x"}, socks5.ReplyCodeHostUnreachable},
+		{&session.RemoteError{Code: session.CodeConnectionRefused, Message: "x"}, socks5.ReplyCodeConnectionRefused},
+		{&session.RemoteError{Code: session.CodeTimeout, Message: "x"}, socks5.ReplyCodeHostUnreachable},
+		{&session.RemoteError{Code: session.CodeDNSFailure, Message: "x"}, socks5.ReplyCodeHostUnreachable},
+		{&session.RemoteError{Code: 200, Message: "x"}, socks5.ReplyCodeFailure},
+		{fmt.Errorf("open stream: %w", session.ErrNotAllowed), socks5.ReplyCodeNotAllowed},
+		{context.DeadlineExceeded, socks5.ReplyCodeHostUnreachable},
+		{errors.New("session closed"), socks5.ReplyCodeFailure},
+	} {
+		if reply := socks5ReplyCode(test.err); reply != test.reply {
+			t.Errorf("reply of %v is %d, want %d", test.err, reply, test.reply)
+		}
+	}
+}
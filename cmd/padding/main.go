@@ -0,0 +1,212 @@
+package main
+
+import (
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// padding checks the padding schemes given to the server with --padding-scheme
+const usage = `usage: padding <command> [arguments]
+
+commands:
+  lint [file]              validate a padding scheme and print what it means, the default scheme without file
+  simulate [flags] [pattern]  print the TLS records a session writes for a pattern of writes
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "lint":
+		lint(os.Args[2:])
+	case "simulate":
+		simulate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// readScheme reads the scheme in file, or returns the default scheme if file is empty
+func readScheme(file string) ([]byte, error) {
+	if file == "" {
+		return padding.DefaultPaddingFactory().RawScheme, nil
+	}
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+func lint(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: padding lint [file], - reads the scheme from stdin")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	name := fs.Arg(0)
+	b, err := readScheme(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if name == "" {
+		name = "default scheme"
+	}
+
+	p, warnings, err := padding.ParseScheme(b)
+	for _, w := range warnings {
+		fmt.Println("warning:", w)
+	}
+	if err != nil {
+		for _, issue := range err.(interface{ Unwrap() []error }).Unwrap() {
+			fmt.Println("error:", issue)
+		}
+		fmt.Printf("%s: invalid\n", name)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok, %d warnings\n\n", name, len(warnings))
+
+	fmt.Printf("upstream, stop=%d, md5 %s\n", p.Stop, p.UpstreamMd5)
+	describe(p, true)
+	if p.Down != nil {
+		fmt.Printf("\ndownstream, stop=%d, md5 %s, for clients with padding-down\n", p.Down.Stop, p.Md5)
+		describe(p.Down, false)
+	} else {
+		fmt.Println("\nno downstream section, servers do not pad")
+	}
+}
+
+// describe prints the packets below stop, the packet 0 of clients is the authentication
+func describe(p *padding.PaddingFactory, upstream bool) {
+	for pkt := uint32(0); pkt < p.Stop; pkt++ {
+		if pkt == 64 && p.Stop > 65 {
+			fmt.Printf("  ... %d more packets\n", p.Stop-pkt)
+			return
+		}
+		what := p.Describe(pkt)
+		if what == "" {
+			what = "sent as it is"
+		}
+		if upstream && pkt == 0 {
+			what += " (authentication)"
+		}
+		fmt.Printf("  %3d  %s\n", pkt, what)
+	}
+}
+
+const simulateUsage = `usage: padding simulate [flags] [pattern]
+
+The pattern lists the writes of the session, separated by commas:
+  open:ADDR     first write of a client: cmdSettings, cmdSYN and the address of the first stream
+  update        cmdUpdatePaddingScheme of the server
+  settings      cmdServerSettings of the server
+  synack        cmdSYNACK, synack:ADDR with the bound address
+  N             N bytes of a stream, with the suffixes k and m for KiB and MiB
+  raw:N         a write of N bytes
+The default pattern is %q for clients, %q with -down.
+Writes longer than a TLS record are shown split at 16384 bytes, the TLS of Go may use
+smaller records at the start of a connection.
+
+`
+
+const (
+	defaultUpPattern   = "open:www.example.com:443,517,3k"
+	defaultDownPattern = "settings,synack:192.0.2.1:50000,5k,16k"
+)
+
+func simulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	schemeFile := fs.String("scheme", "", "padding scheme file, the default scheme if empty")
+	down := fs.Bool("down", false, "simulate the writes of the server with the downstream section")
+	seed := fs.Uint64("seed", 0, "seed of the sizes drawn, 0 for random")
+	runs := fs.Int("runs", 1, "number of simulations, with the seeds following -seed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), simulateUsage, defaultUpPattern, defaultDownPattern)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	b, err := readScheme(*schemeFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	p, _, err := padding.ParseScheme(b)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid padding scheme, see padding lint")
+		os.Exit(1)
+	}
+
+	pattern := fs.Arg(0)
+	scheme, first := p, uint32(1)
+	if *down {
+		if pattern == "" {
+			pattern = defaultDownPattern
+		}
+		if p.Down == nil {
+			fmt.Println("the scheme has no downstream section, servers do not pad")
+		}
+		scheme, first = p.Down, 0
+	} else if pattern == "" {
+		pattern = defaultUpPattern
+	}
+	sizes, err := session.WritePattern(pattern, p)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	for run := 0; run < *runs; run++ {
+		runScheme := scheme
+		if runScheme != nil && *seed != 0 {
+			runScheme = runScheme.WithSeed(*seed + uint64(run))
+		}
+		if run > 0 {
+			fmt.Println()
+		}
+		printSimulation(padding.Simulate(runScheme, sizes, first))
+	}
+}
+
+func printSimulation(writes []padding.SimulatedWrite) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "pkt\tbytes\twaste\tdelay\t  TLS records\t")
+	var data, wire, waste, records int
+	var delay time.Duration
+	for _, w := range writes {
+		pkt := strconv.FormatUint(uint64(w.Packet), 10)
+		if !w.Padded {
+			pkt = "-"
+		}
+		var parts []string
+		for _, r := range w.Records() {
+			if r.Delay > 0 {
+				parts = append(parts, "wait "+r.Delay.String())
+			} else {
+				parts = append(parts, strconv.Itoa(r.Size))
+				wire += r.Size
+				records++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t  %s\t\n", pkt, w.Size, w.Waste(), w.Delay(), strings.Join(parts, " "))
+		data += w.Size
+		waste += w.Waste()
+		delay += w.Delay()
+	}
+	tw.Flush()
+	fmt.Printf("%d bytes written as %d bytes in %d records, %d bytes of waste (%.1f%%), %s of delay\n",
+		data, wire, records, waste, float64(waste)*100/float64(max(wire, 1)), delay)
+}
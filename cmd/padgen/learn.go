@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// authOverhead is the part of the authentication of clients which is not padding,
+// sha256(password) and the padding length
+const authOverhead = 32 + 2
+
+type learnOptions struct {
+	// overhead is subtracted from the record sizes of the traces to get the plaintext sizes
+	overhead int
+	// coverage is the fraction of the connections which must reach a packet for it to be padded
+	coverage   float64
+	maxStop    int
+	maxRecords int
+	buckets    int
+}
+
+// upstreamPackets maps the flights of the client to the packets of the scheme: the packet 0 is
+// the authentication, sent in the same flight as the packet 1 with the settings and the first stream
+func upstreamPackets(conns []connection) [][][]int {
+	var packets [][][]int
+	for _, c := range conns {
+		flights := c.flights(false)
+		if len(flights) == 0 {
+			continue
+		}
+		p := [][]int{flights[0][:1], flights[0][1:]}
+		packets = append(packets, append(p, flights[1:]...))
+	}
+	return packets
+}
+
+// downstreamPackets maps the flights of the server to the packets of the downstream section
+func downstreamPackets(conns []connection) [][][]int {
+	var packets [][][]int
+	for _, c := range conns {
+		if flights := c.flights(true); len(flights) > 0 {
+			packets = append(packets, flights)
+		}
+	}
+	return packets
+}
+
+// learn returns the stop and the lists of the packets of a section, from the packets of each connection
+func learn(conns [][][]int, opts learnOptions, auth bool) (stop int, lists []string) {
+	for ; stop < opts.maxStop; stop++ {
+		var reached [][]int
+		for _, packets := range conns {
+			if len(packets) > stop {
+				reached = append(reached, packets[stop])
+			}
+		}
+		if len(conns) == 0 || float64(len(reached)) < opts.coverage*float64(len(conns)) {
+			break
+		}
+		lists = append(lists, learnPacket(reached, opts, auth && stop == 0))
+	}
+	return
+}
+
+// learnPacket returns the list of a packet from its records in the connections which reached it.
+// The records up to the median count of the connections are always sent, padded if the data is shorter,
+// the following ones up to the 90th percentile are preceded by a check mark and only sent with data left.
+func learnPacket(reached [][]int, opts learnOptions, auth bool) string {
+	counts := make([]int, len(reached))
+	for i, records := range reached {
+		counts[i] = len(records)
+	}
+	slices.Sort(counts)
+	median := counts[len(counts)/2]
+	last := min(counts[min(len(counts)*9/10, len(counts)-1)], opts.maxRecords)
+	if auth {
+		median, last = 1, 1
+	}
+
+	var items []string
+	for j := 0; j < last; j++ {
+		var sizes []int
+		for _, records := range reached {
+			if len(records) > j {
+				size := records[j] - opts.overhead
+				if auth {
+					size -= authOverhead
+				}
+				sizes = append(sizes, max(1, min(size, math.MaxUint16)))
+			}
+		}
+		if j >= median {
+			items = append(items, "c")
+		}
+		items = append(items, describeSizes(sizes, opts.buckets))
+	}
+	return strings.Join(items, ",")
+}
+
+// describeSizes writes a distribution of the padding scheme matching the sizes: a choice between
+// the values when there are few of them, or weighted buckets. The buckets isolate the frequent values,
+// like the full records of 16384 bytes, then separate the clusters and finally split at the medians.
+func describeSizes(sizes []int, buckets int) string {
+	slices.Sort(sizes)
+	values := slices.Compact(slices.Clone(sizes))
+	if len(values) == 1 {
+		return strconv.Itoa(values[0])
+	}
+	if len(values) <= buckets {
+		var alternatives []string
+		for _, v := range values {
+			first, _ := slices.BinarySearch(sizes, v)
+			after, _ := slices.BinarySearch(sizes, v+1)
+			alternatives = append(alternatives, fmt.Sprintf("%d@%d", v, after-first))
+		}
+		return strings.Join(alternatives, "|")
+	}
+
+	groups := [][]int{sizes}
+	for _, v := range values {
+		first, _ := slices.BinarySearch(sizes, v)
+		after, _ := slices.BinarySearch(sizes, v+1)
+		if (after-first)*buckets >= len(sizes) && len(groups) < buckets {
+			groups = isolate(groups, v)
+		}
+	}
+	spread := sizes[len(sizes)-1] - sizes[0]
+	for len(groups) < buckets {
+		g, i, gap := -1, 0, 0
+		for k, group := range groups {
+			for j := 1; j < len(group); j++ {
+				if d := group[j] - group[j-1]; d > gap {
+					g, i, gap = k, j, d
+				}
+			}
+		}
+		if g < 0 || gap*8 < spread {
+			break
+		}
+		groups = slices.Insert(groups, g+1, groups[g][i:])
+		groups[g] = groups[g][:i]
+	}
+	for len(groups) < buckets {
+		g := -1
+		for k, group := range groups {
+			if group[0] != group[len(group)-1] && (g < 0 || len(group) > len(groups[g])) {
+				g = k
+			}
+		}
+		if g < 0 {
+			break
+		}
+		group := groups[g]
+		i := len(group) / 2
+		// a value is not split between two buckets
+		for i < len(group) && group[i] == group[i-1] {
+			i++
+		}
+		if i == len(group) {
+			i = len(group) / 2
+			for group[i] == group[i-1] {
+				i--
+			}
+		}
+		groups = slices.Insert(groups, g+1, group[i:])
+		groups[g] = group[:i]
+	}
+
+	alternatives := make([]string, len(groups))
+	for k, group := range groups {
+		lo, hi := group[0], group[len(group)-1]
+		bucket := strconv.Itoa(lo)
+		if hi > lo {
+			// the ranges of the scheme exclude their max
+			bucket = fmt.Sprintf("%d-%d", lo, hi+1)
+		}
+		alternatives[k] = fmt.Sprintf("%s@%d", bucket, len(group))
+	}
+	return strings.Join(alternatives, "|")
+}
+
+// isolate splits the group holding v so that the sizes equal to v are a group of their own
+func isolate(groups [][]int, v int) [][]int {
+	for k, group := range groups {
+		if v < group[0] || v > group[len(group)-1] {
+			continue
+		}
+		first, _ := slices.BinarySearch(group, v)
+		after, _ := slices.BinarySearch(group, v+1)
+		var split [][]int
+		for _, part := range [][]int{group[:first], group[first:after], group[after:]} {
+			if len(part) > 0 {
+				split = append(split, part)
+			}
+		}
+		return slices.Replace(groups, k, k+1, split...)
+	}
+	return groups
+}
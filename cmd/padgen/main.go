@@ -0,0 +1,123 @@
+package main
+
+import (
+	"anytls/proxy/padding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	format := flag.String("format", "trace", "format of the input: trace (a connection per line) or tshark")
+	serverPort := flag.Int("port", 443, "port of the server in the tshark format")
+	overhead := flag.Int("overhead", 0, "bytes subtracted from the record sizes, 17 for the TLS 1.3 record lengths of tshark")
+	coverage := flag.Float64("coverage", 0.5, "fraction of the connections which must reach a packet for it to be padded")
+	maxStop := flag.Int("max-stop", 12, "largest stop of a section")
+	maxRecords := flag.Int("max-records", 8, "largest number of records of a packet")
+	buckets := flag.Int("buckets", 4, "largest number of alternatives of a size")
+	down := flag.Bool("down", true, "learn the downstream section from the records of the server")
+	output := flag.String("o", "", "file to write the scheme to, stdout if empty")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: padgen [flags] [trace file], the trace is read from stdin without file")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *coverage <= 0 || *coverage > 1 || *maxStop < 1 || *maxRecords < 1 || *buckets < 1 {
+		fmt.Fprintln(os.Stderr, "invalid -coverage, -max-stop, -max-records or -buckets")
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	if name := flag.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	var conns []connection
+	var err error
+	switch *format {
+	case "trace":
+		conns, err = readTrace(in)
+	case "tshark":
+		conns, err = readTshark(in, *serverPort)
+	default:
+		err = fmt.Errorf("unknown format: %s", *format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	opts := learnOptions{
+		overhead:   *overhead,
+		coverage:   *coverage,
+		maxStop:    *maxStop,
+		maxRecords: *maxRecords,
+		buckets:    *buckets,
+	}
+	scheme, err := generate(conns, opts, *down, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// the learned scheme is valid by construction, the warnings tell about the packets sent as they are
+	_, warnings, err := padding.ParseScheme(scheme)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[BUG] invalid scheme:", err)
+		os.Exit(1)
+	}
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+
+	scheme = append(scheme, '\n')
+	if *output == "" {
+		os.Stdout.Write(scheme)
+		return
+	}
+	if err := os.WriteFile(*output, scheme, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// generate learns the scheme of the connections, with the downstream section if down,
+// and tells about the sections learned to log
+func generate(conns []connection, opts learnOptions, down bool, log io.Writer) ([]byte, error) {
+	upstream := upstreamPackets(conns)
+	stop, lists := learn(upstream, opts, true)
+	if stop == 0 {
+		return nil, errors.New("no records of clients in the trace")
+	}
+	lines := sectionLines("", stop, lists)
+	fmt.Fprintf(log, "%d connections, %d with records of the client, stop=%d\n", len(conns), len(upstream), stop)
+	if down {
+		downstream := downstreamPackets(conns)
+		if stop, lists := learn(downstream, opts, false); stop > 0 {
+			lines = append(lines, sectionLines("down.", stop, lists)...)
+			fmt.Fprintf(log, "%d with records of the server, down.stop=%d\n", len(downstream), stop)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// sectionLines writes the stop and the lists of a section, a packet without records has no list
+func sectionLines(prefix string, stop int, lists []string) []string {
+	lines := []string{prefix + "stop=" + strconv.Itoa(stop)}
+	for pkt, list := range lists {
+		if list != "" {
+			lines = append(lines, prefix+strconv.Itoa(pkt)+"="+list)
+		}
+	}
+	return lines
+}
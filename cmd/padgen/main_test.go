@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"anytls/proxy/padding"
+)
+
+func TestGenerate(t *testing.T) {
+	defaults := learnOptions{coverage: 0.5, maxStop: 12, maxRecords: 8, buckets: 4}
+	for _, test := range []struct {
+		name   string
+		trace  string
+		tshark bool
+		opts   func(opts *learnOptions)
+		down   bool
+		scheme string
+	}{
+		{
+			// the records of a side are grouped by flight, the first flight of the client holds
+			// the authentication, padded without its overhead, and the packet 1 without records
+			name:   "flights",
+			trace:  "134 -1400 -900 64 -512\n# comment\n\n134 -1400 -900 64 -512\n134,-1400,-900,64,-512",
+			down:   true,
+			scheme: "stop=3\n0=100\n2=64\ndown.stop=2\ndown.0=1400,900\ndown.1=512",
+		},
+		{
+			name:   "coverage",
+			trace:  "134 -1400 64 -512 80\n134 -1400 64 -512 80\n134 -1400 64\n134 -1400 64",
+			scheme: "stop=4\n0=100\n2=64\n3=80",
+		},
+		{
+			name:   "coverage 0.75",
+			trace:  "134 -1400 64 -512 80\n134 -1400 64 -512 80\n134 -1400 64\n134 -1400 64",
+			opts:   func(opts *learnOptions) { opts.coverage = 0.75 },
+			scheme: "stop=3\n0=100\n2=64",
+		},
+		{
+			name:   "values",
+			trace:  "134 100\n134 100\n134 200",
+			scheme: "stop=2\n0=100\n1=100@2|200@1",
+		},
+		{
+			// the frequent full records get a bucket, the others are split at the medians
+			name:   "weighted ranges",
+			trace:  "134 100\n134 110\n134 120\n134 500\n134 510\n134 16384\n134 16384\n134 16384",
+			scheme: "stop=2\n0=100\n1=100-111@2|120@1|500-511@2|16384@3",
+		},
+		{
+			// the records after the median count are only sent with data left
+			name:   "check marks",
+			trace:  "134 300\n134 300 400\n134 300 400\n134 300 400 500 600",
+			scheme: "stop=2\n0=100\n1=300,400,c,500,c,600",
+		},
+		{
+			name:   "max records",
+			trace:  "134 300\n134 300 400\n134 300 400\n134 300 400 500 600",
+			opts:   func(opts *learnOptions) { opts.maxRecords = 3 },
+			scheme: "stop=2\n0=100\n1=300,400,c,500",
+		},
+		{
+			name:   "tshark",
+			trace:  "0\t50000\t134,300\n0\t443\t1400,900\n1\t50001\t134,300\n0\t50000\t64\n1\t443\t1400,900\n1\t50001\t64\n2\t50002\t\n",
+			tshark: true,
+			opts:   func(opts *learnOptions) { opts.overhead = 17 },
+			down:   true,
+			scheme: "stop=3\n0=83\n1=283\n2=47\ndown.stop=1\ndown.0=1383,883",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := defaults
+			if test.opts != nil {
+				test.opts(&opts)
+			}
+			var conns []connection
+			var err error
+			if test.tshark {
+				conns, err = readTshark(strings.NewReader(test.trace), 443)
+			} else {
+				conns, err = readTrace(strings.NewReader(test.trace))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			scheme, err := generate(conns, opts, test.down, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(scheme) != test.scheme {
+				t.Fatalf("scheme\n%s\nwant\n%s", scheme, test.scheme)
+			}
+			if _, _, err := padding.ParseScheme(scheme); err != nil {
+				t.Fatal("invalid scheme:", err)
+			}
+		})
+	}
+}
+
+func TestReadTraceErrors(t *testing.T) {
+	for _, trace := range []string{"134 x", "134 0"} {
+		if _, err := readTrace(strings.NewReader(trace)); err == nil {
+			t.Errorf("trace %q read", trace)
+		}
+	}
+	if _, err := readTshark(strings.NewReader("0\thttps\t134"), 443); err == nil {
+		t.Error("tshark line without port read")
+	}
+	if _, err := generate([]connection{{{size: 100, fromServer: true}}}, learnOptions{coverage: 0.5, maxStop: 12, maxRecords: 8, buckets: 4}, true, io.Discard); err == nil {
+		t.Error("scheme without records of clients")
+	}
+}
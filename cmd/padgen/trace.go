@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Traces
+//
+// The trace format has a connection per line, with the sizes of its records in order,
+// separated by spaces or commas. The records sent by the server are negative:
+//
+//	# comment
+//	517 -1400 -2920 64 -512
+//
+// The tshark format is the output of
+//
+//	tshark -r capture.pcap -Y "tls.record.content_type == 23" -T fields -e tcp.stream -e tcp.srcport -e tls.record.length
+//
+// a line per TCP segment with its stream, its source port and the lengths of its records,
+// the records are sent by the server when the source port is the one of the server.
+
+// record is a record of a connection, sent by the client unless fromServer
+type record struct {
+	size       int
+	fromServer bool
+}
+
+type connection []record
+
+func readTrace(r io.Reader) ([]connection, error) {
+	var conns []connection
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var conn connection
+		for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' }) {
+			size, err := strconv.Atoi(field)
+			if err != nil || size == 0 {
+				return nil, fmt.Errorf("line %d: %q is not a record size", line, field)
+			}
+			if size < 0 {
+				conn = append(conn, record{size: -size, fromServer: true})
+			} else {
+				conn = append(conn, record{size: size})
+			}
+		}
+		conns = append(conns, conn)
+	}
+	return conns, scanner.Err()
+}
+
+func readTshark(r io.Reader, serverPort int) ([]connection, error) {
+	streams := make(map[string]int)
+	var conns []connection
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(fields) != 3 || fields[2] == "" {
+			continue
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %q is not a port", line, fields[1])
+		}
+		i, ok := streams[fields[0]]
+		if !ok {
+			i = len(conns)
+			streams[fields[0]] = i
+			conns = append(conns, nil)
+		}
+		for _, field := range strings.Split(fields[2], ",") {
+			size, err := strconv.Atoi(field)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("line %d: %q is not a record length", line, field)
+			}
+			conns[i] = append(conns[i], record{size: size, fromServer: port == serverPort})
+		}
+	}
+	return conns, scanner.Err()
+}
+
+// flights groups the records of one direction of a connection by flight, the records sent
+// by one side until the other side sends, they are the packets of the padding scheme
+func (c connection) flights(fromServer bool) [][]int {
+	var flights [][]int
+	previous := !fromServer
+	for _, r := range c {
+		if r.fromServer != fromServer {
+			previous = r.fromServer
+			continue
+		}
+		if previous != fromServer {
+			flights = append(flights, nil)
+		}
+		flights[len(flights)-1] = append(flights[len(flights)-1], r.size)
+		previous = r.fromServer
+	}
+	return flights
+}
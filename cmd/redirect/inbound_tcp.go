@@ -9,7 +9,6 @@ import (
 	"runtime/debug"
 	"time"
 
-	"anytls/proxy/padding"
 	"anytls/proxy/session"
 
 	"github.com/sagernet/sing/common/buf"
@@ -98,9 +97,12 @@ func handleClientConn(ctx context.Context, c net.Conn, myRedirector *myRedirecto
 		proxyStream, err := myRedirector.CreateProxy(ctx, destination)
 		if err != nil {
 			logrus.Errorf("[Redirect] create proxy for %s failed: %v", c.RemoteAddr(), err)
+			// 把下游的结果转告上游客户端
+			stream.HandshakeFailure(err)
 			return
 		}
 		defer proxyStream.Close()
+		stream.HandshakeSuccess()
 
 		logrus.Infof("[Redirect] start relay %s <-> %s", c.RemoteAddr(), destination.String())
 		done := make(chan struct{}, 2)
@@ -120,9 +122,11 @@ func handleClientConn(ctx context.Context, c net.Conn, myRedirector *myRedirecto
 		}()
 		<-done
 		logrus.Infof("[Redirect] relay finished for %s", c.RemoteAddr())
-	}, &padding.DefaultPaddingFactory)
+	}, serverPadding, nil)
+	serverSessions.Add(session)
 	session.Run()
 	session.Close()
+	serverSessions.Remove(session)
 	logrus.Debugf("[Redirect] session closed for %s", c.RemoteAddr())
 }
 
@@ -2,6 +2,8 @@ package main
 
 import (
 	F "anytls/addon/feedback"
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
 	"anytls/util"
 	"context"
 	"crypto/sha256"
@@ -9,7 +11,9 @@ import (
 	"flag"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -17,10 +21,17 @@ import (
 
 var passwordSha256 []byte
 
+// serverSessions 记录入站会话，收到 SIGTERM 时优雅关闭
+var serverSessions session.SessionGroup
+
+// serverPadding is the scheme of the inbound sessions, separate from the one pushed by the downstream server
+var serverPadding = padding.NewStorage(nil)
+
 func main() {
 	listen := flag.String("l", "0.0.0.0:9443", "redirect listen port")
 	downstream := flag.String("s", "127.0.0.1:8443", "downstream anytls server")
 	password := flag.String("p", "", "password")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "time to let streams finish on SIGTERM")
 	flag.Parse()
 
 	if *password == "" {
@@ -73,9 +84,36 @@ func main() {
 	timer := F.NewTimer(*password, portInt, ctx, cancel)
 	timer.Start()
 
+	// 收到 SIGTERM 后停止接受新连接，通知客户端不再打开新 Stream，等待已有 Stream 结束
+	draining := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		logrus.Infof("[Redirect] draining sessions, timeout %s, signal again to exit now", *drainTimeout)
+		go func() {
+			<-sig
+			logrus.Infoln("[Redirect] exit without draining")
+			os.Exit(1)
+		}()
+		close(draining)
+		listener.Close()
+		serverSessions.Drain(*drainTimeout)
+		close(drained)
+	}()
+
 	for {
 		c, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-draining:
+				<-drained
+				logrus.Infoln("[Redirect] all sessions closed")
+				timer.Stop()
+				return
+			default:
+			}
 			logrus.Fatalln("accept:", err)
 		}
 		logrus.Infof("[Redirect] new client from %s", c.RemoteAddr())
@@ -10,8 +10,12 @@ import (
 	"time"
 
 	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/uot"
 )
 
+// handshakeTimeout 等待下游 server 连接目标地址的最长时间
+const handshakeTimeout = 10 * time.Second
+
 // DialFunc 定义出站拨号函数类型
 // 可自定义实现（如 anytls、socks5、tls 等）
 type DialFunc func(ctx context.Context, addr net.Addr) (net.Conn, error)
@@ -114,21 +118,29 @@ func NewMyRedirector(ctx context.Context, downstream string, tlsConfig *tls.Conf
 			return nil, err
 		}
 		return conn, nil
-	}, nil, 5*time.Second, 5*time.Second, 4)
+	}, nil, 5*time.Second, 5*time.Second, 4,
+		session.KeepaliveConfig{Interval: 15 * time.Second, Timeout: 5 * time.Second, MaxMissed: 3})
 	return &myRedirector{client: client}
 }
 
 // CreateProxy 创建到下游 server 的 stream，返回 net.Conn（协议式转发，写入目标地址到下游server）
+// 并等待下游 server 连接目标地址的结果，连接失败时返回下游的错误
 func (r *myRedirector) CreateProxy(ctx context.Context, targetAddr net.Addr) (net.Conn, error) {
-	stream, err := r.client.CreateStream(ctx)
-	if err != nil {
-		return nil, err
-	}
 	// 直接断言为 M.Socksaddr 类型，确保协议一致
 	sa := targetAddr.(M.Socksaddr)
-	if err := M.SocksaddrSerializer.WriteAddrPort(stream, sa); err != nil {
-		stream.Close()
-		return nil, err
+	if sa.Fqdn == uot.MagicAddress || sa.Fqdn == uot.LegacyMagicAddress {
+		// udp over tcp 的出站结果在第一个包之后才报告，不等待
+		stream, err := r.client.CreateStream(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := M.SocksaddrSerializer.WriteAddrPort(stream, sa); err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return stream, nil
 	}
-	return stream, nil
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	return r.client.CreateStream(ctx, session.WithHandshake(sa))
 }
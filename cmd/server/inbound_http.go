@@ -0,0 +1,35 @@
+package main
+
+import (
+	"anytls/proxy/transport"
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serveHTTP serves the sessions as WebSockets (ws) or HTTP/2 requests (h2) on path,
+// over TLS, until the listener is closed
+func serveHTTP(ctx context.Context, listener net.Listener, s *myServer, kind, path string) error {
+	handle := func(c net.Conn) {
+		logrus.Debugf("[Server] new %s connection from %s", kind, c.RemoteAddr())
+		handleConnection(ctx, c, s)
+	}
+	tlsConfig := s.tlsConfig.Clone()
+	var handler http.Handler
+	if kind == "h2" {
+		handler = transport.HTTP2Handler(path, handle)
+		tlsConfig.NextProtos = []string{"h2"}
+	} else {
+		handler = transport.WebSocketHandler(path, handle)
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+	server := &http.Server{
+		Handler:  handler,
+		ErrorLog: log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0),
+	}
+	return server.Serve(tls.NewListener(listener, tlsConfig))
+}
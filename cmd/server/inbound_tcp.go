@@ -1,7 +1,6 @@
 package main
 
 import (
-	"anytls/proxy/padding"
 	"anytls/proxy/session"
 	"bytes"
 	"context"
@@ -18,14 +17,17 @@ import (
 )
 
 func handleTcpConnection(ctx context.Context, c net.Conn, s *myServer) {
+	logrus.Debugf("[Server] new connection from %s", c.RemoteAddr())
+	handleConnection(ctx, tls.Server(c, s.tlsConfig), s)
+}
+
+// handleConnection authenticates a connection of any transport and runs its session
+func handleConnection(ctx context.Context, c net.Conn, s *myServer) {
 	defer func() {
 		if r := recover(); r != nil {
 			logrus.Errorln("[BUG]", r, string(debug.Stack()))
 		}
 	}()
-
-	logrus.Debugf("[Server] new connection from %s", c.RemoteAddr())
-	c = tls.Server(c, s.tlsConfig)
 	defer func() {
 		logrus.Debugf("[Server] connection from %s closed", c.RemoteAddr())
 		c.Close()
@@ -99,9 +101,11 @@ func handleTcpConnection(ctx context.Context, c net.Conn, s *myServer) {
 			logrus.Debugf("[Server] proxyOutboundTCP for %s", c.RemoteAddr())
 			proxyOutboundTCP(ctx, stream, destination)
 		}
-	}, &padding.DefaultPaddingFactory)
+	}, s.padding, s.sessionConfig)
+	s.sessions.Add(session)
 	session.Run()
 	session.Close()
+	s.sessions.Remove(session)
 	logrus.Debugf("[Server] session closed for %s", c.RemoteAddr())
 }
 
@@ -3,6 +3,7 @@ package main
 import (
 	F "anytls/addon/feedback"
 	"anytls/proxy/padding"
+	"anytls/proxy/session"
 	"anytls/util"
 	"context"
 	"crypto/sha256"
@@ -11,7 +12,9 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -23,22 +26,55 @@ func main() {
 	listen := flag.String("l", "0.0.0.0:8443", "server listen port")
 	password := flag.String("p", "", "password")
 	paddingScheme := flag.String("padding-scheme", "", "padding-scheme")
+	maxStreams := flag.Int("max-streams", 0, "max concurrent streams per session, 0 for unlimited")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "time to let streams finish on SIGTERM")
+	allowReverse := flag.Bool("allow-reverse", false, "allow clients to listen on this server for reverse tunnels")
+	reverseAllow := flag.String("reverse-allow", "*:1024-65535", "comma separated addresses the reverse tunnels may listen on, HOST:PORT or HOST:LO-HI, * is any host")
+	udpTimeout := flag.Duration("udp-timeout", time.Minute, "idle timeout of the udp associations of clients")
+	maxAssociations := flag.Int("max-udp-associations", 64, "max udp associations per session, each with its own socket")
+	resumeTimeout := flag.Duration("resume-timeout", time.Minute, "time to keep the sessions of clients after their connection breaks, 0 to disable")
+	memoryLimit := flag.Int64("memory-limit", 0, "MiB of buffered data for all sessions, 0 for unlimited")
+	sessionMemoryLimit := flag.Int64("session-memory-limit", 0, "MiB of buffered data for each session, 0 for unlimited")
+	transportKind := flag.String("transport", "tcp", "transport of the sessions: tcp, ws (WebSocket) or h2 (HTTP/2)")
+	httpPath := flag.String("path", "/", "HTTP path of the ws and h2 transports")
+	metrics := flag.String("metrics", "", "listen address of the metrics at /debug/vars, empty to disable")
 	flag.Parse()
 
 	if *password == "" {
 		logrus.Fatalln("please set password")
 	}
+	switch *transportKind {
+	case "tcp", "ws", "h2":
+	default:
+		logrus.Fatalln("unknown transport:", *transportKind)
+	}
+	var paddingF *padding.PaddingFactory
 	if *paddingScheme != "" {
 		if f, err := os.Open(*paddingScheme); err == nil {
 			b, err := io.ReadAll(f)
 			if err != nil {
 				logrus.Fatalln(err)
 			}
-			if padding.UpdatePaddingScheme(b) {
-				logrus.Infoln("loaded padding scheme file:", *paddingScheme)
-			} else {
-				logrus.Errorln("wrong format padding scheme file:", *paddingScheme)
+			// parsed like the schemes pushed to the clients, the lines and items they skip are only warned about
+			p := padding.NewPaddingFactory(b)
+			_, warnings, err := padding.ParseScheme(b)
+			for _, w := range warnings {
+				logrus.Warnln("padding scheme file:", w)
+			}
+			if err != nil {
+				for _, issue := range err.(interface{ Unwrap() []error }).Unwrap() {
+					if p == nil {
+						logrus.Errorln("padding scheme file:", issue)
+					} else {
+						logrus.Warnln("padding scheme file: skipped:", issue)
+					}
+				}
 			}
+			if p == nil {
+				logrus.Fatalln("wrong format padding scheme file:", *paddingScheme)
+			}
+			paddingF = p
+			logrus.Infoln("loaded padding scheme file:", *paddingScheme)
 			f.Close()
 		} else {
 			logrus.Fatalln(err)
@@ -57,7 +93,7 @@ func main() {
 	passwordSha256 = sum[:]
 
 	logrus.Infoln("[Server]", util.ProgramVersionName)
-	logrus.Infoln("[Server] Listening TCP", *listen)
+	logrus.Infoln("[Server] Listening TCP", *listen, "transport", *transportKind)
 
 	// listen
 	listener, err := net.Listen("tcp", *listen)
@@ -85,14 +121,74 @@ func main() {
 
 	// server
 	ctx, cancel := context.WithCancel(context.Background())
-	server := NewMyServer(tlsConfig)
+	sessionConfig := &session.ServerConfig{
+		MaxStreams:          *maxStreams,
+		DatagramIdleTimeout: *udpTimeout,
+		MaxAssociations:     *maxAssociations,
+		Memory:              session.NewMemoryBudget(*memoryLimit<<20, *sessionMemoryLimit<<20),
+	}
+	if *resumeTimeout > 0 {
+		sessionConfig.Resume = session.NewResumeStore(*resumeTimeout)
+	}
+	if *metrics != "" {
+		serveMetrics(*metrics, sessionConfig.Memory)
+	}
+	server := NewMyServer(tlsConfig, sessionConfig, paddingF)
+	sessionConfig.OnPacketConn = server.handlePacketConn(ctx)
+	if *allowReverse {
+		rules, err := parseReverseRules(*reverseAllow)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+		sessionConfig.OnBind = server.handleBind(ctx, rules)
+	}
 
 	timer := F.NewTimer(*password, portInt, ctx, cancel)
 	timer.Start()
 
+	// graceful shutdown
+	draining := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		logrus.Infof("[Server] draining sessions, timeout %s, signal again to exit now", *drainTimeout)
+		go func() {
+			<-sig
+			logrus.Infoln("[Server] exit without draining")
+			os.Exit(1)
+		}()
+		close(draining)
+		listener.Close()
+		server.sessions.Drain(*drainTimeout)
+		close(drained)
+	}()
+
+	if *transportKind != "tcp" {
+		err := serveHTTP(ctx, listener, server, *transportKind, *httpPath)
+		select {
+		case <-draining:
+			<-drained
+			logrus.Infoln("[Server] all sessions closed")
+			timer.Stop()
+			return
+		default:
+		}
+		logrus.Fatalln("serve http:", err)
+	}
+
 	for {
 		c, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-draining:
+				<-drained
+				logrus.Infoln("[Server] all sessions closed")
+				timer.Stop()
+				return
+			default:
+			}
 			logrus.Fatalln("accept:", err)
 		}
 		go handleTcpConnection(ctx, c, server)
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"anytls/proxy/session"
+	"expvar"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serveMetrics publishes the memory usage and the protocol violations of the sessions
+// as JSON at /debug/vars
+func serveMetrics(listen string, memory *session.MemoryBudget) {
+	expvar.Publish("memory", expvar.Func(func() any {
+		return memory.Stats()
+	}))
+	expvar.Publish("violations", expvar.Func(func() any {
+		return session.ViolationCounts()
+	}))
+	go func() {
+		logrus.Infoln("[Server] metrics on", listen)
+		if err := http.ListenAndServe(listen, nil); err != nil {
+			logrus.Errorln("metrics:", err)
+		}
+	}()
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
 	"crypto/tls"
+
+	"github.com/sagernet/sing/common/atomic"
 )
 
 type myServer struct {
-	tlsConfig *tls.Config
+	tlsConfig     *tls.Config
+	sessionConfig *session.ServerConfig
+	sessions      session.SessionGroup
+	// padding is the scheme of the server, pushed to its clients
+	padding *atomic.TypedValue[*padding.PaddingFactory]
 }
 
-func NewMyServer(tlsConfig *tls.Config) *myServer {
+func NewMyServer(tlsConfig *tls.Config, sessionConfig *session.ServerConfig, paddingF *padding.PaddingFactory) *myServer {
 	s := &myServer{
-		tlsConfig: tlsConfig,
+		tlsConfig:     tlsConfig,
+		sessionConfig: sessionConfig,
+		padding:       padding.NewStorage(paddingF),
 	}
 	return s
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"anytls/proxy"
+	"anytls/proxy/session"
 	"context"
 	"net"
 
@@ -21,7 +22,12 @@ func proxyOutboundTCP(ctx context.Context, conn net.Conn, destination M.Socksadd
 		return err
 	}
 
-	err = N.ReportHandshakeSuccess(conn)
+	if stream, ok := conn.(*session.Stream); ok {
+		// the client may reply the bound address to its socks5 inbound
+		err = stream.HandshakeSuccessBound(M.SocksaddrFromNet(c.LocalAddr()))
+	} else {
+		err = N.ReportHandshakeSuccess(conn)
+	}
 	if err != nil {
 		return err
 	}
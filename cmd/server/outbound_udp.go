@@ -0,0 +1,32 @@
+package main
+
+import (
+	"anytls/proxy/session"
+	"context"
+	"net"
+	"runtime/debug"
+
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sirupsen/logrus"
+)
+
+// handlePacketConn relays the datagrams of an association through its own udp socket,
+// until the session forgets the idle association
+func (s *myServer) handlePacketConn(ctx context.Context) func(conn *session.PacketConn) {
+	return func(conn *session.PacketConn) {
+		defer func() {
+			if r := recover(); r != nil {
+				logrus.Errorln("[BUG]", r, string(debug.Stack()))
+			}
+		}()
+
+		c, err := net.ListenPacket("udp", "")
+		if err != nil {
+			logrus.Debugln("handlePacketConn ListenPacket:", err)
+			return
+		}
+		logrus.Debugln("[Server] datagram association", c.LocalAddr())
+		bufio.CopyPacketConn(ctx, conn, bufio.NewPacketConn(c))
+		logrus.Debugln("[Server] datagram association", c.LocalAddr(), "closed")
+	}
+}
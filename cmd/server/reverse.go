@@ -0,0 +1,140 @@
+package main
+
+import (
+	"anytls/proxy/session"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+// reverseRule allows the clients to listen on an address, or any address, within a range of ports
+type reverseRule struct {
+	any    bool
+	addr   netip.Addr
+	lo, hi uint16
+}
+
+// reverseRules is the allow-list of the addresses of reverse tunnels
+type reverseRules []reverseRule
+
+// parseReverseRules parses comma separated HOST:PORT or HOST:LO-HI rules,
+// HOST is an IP address or * for any address, IPv6 addresses are in brackets
+func parseReverseRules(s string) (reverseRules, error) {
+	var rules reverseRules
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, ports, err := net.SplitHostPort(item)
+		if err != nil {
+			return nil, fmt.Errorf("reverse rule %q: %w", item, err)
+		}
+		var rule reverseRule
+		if host == "*" {
+			rule.any = true
+		} else if rule.addr, err = netip.ParseAddr(host); err != nil {
+			return nil, fmt.Errorf("reverse rule %q: %w", item, err)
+		}
+		lo, hi, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.ParseUint(lo, 10, 16)
+		to, err2 := strconv.ParseUint(hi, 10, 16)
+		if err1 != nil || err2 != nil || from == 0 || from > to {
+			return nil, fmt.Errorf("reverse rule %q: invalid ports", item)
+		}
+		rule.lo, rule.hi = uint16(from), uint16(to)
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// allow reports whether a rule allows the address, a listen address without host is the unspecified address
+func (r reverseRules) allow(address string) bool {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil || port == 0 {
+		return false
+	}
+	addr := netip.IPv4Unspecified()
+	if host != "" {
+		if addr, err = netip.ParseAddr(host); err != nil {
+			addr = netip.Addr{}
+		}
+	}
+	for _, rule := range r {
+		if uint16(port) < rule.lo || uint16(port) > rule.hi {
+			continue
+		}
+		// host names are only allowed by the rules of any address
+		if rule.any || addr.IsValid() && addr.Unmap() == rule.addr.Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// handleBind listens on the address requested by the client and forwards
+// the accepted connections back to it, until the session is closed.
+// The addresses which are not allowed by rules are refused.
+func (s *myServer) handleBind(ctx context.Context, rules reverseRules) session.BindHandler {
+	return func(sess *session.Session, bindID uint32, address string) error {
+		if !rules.allow(address) {
+			logrus.Warnln("[Server] reverse bind", address, "refused by -reverse-allow")
+			return fmt.Errorf("%s: %w", address, session.ErrNotAllowed)
+		}
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			logrus.Warnln("[Server] reverse bind", address, "failed:", err)
+			return err
+		}
+		logrus.Infoln("[Server] reverse bind", listener.Addr())
+
+		go func() {
+			<-sess.Done()
+			listener.Close()
+			logrus.Infoln("[Server] reverse bind", listener.Addr(), "closed")
+		}()
+		go func() {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go handleReverseConnection(ctx, sess, bindID, c)
+			}
+		}()
+		return nil
+	}
+}
+
+func handleReverseConnection(ctx context.Context, sess *session.Session, bindID uint32, c net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorln("[BUG]", r, string(debug.Stack()))
+		}
+	}()
+	defer c.Close()
+
+	stream, err := sess.OpenReverseStream(bindID, M.SocksaddrFromNet(c.RemoteAddr()))
+	if err != nil {
+		logrus.Debugln("[Server] OpenReverseStream:", err)
+		return
+	}
+	defer stream.Close()
+
+	bufio.CopyConn(ctx, c, stream)
+}
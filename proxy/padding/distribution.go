@@ -0,0 +1,220 @@
+package padding
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Distributions
+//
+// A size or delay item in the list of a packet draws its value from a distribution:
+//
+//	min-max       uniform in [min, max), as in the first schemes
+//	v             the value v
+//	norm(μ;σ)     normal with mean μ and standard deviation σ, rounded
+//	lognorm(μ;σ)  log-normal, μ and σ are those of the logarithm of the value
+//
+// Alternatives joined by | are picked by their weight @w, 1 if not given:
+// 100-200@3|1400 draws from 100-200 three times out of four, 1400 otherwise,
+// and 517|1024|1400 picks one of three sizes. Implementations which do not know
+// a form skip the item, like any other item they do not understand.
+
+// maxRecordSize bounds the sizes drawn, it is the largest length of the auth padding
+const maxRecordSize = math.MaxUint16
+
+type distKind uint8
+
+const (
+	distUniform distKind = iota
+	distNormal
+	distLogNormal
+)
+
+// bucket is an alternative of a distribution, a and b are min and max or μ and σ
+type bucket struct {
+	kind   distKind
+	a, b   float64
+	weight uint64
+}
+
+type distribution struct {
+	buckets     []bucket
+	totalWeight uint64
+}
+
+// parseDistribution parses an item without its directive prefix, lowest is the smallest min-max allowed
+func parseDistribution(s string, lowest int64) (distribution, error) {
+	var d distribution
+	for _, alt := range strings.Split(s, "|") {
+		weight := uint64(1)
+		if value, w, ok := strings.Cut(alt, "@"); ok {
+			n, err := strconv.ParseUint(w, 10, 32)
+			if err != nil || n == 0 {
+				return d, fmt.Errorf("weight %q is not a positive integer", w)
+			}
+			alt, weight = value, n
+		}
+		b, err := parseBucket(alt, lowest)
+		if err != nil {
+			return d, err
+		}
+		b.weight = weight
+		d.buckets = append(d.buckets, b)
+		d.totalWeight += weight
+	}
+	return d, nil
+}
+
+func parseBucket(s string, lowest int64) (bucket, error) {
+	for _, f := range []struct {
+		name string
+		kind distKind
+	}{{"norm", distNormal}, {"lognorm", distLogNormal}} {
+		args, ok := strings.CutPrefix(s, f.name+"(")
+		if !ok {
+			continue
+		}
+		args, ok = strings.CutSuffix(args, ")")
+		if !ok {
+			return bucket{}, fmt.Errorf("%s is not closed by )", f.name)
+		}
+		mu, sigma, ok := strings.Cut(args, ";")
+		if !ok {
+			return bucket{}, fmt.Errorf("%s needs μ;σ", f.name)
+		}
+		a, err := strconv.ParseFloat(mu, 64)
+		if err != nil || math.IsNaN(a) || math.IsInf(a, 0) {
+			return bucket{}, fmt.Errorf("μ %q is not a number", mu)
+		}
+		b, err := strconv.ParseFloat(sigma, 64)
+		if err != nil || !(b >= 0) || math.IsInf(b, 0) {
+			return bucket{}, fmt.Errorf("σ %q is not a non-negative number", sigma)
+		}
+		return bucket{kind: f.kind, a: a, b: b}, nil
+	}
+
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	_min, err := strconv.ParseInt(lo, 10, 64)
+	if err != nil {
+		return bucket{}, fmt.Errorf("%q is not a number", lo)
+	}
+	_max, err := strconv.ParseInt(hi, 10, 64)
+	if err != nil {
+		return bucket{}, fmt.Errorf("%q is not a number", hi)
+	}
+	_min, _max = min(_min, _max), max(_min, _max)
+	if _min < lowest {
+		return bucket{}, fmt.Errorf("%d is below %d", _min, lowest)
+	}
+	return bucket{kind: distUniform, a: float64(_min), b: float64(_max)}, nil
+}
+
+// upper is about the largest value drawn, three standard deviations above the mean for the normal forms
+func (d distribution) upper() float64 {
+	var v float64
+	for _, b := range d.buckets {
+		switch b.kind {
+		case distUniform:
+			v = max(v, b.b)
+		case distNormal:
+			v = max(v, b.a+3*b.b)
+		case distLogNormal:
+			v = max(v, math.Exp(b.a+3*b.b))
+		}
+	}
+	return v
+}
+
+func (b bucket) String() string {
+	switch b.kind {
+	case distNormal:
+		return fmt.Sprintf("normal(mean %g, σ %g)", b.a, b.b)
+	case distLogNormal:
+		return fmt.Sprintf("log-normal(median %.0f, σ %g)", math.Exp(b.a), b.b)
+	}
+	if b.a == b.b {
+		return fmt.Sprintf("%.0f", b.a)
+	}
+	return fmt.Sprintf("%.0f-%.0f", b.a, b.b)
+}
+
+func (d distribution) String() string {
+	if len(d.buckets) == 1 {
+		return d.buckets[0].String()
+	}
+	parts := make([]string, len(d.buckets))
+	for i, b := range d.buckets {
+		parts[i] = fmt.Sprintf("%s (%.0f%%)", b, float64(b.weight)*100/float64(d.totalWeight))
+	}
+	return strings.Join(parts, " or ")
+}
+
+// draw returns a value of the distribution within [lo, hi]
+func (d distribution) draw(r *rand.Rand, lo, hi int64) int64 {
+	b := d.buckets[0]
+	if len(d.buckets) > 1 {
+		n := r.Uint64N(d.totalWeight)
+		for _, b = range d.buckets {
+			if n < b.weight {
+				break
+			}
+			n -= b.weight
+		}
+	}
+	var v float64
+	switch b.kind {
+	case distUniform:
+		v = b.a
+		if b.b > b.a {
+			v += float64(r.Int64N(int64(b.b - b.a)))
+		}
+	case distNormal:
+		v = math.Round(b.a + b.b*r.NormFloat64())
+	case distLogNormal:
+		v = math.Round(math.Exp(b.a + b.b*r.NormFloat64()))
+	}
+	return int64(max(float64(lo), min(v, float64(hi))))
+}
+
+// cryptoSource draws from crypto/rand, it is safe for concurrent use
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	crand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// lockedSource makes a deterministic source safe for concurrent use
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+var cryptoRand = rand.New(cryptoSource{})
+
+// WithSeed returns a copy of the factory which draws deterministic values from seed, for tests and simulations.
+// The copy is safe for concurrent use, but concurrent callers make the sequence depend on their order.
+func (p *PaddingFactory) WithSeed(seed uint64) *PaddingFactory {
+	seeded := *p
+	seeded.rng = rand.New(&lockedSource{src: rand.NewPCG(seed, 0)})
+	if p.Down != nil {
+		seeded.Down = p.Down.WithSeed(seed + 1)
+	}
+	return &seeded
+}
@@ -0,0 +1,127 @@
+package padding
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+const drawScheme = `stop=8
+0=30-30
+1=100-200
+2=517
+3=norm(1000;50)
+4=lognorm(6;0.5)
+5=100-200@3|1400
+6=norm(10;100)
+7=d100-200,300`
+
+// drawAll draws the first record of the packet pkt n times
+func drawAll(t *testing.T, p *PaddingFactory, pkt uint32, n int) []float64 {
+	t.Helper()
+	values := make([]float64, n)
+	for i := range values {
+		records := p.GenerateRecords(pkt)
+		if len(records) == 0 {
+			t.Fatalf("packet %d has no record", pkt)
+		}
+		if records[0].Delay > 0 {
+			values[i] = float64(records[0].Delay / time.Millisecond)
+		} else {
+			values[i] = float64(records[0].Size)
+		}
+	}
+	return values
+}
+
+func meanStddev(values []float64) (mean, stddev float64) {
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		stddev += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(stddev / float64(len(values)))
+}
+
+func TestDraw(t *testing.T) {
+	scheme := NewPaddingFactory([]byte(drawScheme))
+	if scheme == nil {
+		t.Fatal("invalid scheme")
+	}
+	p := scheme.WithSeed(1)
+	const n = 10000
+
+	uniform := drawAll(t, p, 1, n)
+	if lo, hi := slices.Min(uniform), slices.Max(uniform); lo != 100 || hi < 195 || hi >= 200 {
+		t.Errorf("uniform 100-200 drew within [%v, %v]", lo, hi)
+	}
+	if mean, _ := meanStddev(uniform); math.Abs(mean-150) > 2 {
+		t.Errorf("uniform 100-200 mean %v", mean)
+	}
+
+	for _, v := range drawAll(t, p, 2, 100) {
+		if v != 517 {
+			t.Fatalf("value 517 drew %v", v)
+		}
+	}
+
+	if mean, stddev := meanStddev(drawAll(t, p, 3, n)); math.Abs(mean-1000) > 2 || math.Abs(stddev-50) > 2 {
+		t.Errorf("norm(1000;50) mean %v, standard deviation %v", mean, stddev)
+	}
+
+	lognorm := drawAll(t, p, 4, n)
+	sort.Float64s(lognorm)
+	if median := lognorm[n/2]; math.Abs(median-math.Exp(6)) > math.Exp(6)*0.05 {
+		t.Errorf("lognorm(6;0.5) median %v, want about %v", median, math.Exp(6))
+	}
+
+	var large int
+	for _, v := range drawAll(t, p, 5, n) {
+		switch {
+		case v == 1400:
+			large++
+		case v < 100 || v >= 200:
+			t.Fatalf("100-200@3|1400 drew %v", v)
+		}
+	}
+	if ratio := float64(large) / n; math.Abs(ratio-0.25) > 0.02 {
+		t.Errorf("1400 drawn %.3f of the times, want 0.25 by the weights 3 and 1", ratio)
+	}
+
+	// the sizes stay within a record
+	if lo := slices.Min(drawAll(t, p, 6, n)); lo != 1 {
+		t.Errorf("norm(10;100) drew %v, want 1 at least and at times", lo)
+	}
+
+	delays := drawAll(t, p, 7, n)
+	if lo, hi := slices.Min(delays), slices.Max(delays); lo < 100 || hi >= 200 {
+		t.Errorf("d100-200 waited within [%v, %v] ms", lo, hi)
+	}
+}
+
+func TestWithSeed(t *testing.T) {
+	scheme := NewPaddingFactory([]byte(drawScheme + "\ndown.stop=1\ndown.0=norm(500;100)"))
+	if scheme == nil {
+		t.Fatal("invalid scheme")
+	}
+	draw := func(p *PaddingFactory) (sizes []int) {
+		for pkt := uint32(1); pkt < p.Stop; pkt++ {
+			sizes = append(sizes, p.GenerateRecordPayloadSizes(pkt)...)
+		}
+		return append(sizes, p.Down.GenerateRecordPayloadSizes(0)...)
+	}
+	a, b, c := draw(scheme.WithSeed(7)), draw(scheme.WithSeed(7)), draw(scheme.WithSeed(8))
+	if !slices.Equal(a, b) {
+		t.Fatalf("seed 7 drew %v then %v", a, b)
+	}
+	if slices.Equal(a, c) {
+		t.Fatal("seeds 7 and 8 drew the same sizes")
+	}
+	if scheme.rng != nil {
+		t.Fatal("WithSeed changed the factory")
+	}
+}
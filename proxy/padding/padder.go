@@ -0,0 +1,82 @@
+package padding
+
+import (
+	"math"
+	"time"
+)
+
+// The cmdWaste frames completing the records have the header of the session frames,
+// and carry at most maxWasteSize bytes like the other frames (see proxy/session/frame.go)
+const (
+	wasteHeaderSize = 1 + 4 + 2
+	maxWasteSize    = math.MaxUint16 - wasteHeaderSize
+)
+
+// Write is a step of a padded packet: a wait of Delay, or a write to the connection of
+// Payload bytes of the data followed by a cmdWaste frame of Waste bytes when Waste is not 0
+type Write struct {
+	Delay   time.Duration
+	Payload int
+	Waste   int
+}
+
+// Size is the number of bytes written to the connection
+func (w Write) Size() int {
+	if w.Waste > 0 {
+		return w.Payload + wasteHeaderSize + w.Waste
+	}
+	return w.Payload
+}
+
+// Padder cuts the writes of a connection into the packets of a scheme, Session.writeConn
+// and Simulate share it. It is not safe for concurrent use.
+type Padder struct {
+	next    uint32
+	delayed time.Duration
+}
+
+// NewPadder starts at the packet first, the packet 0 of clients is their authentication
+func NewPadder(first uint32) Padder {
+	return Padder{next: first}
+}
+
+// Next returns how to write the next n bytes, ok is false when p is nil or the packet reaches its stop.
+// The delays of a connection stop at MaxConnectionDelay.
+func (c *Padder) Next(p *PaddingFactory, n int) (writes []Write, ok bool) {
+	pkt := c.next
+	c.next++
+	if p == nil || pkt >= p.Stop {
+		return nil, false
+	}
+	for _, record := range p.GenerateRecords(pkt) {
+		if record.Size == 0 {
+			if d := min(record.Delay, MaxConnectionDelay-c.delayed); d > 0 {
+				c.delayed += d
+				writes = append(writes, Write{Delay: d})
+			}
+			continue
+		}
+		l := record.Size
+		if l == CheckMark {
+			if n == 0 {
+				break
+			} else {
+				continue
+			}
+		}
+		if n > l { // this packet is all payload
+			writes = append(writes, Write{Payload: l})
+			n -= l
+		} else if n > 0 { // this packet contains padding and the last part of payload
+			writes = append(writes, Write{Payload: n, Waste: max(min(l-n-wasteHeaderSize, maxWasteSize), 0)})
+			n = 0
+		} else { // this packet is all padding
+			writes = append(writes, Write{Waste: min(l, maxWasteSize)})
+		}
+	}
+	// maybe still remain payload to write
+	if n > 0 {
+		writes = append(writes, Write{Payload: n})
+	}
+	return writes, true
+}
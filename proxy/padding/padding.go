@@ -1,19 +1,25 @@
 package padding
 
 import (
-	"anytls/util"
-	"crypto/md5"
-	"crypto/rand"
-	"fmt"
-	"math/big"
-	"strconv"
+	"math/rand/v2"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sagernet/sing/common/atomic"
 )
 
 const CheckMark = -1
 
+// Delay directives: dMIN-MAX in the list of a packet waits MIN to MAX milliseconds at its position,
+// before the packet when it comes first, between split records, or after the packet when it comes last.
+const (
+	// MaxDelay caps each delay directive
+	MaxDelay = time.Second
+	// MaxConnectionDelay caps the delays of all the packets of a connection together
+	MaxConnectionDelay = 3 * time.Second
+)
+
 var defaultPaddingScheme = []byte(`stop=8
 0=30-30
 1=100-400
@@ -22,74 +28,131 @@ var defaultPaddingScheme = []byte(`stop=8
 4=500-1000
 5=500-1000
 6=500-1000
-7=500-1000`)
+7=500-1000
+down.stop=5
+down.0=100-400
+down.1=400-500,c,500-1000,c,500-1000,c,500-1000,c,500-1000
+down.2=500-1000
+down.3=500-1000
+down.4=500-1000`)
+
+// downPrefix marks the keys of the downstream section, which pads the writes of servers
+const downPrefix = "down."
 
 type PaddingFactory struct {
-	scheme    util.StringMap
+	packets   map[uint32][]directive
+	rng       *rand.Rand // nil draws from crypto/rand
 	RawScheme []byte
 	Stop      uint32
 	Md5       string
+
+	// Down pads the writes of servers, nil if the scheme has no downstream section
+	Down *PaddingFactory
+	// UpstreamScheme is RawScheme without the downstream section, for clients which do not support it
+	UpstreamScheme []byte
+	UpstreamMd5    string
 }
 
-var DefaultPaddingFactory atomic.TypedValue[*PaddingFactory]
+// DefaultPaddingFactory returns the factory of the default scheme, shared as it is never changed
+var DefaultPaddingFactory = sync.OnceValue(func() *PaddingFactory {
+	return NewPaddingFactory(defaultPaddingScheme)
+})
 
-func init() {
-	UpdatePaddingScheme(defaultPaddingScheme)
+// NewStorage returns the padding of a client or a server, starting with p or the default scheme if p is nil.
+// Each session.Client has its own, the schemes pushed by its server only replace the one of that client.
+func NewStorage(p *PaddingFactory) *atomic.TypedValue[*PaddingFactory] {
+	if p == nil {
+		p = DefaultPaddingFactory()
+	}
+	storage := new(atomic.TypedValue[*PaddingFactory])
+	storage.Store(p)
+	return storage
 }
 
-func UpdatePaddingScheme(rawScheme []byte) bool {
-	if p := NewPaddingFactory(rawScheme); p != nil {
-		DefaultPaddingFactory.Store(p)
-		return true
+// NewPaddingFactory parses rawScheme, the lines and items which are not understood are skipped.
+// It returns nil if the scheme is unusable, ParseScheme tells why.
+func NewPaddingFactory(rawScheme []byte) *PaddingFactory {
+	p, ps := parseScheme(rawScheme)
+	if ps.fatal {
+		return nil
 	}
-	return false
+	return p
 }
 
-func NewPaddingFactory(rawScheme []byte) *PaddingFactory {
-	p := &PaddingFactory{
-		RawScheme: rawScheme,
-		Md5:       fmt.Sprintf("%x", md5.Sum(rawScheme)),
+// stripDownstream removes the lines of the downstream section, the other lines are kept as they are
+func stripDownstream(rawScheme []byte) []byte {
+	lines := strings.Split(string(rawScheme), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, downPrefix) {
+			kept = append(kept, line)
+		}
 	}
-	scheme := util.StringMapFromBytes(rawScheme)
-	if len(scheme) == 0 {
-		return nil
+	return []byte(strings.Join(kept, "\n"))
+}
+
+type directiveKind uint8
+
+const (
+	directiveSize directiveKind = iota
+	directiveCheck
+	directiveDelay
+)
+
+// directive is an item in the list of a packet, a size or delay, or the check mark
+type directive struct {
+	kind directiveKind
+	dist distribution
+}
+
+// Describe tells what the list of the packet pkt does, it is empty if the packet has no list
+func (p *PaddingFactory) Describe(pkt uint32) string {
+	list := p.packets[pkt]
+	parts := make([]string, len(list))
+	for i, d := range list {
+		switch d.kind {
+		case directiveSize:
+			parts[i] = d.dist.String() + " bytes"
+		case directiveCheck:
+			parts[i] = "end if no data is left"
+		case directiveDelay:
+			parts[i] = "wait " + d.dist.String() + " ms"
+		}
 	}
-	if stop, err := strconv.Atoi(scheme["stop"]); err == nil {
-		p.Stop = uint32(stop)
-	} else {
-		return nil
+	return strings.Join(parts, ", ")
+}
+
+// Record is a step of a packet, a record of Size bytes (or CheckMark), or a wait of Delay before the next step
+type Record struct {
+	Size  int
+	Delay time.Duration
+}
+
+// GenerateRecords returns the steps of the packet pkt, delays included
+func (p *PaddingFactory) GenerateRecords(pkt uint32) (records []Record) {
+	rng := p.rng
+	if rng == nil {
+		rng = cryptoRand
 	}
-	p.scheme = scheme
-	return p
+	for _, d := range p.packets[pkt] {
+		switch d.kind {
+		case directiveSize:
+			records = append(records, Record{Size: int(d.dist.draw(rng, 1, maxRecordSize))})
+		case directiveCheck:
+			records = append(records, Record{Size: CheckMark})
+		case directiveDelay:
+			ms := d.dist.draw(rng, 0, MaxDelay.Milliseconds())
+			records = append(records, Record{Delay: time.Duration(ms) * time.Millisecond})
+		}
+	}
+	return
 }
 
+// GenerateRecordPayloadSizes returns the record sizes of the packet pkt, delays are left out
 func (p *PaddingFactory) GenerateRecordPayloadSizes(pkt uint32) (pktSizes []int) {
-	if s, ok := p.scheme[strconv.Itoa(int(pkt))]; ok {
-		sRanges := strings.Split(s, ",")
-		for _, sRange := range sRanges {
-			sRangeMinMax := strings.Split(sRange, "-")
-			if len(sRangeMinMax) == 2 {
-				_min, err := strconv.ParseInt(sRangeMinMax[0], 10, 64)
-				if err != nil {
-					continue
-				}
-				_max, err := strconv.ParseInt(sRangeMinMax[1], 10, 64)
-				if err != nil {
-					continue
-				}
-				_min, _max = min(_min, _max), max(_min, _max)
-				if _min <= 0 || _max <= 0 {
-					continue
-				}
-				if _min == _max {
-					pktSizes = append(pktSizes, int(_min))
-				} else {
-					i, _ := rand.Int(rand.Reader, big.NewInt(_max-_min))
-					pktSizes = append(pktSizes, int(i.Int64()+_min))
-				}
-			} else if sRange == "c" {
-				pktSizes = append(pktSizes, CheckMark)
-			}
+	for _, r := range p.GenerateRecords(pkt) {
+		if r.Size != 0 {
+			pktSizes = append(pktSizes, r.Size)
 		}
 	}
 	return
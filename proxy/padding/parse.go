@@ -0,0 +1,268 @@
+package padding
+
+import (
+	"cmp"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Issue is a problem found in a padding scheme. Line counts from 1,
+// Key and Token are empty when the problem is not about one of them.
+type Issue struct {
+	Line    int
+	Key     string
+	Token   string
+	Message string
+}
+
+func (i *Issue) Error() string {
+	var b strings.Builder
+	if i.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", i.Line)
+	}
+	if i.Key != "" {
+		fmt.Fprintf(&b, "key %s: ", i.Key)
+	}
+	if i.Token != "" {
+		fmt.Fprintf(&b, "%q: ", i.Token)
+	}
+	b.WriteString(i.Message)
+	return b.String()
+}
+
+// ParseScheme parses rawScheme strictly, every line or item which NewPaddingFactory would skip is an error.
+// The warnings are about schemes which are valid but probably not what was meant.
+func ParseScheme(rawScheme []byte) (p *PaddingFactory, warnings []*Issue, err error) {
+	p, ps := parseScheme(rawScheme)
+	if len(ps.errors) > 0 {
+		errs := make([]error, len(ps.errors))
+		for i, issue := range ps.errors {
+			errs[i] = issue
+		}
+		return nil, ps.warnings, errors.Join(errs...)
+	}
+	return p, ps.warnings, nil
+}
+
+type parser struct {
+	errors   []*Issue
+	warnings []*Issue
+	// fatal is set by the errors which make the scheme unusable, the others only skip a line or item
+	fatal bool
+}
+
+func (ps *parser) errorf(line int, key, token, format string, a ...any) {
+	ps.errors = append(ps.errors, &Issue{Line: line, Key: key, Token: token, Message: fmt.Sprintf(format, a...)})
+}
+
+func (ps *parser) warnf(line int, key, token, format string, a ...any) {
+	ps.warnings = append(ps.warnings, &Issue{Line: line, Key: key, Token: token, Message: fmt.Sprintf(format, a...)})
+}
+
+// entry is a key=value line of the scheme
+type entry struct {
+	line  int
+	key   string
+	value string
+}
+
+// section is the upstream part of a scheme, or its downstream part with keys prefixed by down.
+type section struct {
+	prefix string
+	stop   *entry
+	lists  map[uint32]*entry
+	// other keys of the section were seen
+	present bool
+}
+
+// parseScheme parses rawScheme line by line, the factory is nil if an error is fatal
+func parseScheme(rawScheme []byte) (*PaddingFactory, *parser) {
+	ps := &parser{}
+	up := &section{lists: make(map[uint32]*entry)}
+	down := &section{prefix: downPrefix, lists: make(map[uint32]*entry)}
+	seen := make(map[string]int)
+	for i, line := range strings.Split(string(rawScheme), "\n") {
+		n := i + 1
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			ps.errorf(n, "", line, "not a key=value line")
+			continue
+		}
+		if prev, ok := seen[key]; ok {
+			ps.warnf(n, key, "", "overrides line %d", prev)
+		}
+		seen[key] = n
+
+		e := &entry{line: n, key: key, value: value}
+		sec, name := up, key
+		if k, ok := strings.CutPrefix(key, downPrefix); ok {
+			sec, name = down, k
+			sec.present = true
+		}
+		if name == "stop" {
+			sec.stop = e
+		} else if pkt, err := strconv.ParseUint(name, 10, 32); err == nil && strconv.FormatUint(pkt, 10) == name {
+			sec.lists[uint32(pkt)] = e
+		} else {
+			ps.warnf(n, key, "", "unknown key, ignored")
+		}
+	}
+
+	defer func() {
+		byLine := func(a, b *Issue) int { return cmp.Compare(a.Line, b.Line) }
+		slices.SortStableFunc(ps.errors, byLine)
+		slices.SortStableFunc(ps.warnings, byLine)
+	}()
+	p := ps.parseSection(up)
+	if p == nil {
+		return nil, ps
+	}
+	p.RawScheme = rawScheme
+	p.Md5 = fmt.Sprintf("%x", md5.Sum(rawScheme))
+	p.UpstreamScheme = rawScheme
+	if down.present {
+		p.Down = ps.parseSection(down)
+		if p.Down == nil {
+			return nil, ps
+		}
+		p.UpstreamScheme = stripDownstream(rawScheme)
+	}
+	p.UpstreamMd5 = fmt.Sprintf("%x", md5.Sum(p.UpstreamScheme))
+	return p, ps
+}
+
+func (ps *parser) parseSection(sec *section) *PaddingFactory {
+	if sec.stop == nil {
+		ps.errorf(0, sec.prefix+"stop", "", "missing")
+		ps.fatal = true
+		return nil
+	}
+	stop, err := strconv.ParseUint(sec.stop.value, 10, 32)
+	if err != nil {
+		message := "stop must be a number of packets"
+		if strings.HasSuffix(sec.stop.value, "\r") {
+			message += ", the line ends with \\r"
+		}
+		ps.errorf(sec.stop.line, sec.stop.key, sec.stop.value, message)
+		ps.fatal = true
+		return nil
+	}
+
+	p := &PaddingFactory{
+		packets: make(map[uint32][]directive),
+		Stop:    uint32(stop),
+	}
+	var totalDelay float64
+	for _, pkt := range slices.Sorted(maps.Keys(sec.lists)) {
+		e := sec.lists[pkt]
+		list := ps.parseList(e)
+		p.packets[pkt] = list
+		if pkt >= p.Stop {
+			ps.warnf(e.line, e.key, "", "packet %d is not below %sstop=%d, never used", pkt, sec.prefix, stop)
+			continue
+		}
+		for _, d := range list {
+			if d.kind == directiveDelay {
+				totalDelay += min(d.dist.upper(), float64(MaxDelay.Milliseconds()))
+			}
+		}
+		if pkt == 0 && sec.prefix == "" && len(list) > 0 {
+			if list[0].kind != directiveSize {
+				ps.warnf(e.line, e.key, "", "packet 0 is the authentication padding, it must start with a size")
+			} else if len(list) > 1 {
+				ps.warnf(e.line, e.key, "", "packet 0 is the authentication padding, only its first size is used")
+			}
+		}
+	}
+	if limit := float64(MaxConnectionDelay.Milliseconds()); totalDelay > limit {
+		ps.warnf(0, sec.prefix+"stop", "", "the delays add up to %.0f ms, at most %.0f ms are waited on a connection", totalDelay, limit)
+	}
+
+	if p.Stop > maxListedGaps {
+		defined := 0
+		for pkt := range sec.lists {
+			if pkt < p.Stop {
+				defined++
+			}
+		}
+		if missing := int(p.Stop) - defined; missing > 0 {
+			ps.warnf(sec.stop.line, sec.stop.key, "", "%d packets below %sstop=%d have no list, they are sent as they are", missing, sec.prefix, stop)
+		}
+		return p
+	}
+	var gaps []uint32
+	for pkt := uint32(0); pkt < p.Stop; pkt++ {
+		if _, ok := sec.lists[pkt]; !ok {
+			gaps = append(gaps, pkt)
+		}
+	}
+	if len(gaps) == 1 {
+		ps.warnf(sec.stop.line, sec.stop.key, "", "packet %d has no list, it is sent as it is", gaps[0])
+	} else if len(gaps) > 1 {
+		ps.warnf(sec.stop.line, sec.stop.key, "", "packets %s have no list, they are sent as they are", formatRanges(gaps))
+	}
+	return p
+}
+
+// maxListedGaps is the largest stop for which the packets without list are listed in the warning
+const maxListedGaps = 1024
+
+// parseList parses the items of a packet, the items which are not understood are skipped
+func (ps *parser) parseList(e *entry) []directive {
+	var list []directive
+	if e.value == "" {
+		return nil
+	}
+	for _, item := range strings.Split(e.value, ",") {
+		if item == "c" {
+			list = append(list, directive{kind: directiveCheck})
+			continue
+		}
+		kind, lowest, highest, unit := directiveSize, int64(1), int64(maxRecordSize), "bytes"
+		value := item
+		if delay, ok := strings.CutPrefix(item, "d"); ok {
+			kind, lowest, highest, unit = directiveDelay, 0, MaxDelay.Milliseconds(), "ms"
+			value = delay
+		}
+		dist, err := parseDistribution(value, lowest)
+		if err != nil {
+			message := err.Error()
+			if strings.HasSuffix(item, "\r") {
+				message += ", the line ends with \\r"
+			}
+			ps.errorf(e.line, e.key, item, message)
+			continue
+		}
+		if dist.upper() > float64(highest) {
+			ps.warnf(e.line, e.key, item, "can exceed %d %s, larger values are cut", highest, unit)
+		}
+		list = append(list, directive{kind: kind, dist: dist})
+	}
+	return list
+}
+
+// formatRanges writes ascending numbers with the runs as first-last, like 1, 3-5
+func formatRanges(numbers []uint32) string {
+	var parts []string
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.FormatUint(uint64(numbers[i]), 10))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", numbers[i], numbers[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
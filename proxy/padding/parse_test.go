@@ -0,0 +1,76 @@
+package padding
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// position is where an Issue points in the scheme, its message is not compared
+type position struct {
+	line  int
+	key   string
+	token string
+}
+
+func positions(issues []*Issue) []position {
+	var ps []position
+	for _, i := range issues {
+		ps = append(ps, position{i.Line, i.Key, i.Token})
+	}
+	return ps
+}
+
+func TestParseSchemeIssues(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   string
+		errors   []position
+		warnings []position
+	}{
+		{name: "default", scheme: string(defaultPaddingScheme)},
+		{name: "empty lines", scheme: "\nstop=2\n\n0=30\n1=100-200\n"},
+		{name: "not key=value", scheme: "stop=2\n0=30\nfoo\n1=10", errors: []position{{3, "", "foo"}}},
+		{name: "missing stop", scheme: "0=30\n1=10", errors: []position{{0, "stop", ""}}},
+		{name: "invalid stop", scheme: "0=30\nstop=x", errors: []position{{2, "stop", "x"}}},
+		{name: "stop ends with cr", scheme: "stop=1\r\n0=30", errors: []position{{1, "stop", "1\r"}}},
+		{name: "invalid item", scheme: "stop=2\n0=30\n1=10,zz,c,d5x", errors: []position{{3, "1", "zz"}, {3, "1", "d5x"}}},
+		{name: "item ends with cr", scheme: "stop=2\n0=30\r\n1=10", errors: []position{{2, "0", "30\r"}}},
+		{name: "errors sorted by line", scheme: "stop=3\n0=30\n1=zz\n2=yy\nbad", errors: []position{{3, "1", "zz"}, {4, "2", "yy"}, {5, "", "bad"}}},
+		{name: "missing down stop", scheme: "stop=1\n0=30\ndown.0=10", errors: []position{{0, "down.stop", ""}}},
+		{name: "invalid down item", scheme: "stop=1\n0=30\ndown.stop=1\ndown.0=x", errors: []position{{4, "down.0", "x"}}},
+		{name: "overridden key", scheme: "stop=2\n0=30\n1=10\n1=20", warnings: []position{{4, "1", ""}}},
+		{name: "unknown key", scheme: "stop=1\n0=30\nbar=1\n01=5", warnings: []position{{3, "bar", ""}, {4, "01", ""}}},
+		{name: "packet not below stop", scheme: "stop=1\n0=30\n5=10", warnings: []position{{3, "5", ""}}},
+		{name: "packets without list", scheme: "stop=4\n0=30\n2=10", warnings: []position{{1, "stop", ""}}},
+		{name: "packet 0 without size", scheme: "stop=1\n0=c,30", warnings: []position{{2, "0", ""}}},
+		{name: "packet 0 with sizes", scheme: "stop=1\n0=30,40", warnings: []position{{2, "0", ""}}},
+		{name: "size too large", scheme: "stop=2\n0=30\n1=70000", warnings: []position{{3, "1", "70000"}}},
+		{name: "delays too long", scheme: "stop=5\n0=30\n1=d1000\n2=d1000\n3=d1000\n4=d1000", warnings: []position{{0, "stop", ""}}},
+		{name: "down packet without list", scheme: "stop=1\n0=30\ndown.stop=2\ndown.1=10", warnings: []position{{3, "down.stop", ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, warnings, err := ParseScheme([]byte(tt.scheme))
+			var errs []*Issue
+			if err != nil {
+				for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+					var issue *Issue
+					if !errors.As(e, &issue) {
+						t.Fatalf("error %v is not an Issue", e)
+					}
+					errs = append(errs, issue)
+				}
+			}
+			if (p == nil) != (len(tt.errors) > 0) {
+				t.Fatalf("factory %v with errors %v", p != nil, err)
+			}
+			if got := positions(errs); !slices.Equal(got, tt.errors) {
+				t.Fatalf("errors at %v, want %v: %v", got, tt.errors, err)
+			}
+			if got := positions(warnings); !slices.Equal(got, tt.warnings) {
+				t.Fatalf("warnings at %v, want %v", got, tt.warnings)
+			}
+		})
+	}
+}
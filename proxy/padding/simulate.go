@@ -0,0 +1,68 @@
+package padding
+
+import "time"
+
+// maxTLSRecord is the largest plaintext of a TLS record, longer writes are split by TLS
+const maxTLSRecord = 16384
+
+// SimulatedWrite is what a session does with a write of Size bytes to its connection
+type SimulatedWrite struct {
+	Size int
+	// Packet is the index of the write in the scheme, Padded is false from its stop on
+	Packet uint32
+	Padded bool
+	Writes []Write
+}
+
+// Records returns the TLS plaintext record sizes of the write, with the delays before them
+func (w SimulatedWrite) Records() (records []Record) {
+	for _, step := range w.Writes {
+		if step.Delay > 0 {
+			records = append(records, Record{Delay: step.Delay})
+			continue
+		}
+		for size := step.Size(); size > 0; size -= maxTLSRecord {
+			records = append(records, Record{Size: min(size, maxTLSRecord)})
+		}
+	}
+	return
+}
+
+// Waste is the number of bytes of the cmdWaste frames of the write, headers included
+func (w SimulatedWrite) Waste() int {
+	var n int
+	for _, step := range w.Writes {
+		n += step.Size() - step.Payload
+	}
+	return n
+}
+
+// Delay is the time waited during the write
+func (w SimulatedWrite) Delay() time.Duration {
+	var d time.Duration
+	for _, step := range w.Writes {
+		d += step.Delay
+	}
+	return d
+}
+
+// Simulate returns what a session does with writes of the given sizes to a new connection,
+// with the Padder of Session.writeConn. first is 1 for the writes of clients, the packet 0
+// being their authentication, and 0 for the writes of servers with the downstream section.
+func Simulate(p *PaddingFactory, sizes []int, first uint32) []SimulatedWrite {
+	padder := NewPadder(first)
+	padding := true
+	simulated := make([]SimulatedWrite, len(sizes))
+	for i, n := range sizes {
+		w := SimulatedWrite{Size: n, Packet: first + uint32(i)}
+		if padding {
+			w.Writes, w.Padded = padder.Next(p, n)
+			padding = w.Padded
+		}
+		if !w.Padded {
+			w.Writes = []Write{{Payload: n}}
+		}
+		simulated[i] = w
+	}
+	return simulated
+}
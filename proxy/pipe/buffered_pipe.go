@@ -0,0 +1,201 @@
+package pipe
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+// BufferedPipe is an in-memory pipe whose writer never waits for the reader.
+//
+// Written buffers are queued until they are consumed by Read, so the writer
+// side can be driven by a single goroutine serving many pipes (such as the
+// session receive loop) without being stalled by one slow reader. Callers
+// that need to bound the queue use WaitBuffered.
+type BufferedPipe struct {
+	mu      sync.Mutex
+	buffers []*buf.Buffer
+	size    int
+
+	readable chan struct{} // signaled after each write
+	consumed chan struct{} // signaled after each read
+
+	rOnce sync.Once // Protects closing rDone
+	rDone chan struct{}
+	wOnce sync.Once // Protects closing wDone
+	wDone chan struct{}
+	werr  onceError
+
+	readDeadline PipeDeadline
+
+	// onRelease is called with the bytes leaving the queue, read or dropped
+	onRelease func(n int)
+}
+
+// NewBufferedPipe creates an empty BufferedPipe.
+func NewBufferedPipe() *BufferedPipe {
+	return &BufferedPipe{
+		readable:     make(chan struct{}, 1),
+		consumed:     make(chan struct{}, 1),
+		rDone:        make(chan struct{}),
+		wDone:        make(chan struct{}),
+		readDeadline: MakePipeDeadline(),
+	}
+}
+
+// Read reads queued data from the pipe, blocking until data is available,
+// the write end is closed or the read deadline is exceeded.
+// Data queued before CloseWrite is still returned before the close error.
+func (p *BufferedPipe) Read(b []byte) (n int, err error) {
+	for {
+		p.mu.Lock()
+		if isClosedChan(p.rDone) {
+			p.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if p.size > 0 {
+			for n < len(b) && len(p.buffers) > 0 {
+				buffer := p.buffers[0]
+				nr, _ := buffer.Read(b[n:])
+				n += nr
+				if buffer.IsEmpty() {
+					buffer.Release()
+					p.buffers[0] = nil
+					p.buffers = p.buffers[1:]
+				}
+			}
+			p.size -= n
+			p.mu.Unlock()
+			notify(p.consumed)
+			if p.onRelease != nil {
+				p.onRelease(n)
+			}
+			return n, nil
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-p.wDone:
+			// the writer may have queued data right before closing
+			p.mu.Lock()
+			empty := p.size == 0
+			p.mu.Unlock()
+			if empty {
+				return 0, p.werr.Load()
+			}
+		case <-p.readable:
+		case <-p.rDone:
+			return 0, io.ErrClosedPipe
+		case <-p.readDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// WriteBuffer queues buffer without copying it. The pipe takes the ownership
+// of buffer and releases it once it has been consumed or the pipe is closed.
+func (p *BufferedPipe) WriteBuffer(buffer *buf.Buffer) error {
+	p.mu.Lock()
+	if isClosedChan(p.rDone) || isClosedChan(p.wDone) {
+		p.mu.Unlock()
+		buffer.Release()
+		return io.ErrClosedPipe
+	}
+	if buffer.IsEmpty() {
+		p.mu.Unlock()
+		buffer.Release()
+		return nil
+	}
+	p.buffers = append(p.buffers, buffer)
+	p.size += buffer.Len()
+	p.mu.Unlock()
+	notify(p.readable)
+	return nil
+}
+
+// Write implements the standard Write interface by copying b into the queue.
+func (p *BufferedPipe) Write(b []byte) (n int, err error) {
+	buffer := buf.NewSize(len(b))
+	buffer.Write(b)
+	if err = p.WriteBuffer(buffer); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WaitBuffered blocks until at most n bytes remain queued in the pipe,
+// or the read end is closed.
+func (p *BufferedPipe) WaitBuffered(n int) error {
+	for {
+		p.mu.Lock()
+		size := p.size
+		p.mu.Unlock()
+		if size <= n {
+			return nil
+		}
+		select {
+		case <-p.consumed:
+		case <-p.rDone:
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+// OnRelease sets f to be called with the number of bytes leaving the queue,
+// when they are read or dropped by Close. It must be set before the pipe is used.
+func (p *BufferedPipe) OnRelease(f func(n int)) {
+	p.onRelease = f
+}
+
+// Buffered returns the number of bytes queued in the pipe.
+func (p *BufferedPipe) Buffered() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// CloseWrite closes the write end; once the queued data has been read,
+// subsequent reads return err, or EOF if err is nil.
+func (p *BufferedPipe) CloseWrite(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	p.werr.Store(err)
+	p.wOnce.Do(func() { close(p.wDone) })
+	return nil
+}
+
+// Close closes the read end and drops all queued data.
+func (p *BufferedPipe) Close() error {
+	p.rOnce.Do(func() { close(p.rDone) })
+	p.mu.Lock()
+	for _, buffer := range p.buffers {
+		buffer.Release()
+	}
+	p.buffers = nil
+	dropped := p.size
+	p.size = 0
+	p.mu.Unlock()
+	if dropped > 0 && p.onRelease != nil {
+		p.onRelease(dropped)
+	}
+	return nil
+}
+
+func (p *BufferedPipe) SetReadDeadline(t time.Time) error {
+	if isClosedChan(p.rDone) {
+		return io.ErrClosedPipe
+	}
+	p.readDeadline.Set(t)
+	return nil
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,237 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BalancerConfig controls the health checks and the server selection of a Balancer
+type BalancerConfig struct {
+	// ProbeInterval between two probes of every server, zero means 30s
+	ProbeInterval time.Duration
+	// ProbeTimeout of one probe, zero means 5s
+	ProbeTimeout time.Duration
+	// MaxFailures consecutive failures mark a server as down until it succeeds again, zero means 3
+	MaxFailures int
+	// Tolerance is how much faster another server must be to replace the current one,
+	// so close servers do not flap, zero means 10ms
+	Tolerance time.Duration
+}
+
+func (c BalancerConfig) normalize() BalancerConfig {
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = time.Second * 30
+	}
+	if c.ProbeTimeout <= 0 {
+		c.ProbeTimeout = time.Second * 5
+	}
+	if c.MaxFailures <= 0 {
+		c.MaxFailures = 3
+	}
+	if c.Tolerance <= 0 {
+		c.Tolerance = time.Millisecond * 10
+	}
+	return c
+}
+
+// BalancerServer is a server of a Balancer, with the Client holding its sessions
+type BalancerServer struct {
+	Name   string
+	Client *Client
+}
+
+// Balancer opens streams on the healthiest server with the lowest latency among several servers,
+// and fails over to the next one when a server can not open streams.
+type Balancer struct {
+	die       context.Context
+	dieCancel context.CancelFunc
+
+	servers []BalancerServer
+	config  BalancerConfig
+
+	mu      sync.Mutex
+	current int
+}
+
+// NewBalancer starts probing the servers, which are preferred in the given order until measured.
+// A single server is not probed, its Client is used as is.
+func NewBalancer(ctx context.Context, servers []BalancerServer, config BalancerConfig) *Balancer {
+	b := &Balancer{
+		servers: servers,
+		config:  config.normalize(),
+	}
+	b.die, b.dieCancel = context.WithCancel(ctx)
+	if len(servers) > 1 {
+		go b.probeLoop()
+	}
+	return b
+}
+
+// Servers returns the servers of the balancer
+func (b *Balancer) Servers() []BalancerServer {
+	return b.servers
+}
+
+// CreateStream opens a stream on the preferred server, trying the others in order if it fails.
+// A *RemoteError is returned at once: the server is fine, the destination is not reachable through it.
+func (b *Balancer) CreateStream(ctx context.Context, opts ...StreamOption) (net.Conn, error) {
+	select {
+	case <-b.die.Done():
+		return nil, io.ErrClosedPipe
+	default:
+	}
+	if len(b.servers) == 0 {
+		return nil, errors.New("no server")
+	}
+
+	var err error
+	for _, i := range b.candidates() {
+		var conn net.Conn
+		conn, err = b.servers[i].Client.CreateStream(ctx, opts...)
+		var remoteErr *RemoteError
+		if err == nil || errors.As(err, &remoteErr) {
+			return conn, err
+		}
+		logrus.Warnln("[Client] server", b.servers[i].Name, "failed:", err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// CreatePacketConn opens a datagram association on the preferred server, trying the others in order if it fails.
+// ErrDatagramNotSupported is returned as soon as a server does not support datagrams.
+func (b *Balancer) CreatePacketConn(ctx context.Context) (*PacketConn, error) {
+	select {
+	case <-b.die.Done():
+		return nil, io.ErrClosedPipe
+	default:
+	}
+	if len(b.servers) == 0 {
+		return nil, errors.New("no server")
+	}
+
+	var err error
+	for _, i := range b.candidates() {
+		var conn *PacketConn
+		conn, err = b.servers[i].Client.CreatePacketConn(ctx)
+		if err == nil || err == ErrDatagramNotSupported {
+			return conn, err
+		}
+		logrus.Warnln("[Client] server", b.servers[i].Name, "failed:", err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// candidates returns the indexes of the servers in the order they should be tried:
+// the current server unless another healthy one is faster by more than the tolerance,
+// the other healthy servers by latency, then the servers which are down by failures
+func (b *Balancer) candidates() []int {
+	health := make([]Health, len(b.servers))
+	order := make([]int, len(b.servers))
+	for i, server := range b.servers {
+		health[i] = server.Client.Health()
+		order[i] = i
+	}
+	down := func(i int) bool {
+		return health[i].Failures >= b.config.MaxFailures
+	}
+	slices.SortStableFunc(order, func(x, y int) int {
+		if down(x) != down(y) {
+			if down(x) {
+				return 1
+			}
+			return -1
+		}
+		if down(x) {
+			return health[x].Failures - health[y].Failures
+		}
+		// servers not measured yet come last, in the given order
+		lx, ly := health[x].Latency(), health[y].Latency()
+		switch {
+		case lx == ly:
+			return 0
+		case lx == 0:
+			return 1
+		case ly == 0:
+			return -1
+		case lx < ly:
+			return -1
+		default:
+			return 1
+		}
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	best := order[0]
+	current := b.current
+	if best != current && !down(current) {
+		lb, lc := health[best].Latency(), health[current].Latency()
+		if lb == 0 || (lc != 0 && lc-lb <= b.config.Tolerance) {
+			best = current
+		}
+	}
+	if best != current {
+		logrus.Infoln("[Client] switched to server", b.servers[best].Name, "latency", health[best].Latency())
+		b.current = best
+	}
+	if order[0] != best {
+		order = slices.DeleteFunc(order, func(i int) bool { return i == best })
+		order = slices.Insert(order, 0, best)
+	}
+	return order
+}
+
+func (b *Balancer) probeLoop() {
+	ticker := time.NewTicker(b.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		b.probe()
+		select {
+		case <-b.die.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks all servers concurrently
+func (b *Balancer) probe() {
+	var wg sync.WaitGroup
+	for _, server := range b.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(b.die, b.config.ProbeTimeout)
+			defer cancel()
+			if err := server.Client.Probe(ctx); err != nil {
+				logrus.Debugln("[Client] probe", server.Name, "failed:", err)
+				return
+			}
+			health := server.Client.Health()
+			logrus.Debugln("[Client] probe", server.Name, "handshake", health.Handshake, "rtt", health.RTT)
+		}()
+	}
+	wg.Wait()
+}
+
+// Close closes the clients of all servers
+func (b *Balancer) Close() error {
+	b.dieCancel()
+	for _, server := range b.servers {
+		server.Client.Close()
+	}
+	return nil
+}
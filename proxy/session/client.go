@@ -4,6 +4,7 @@ import (
 	"anytls/proxy/padding"
 	"anytls/util"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/chen3feng/stl4go"
 	"github.com/sagernet/sing/common/atomic"
+	M "github.com/sagernet/sing/common/metadata"
 )
 
 type Client struct {
@@ -29,14 +31,22 @@ type Client struct {
 	sessions     map[uint64]*Session
 	sessionsLock sync.Mutex
 
-	padding *atomic.TypedValue[*padding.PaddingFactory]
+	padding     *atomic.TypedValue[*padding.PaddingFactory]
+	paddingHook func(p *padding.PaddingFactory)
 
 	idleSessionTimeout time.Duration
 	minIdleSession     int
+
+	keepalive KeepaliveConfig
+
+	health clientHealth
 }
 
+// NewClient returns a client opening its sessions with dialOut. _padding holds its scheme, replaced
+// by the ones pushed by its server, and starts with the default scheme if nil.
 func NewClient(ctx context.Context, dialOut util.DialOutFunc,
 	_padding *atomic.TypedValue[*padding.PaddingFactory], idleSessionCheckInterval, idleSessionTimeout time.Duration, minIdleSession int,
+	keepalive KeepaliveConfig,
 ) *Client {
 	c := &Client{
 		sessions:           make(map[uint64]*Session),
@@ -44,6 +54,7 @@ func NewClient(ctx context.Context, dialOut util.DialOutFunc,
 		padding:            _padding,
 		idleSessionTimeout: idleSessionTimeout,
 		minIdleSession:     minIdleSession,
+		keepalive:          keepalive.normalize(),
 	}
 	if idleSessionCheckInterval <= time.Second*5 {
 		idleSessionCheckInterval = time.Second * 30
@@ -51,13 +62,49 @@ func NewClient(ctx context.Context, dialOut util.DialOutFunc,
 	if c.idleSessionTimeout <= time.Second*5 {
 		c.idleSessionTimeout = time.Second * 30
 	}
+	if c.padding == nil {
+		c.padding = padding.NewStorage(nil)
+	}
 	c.die, c.dieCancel = context.WithCancel(ctx)
 	c.idleSession = stl4go.NewSkipList[uint64, *Session]()
 	util.StartRoutine(c.die, idleSessionCheckInterval, c.idleCleanup)
 	return c
 }
 
-func (c *Client) CreateStream(ctx context.Context) (net.Conn, error) {
+// OnPaddingUpdate sets a hook called with the schemes pushed by the server, after they replace the scheme
+// of the client, to keep them for the next start. It is set before the client opens streams.
+func (c *Client) OnPaddingUpdate(hook func(p *padding.PaddingFactory)) {
+	c.paddingHook = hook
+}
+
+// serverSettingsTimeout is how long a stream waiting for cmdSYNACK on a new session
+// waits for cmdServerSettings, before taking the server as version 1
+const serverSettingsTimeout = time.Second * 3
+
+// StreamOption changes how Client.CreateStream opens a stream
+type StreamOption func(options *streamOptions)
+
+type streamOptions struct {
+	handshake   bool
+	destination M.Socksaddr
+}
+
+// WithHandshake writes the destination to the stream and waits until the server reports
+// the result of its outbound in cmdSYNACK, so CreateStream returns the remote error.
+// The wait ends with the ctx of CreateStream, which then closes only the stream.
+func WithHandshake(destination M.Socksaddr) StreamOption {
+	return func(options *streamOptions) {
+		options.handshake = true
+		options.destination = destination
+	}
+}
+
+func (c *Client) CreateStream(ctx context.Context, opts ...StreamOption) (net.Conn, error) {
+	var options streamOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	select {
 	case <-c.die.Done():
 		return nil, io.ErrClosedPipe
@@ -73,9 +120,12 @@ func (c *Client) CreateStream(ctx context.Context) (net.Conn, error) {
 		if session == nil {
 			return nil, fmt.Errorf("failed to create session: %w", err)
 		}
-		stream, err = session.OpenStream()
+		// a stream waiting for its handshake is bounded by ctx instead of the session watchdog
+		stream, err = session.openStream(!options.handshake)
 		if err != nil {
-			session.Close()
+			if err != errTooManyStreams && err != errSessionDraining {
+				session.Close()
+			}
 			continue
 		}
 		break
@@ -85,49 +135,156 @@ func (c *Client) CreateStream(ctx context.Context) (net.Conn, error) {
 	}
 
 	stream.dieHook = func() {
-		if !session.IsClosed() {
-			select {
-			case <-c.die.Done():
-				// Now client has been closed
-				go session.Close()
-			default:
-				c.idleSessionLock.Lock()
-				session.idleSince = time.Now()
-				c.idleSession.Insert(math.MaxUint64-session.seq, session)
-				c.idleSessionLock.Unlock()
-			}
-		}
+		c.release(session)
 	}
 
+	if options.handshake {
+		if err := c.handshake(ctx, stream, options.destination); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
 	return stream, nil
 }
 
+// handshake sends the destination and waits for the outbound result
+func (c *Client) handshake(ctx context.Context, stream *Stream, destination M.Socksaddr) error {
+	if err := M.SocksaddrSerializer.WriteAddrPort(stream, destination); err != nil {
+		return err
+	}
+	err := stream.waitSYNACK(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.health.failure(errSYNACKTimeout)
+	}
+	return err
+}
+
+// release is called when a stream or an association of the session is closed,
+// the session is reused once nothing uses it anymore
+func (c *Client) release(session *Session) {
+	if session.IsClosed() {
+		return
+	}
+	select {
+	case <-c.die.Done():
+		// Now client has been closed
+		go session.Close()
+	default:
+		// other streams may still be using the session
+		if session.busy() {
+			return
+		}
+		if session.IsDraining() {
+			// the server asked for no more streams
+			go session.Close()
+			return
+		}
+		c.putIdle(session)
+	}
+}
+
+// putIdle makes a session without streams available for reuse
+func (c *Client) putIdle(session *Session) {
+	c.idleSessionLock.Lock()
+	session.idleSince = time.Now()
+	c.idleSession.Insert(math.MaxUint64-session.seq, session)
+	c.idleSessionLock.Unlock()
+}
+
 func (c *Client) findSession(ctx context.Context) (*Session, error) {
-	var idle *Session
+	for {
+		session, idle := c.pickSession()
+		if session == nil {
+			s, err := c.createSession(ctx)
+			return s, err
+		}
+		if !idle || c.probeIdleSession(session) {
+			return session, nil
+		}
+		session.Close()
+	}
+}
 
+// pickSession takes the most recent idle session, or else the least loaded busy session
+// that is still below the stream limit advertised by the server.
+// Busy sessions of servers without a stream limit are not shared, as before.
+func (c *Client) pickSession() (session *Session, idle bool) {
 	c.idleSessionLock.Lock()
-	if !c.idleSession.IsEmpty() {
+	defer c.idleSessionLock.Unlock()
+	for !c.idleSession.IsEmpty() {
 		it := c.idleSession.Iterate()
-		idle = it.Value()
+		session = it.Value()
 		c.idleSession.Remove(it.Key())
+		if session.IsDraining() {
+			go session.Close()
+			continue
+		}
+		if !session.busy() {
+			return session, true
+		}
+		// picked as a busy session after its last stream had closed, it is not idle anymore
 	}
-	c.idleSessionLock.Unlock()
 
-	if idle == nil {
-		s, err := c.createSession(ctx)
-		return s, err
+	session = nil
+	var load int
+	c.sessionsLock.Lock()
+	for _, s := range c.sessions {
+		limit := int(s.negotiated().maxStreams)
+		if limit == 0 || s.reverse || s.IsClosed() || s.IsDraining() {
+			continue
+		}
+		n := s.streamCount()
+		if n >= limit {
+			continue
+		}
+		if session == nil || n < load || (n == load && s.seq > session.seq) {
+			session = s
+			load = n
+		}
+	}
+	c.sessionsLock.Unlock()
+	return session, false
+}
+
+// probeIdleSession checks that an idle session which has been silent for a while is still alive,
+// since it may have silently died behind a NAT
+func (c *Client) probeIdleSession(session *Session) bool {
+	if session.IsClosed() {
+		return false
 	}
-	return idle, nil
+	if c.keepalive.Interval <= 0 || session.lastRecvSince() < c.keepalive.Interval {
+		return true
+	}
+	_, err := session.Ping(c.keepalive.Timeout)
+	if err == errHeartbeatNotSupported {
+		return true
+	}
+	return err == nil
 }
 
 func (c *Client) createSession(ctx context.Context) (*Session, error) {
+	return c.createSessionWith(ctx, nil)
+}
+
+// createSessionWith creates a session, setup is called before it runs
+func (c *Client) createSessionWith(ctx context.Context, setup func(session *Session)) (*Session, error) {
+	start := time.Now()
 	underlying, err := c.dialOut(ctx)
 	if err != nil {
+		c.health.failure(err)
 		return nil, err
 	}
+	c.health.dialed(time.Since(start))
 
-	session := NewClientSession(underlying, &padding.DefaultPaddingFactory)
+	session := NewClientSession(underlying, c.padding)
 	session.seq = c.sessionCounter.Add(1)
+	session.keepalive = c.keepalive
+	session.health = &c.health
+	session.redial = c.dialOut
+	session.onPaddingUpdate = c.paddingHook
+	if setup != nil {
+		setup(session)
+	}
 	session.dieHook = func() {
 		//logrus.Debugln("session died", session)
 		c.idleSessionLock.Lock()
@@ -180,6 +337,12 @@ func (c *Client) idleCleanupExpTime(expTime time.Time) {
 		key := it.Key()
 		it.MoveToNext()
 
+		if session.busy() {
+			// in use again
+			c.idleSession.Remove(key)
+			continue
+		}
+
 		if !session.idleSince.Before(expTime) {
 			activeCount++
 			continue
@@ -0,0 +1,409 @@
+package session
+
+import (
+	"anytls/proxy/pipe"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// Datagrams (CapDatagram)
+//
+// UDP packets are carried by cmdDatagram frames instead of a udp-over-tcp stream.
+// The frame id is an association opened by the client, in its own id space,
+// and the payload is the SocksAddr of the destination (client to server)
+// or of the source (server to client), followed by the packet.
+//
+// The server creates an association on its first datagram, like a NAT creates a mapping,
+// and forgets it after it has been idle for a while. A later datagram of the client
+// creates it again. The client closes an association with cmdDatagramClose. The associations of
+// a session are limited, servers reject the others with cmdDatagramClose (CapDatagramClose).
+//
+// Datagrams are never retransmitted by the session: they are dropped instead of queued
+// when the send queue or the receive queue of the association is full.
+
+// ErrDatagramNotSupported is returned when the peer does not support CapDatagram,
+// the caller may fall back to udp over tcp
+var ErrDatagramNotSupported = errors.New("peer does not support datagrams")
+
+var (
+	errDatagramDropped     = errors.New("datagram dropped")
+	errTooManyAssociations = errors.New("too many datagram associations")
+)
+
+const (
+	// datagramQueueID is the scheduler queue of the datagrams, no stream has id 0
+	datagramQueueID = 0
+	// maxQueuedDatagrams limits the datagrams of a session waiting in the send scheduler
+	maxQueuedDatagrams = 64
+	// maxReceivedDatagrams limits the datagrams of an association not read yet
+	maxReceivedDatagrams = 128
+	// defaultDatagramIdleTimeout is how long servers keep an association without datagrams
+	defaultDatagramIdleTimeout = time.Minute
+	// defaultMaxAssociations limits the associations of a server session
+	defaultMaxAssociations = 64
+)
+
+type datagram struct {
+	buffer *buf.Buffer
+	addr   M.Socksaddr
+}
+
+// PacketConn is a datagram association, it implements N.PacketConn
+type PacketConn struct {
+	id   uint32
+	sess *Session
+
+	recv         chan datagram
+	readDeadline pipe.PipeDeadline
+
+	// server: the association is forgotten after idleTimeout without datagrams
+	lastActive  atomic.Int64
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+
+	die     chan struct{}
+	dieOnce sync.Once
+	dieHook func()
+}
+
+func newPacketConn(id uint32, sess *Session) *PacketConn {
+	c := &PacketConn{
+		id:           id,
+		sess:         sess,
+		recv:         make(chan datagram, maxReceivedDatagrams),
+		readDeadline: pipe.MakePipeDeadline(),
+		die:          make(chan struct{}),
+	}
+	c.lastActive.Store(time.Now().UnixNano())
+	return c
+}
+
+// ReadPacket implements N.PacketReader, it returns the source of the packet
+func (c *PacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	select {
+	case d := <-c.recv:
+		defer d.buffer.Release()
+		c.sess.memory.release(memoryReceive, d.buffer.Len())
+		c.lastActive.Store(time.Now().UnixNano())
+		if _, err := buffer.Write(d.buffer.Bytes()); err != nil {
+			return M.Socksaddr{}, err
+		}
+		return d.addr, nil
+	case <-c.die:
+		return M.Socksaddr{}, io.EOF
+	case <-c.readDeadline.Wait():
+		return M.Socksaddr{}, os.ErrDeadlineExceeded
+	}
+}
+
+// WritePacket implements N.PacketWriter, it takes the buffer.
+// A packet which does not fit in a frame, or finds the send queue full, is dropped silently.
+func (c *PacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	select {
+	case <-c.die:
+		return io.ErrClosedPipe
+	default:
+	}
+	c.lastActive.Store(time.Now().UnixNano())
+
+	addrLen := M.SocksaddrSerializer.AddrPortLen(destination)
+	if addrLen+buffer.Len() > maxFramePayloadSize {
+		return nil
+	}
+	data := buf.NewSize(addrLen + buffer.Len())
+	if err := M.SocksaddrSerializer.WriteAddrPort(data, destination); err != nil {
+		data.Release()
+		return err
+	}
+	data.Write(buffer.Bytes())
+
+	f := newFrame(cmdDatagram, c.id)
+	f.data = data.Bytes()
+	req := newWriteRequest(f, nil)
+	req.buffer = data
+	if err := c.sess.sched.pushDatagram(req); err != nil {
+		req.release()
+		if err == errDatagramDropped {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// deliver queues a received datagram, it is dropped if the association is not read fast enough
+// or the memory budget is exhausted
+func (c *PacketConn) deliver(d datagram) {
+	c.lastActive.Store(time.Now().UnixNano())
+	select {
+	case <-c.die:
+		d.buffer.Release()
+		return
+	default:
+	}
+	if c.sess.memory.exhausted() {
+		c.sess.memory.budget.droppedDatagrams.Add(1)
+		d.buffer.Release()
+		return
+	}
+	c.sess.memory.charge(memoryReceive, d.buffer.Len())
+	select {
+	case c.recv <- d:
+	default:
+		c.sess.memory.release(memoryReceive, d.buffer.Len())
+		d.buffer.Release()
+	}
+}
+
+// Close implements N.PacketConn, clients tell the server to forget the association
+func (c *PacketConn) Close() error {
+	if !c.close() {
+		return io.ErrClosedPipe
+	}
+	if c.sess.isClient {
+		c.sess.writeFrame(newFrame(cmdDatagramClose, c.id))
+	}
+	return nil
+}
+
+// close releases the association without telling the peer
+func (c *PacketConn) close() bool {
+	var once bool
+	c.dieOnce.Do(func() {
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return false
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.sess.datagramLock.Lock()
+	if c.sess.associations[c.id] == c {
+		delete(c.sess.associations, c.id)
+		c.sess.memory.release(memoryAssociations, associationMemory)
+	}
+	c.sess.datagramLock.Unlock()
+	c.sess.notifyDrain()
+	for drained := false; !drained; {
+		select {
+		case d := <-c.recv:
+			c.sess.memory.release(memoryReceive, d.buffer.Len())
+			d.buffer.Release()
+		default:
+			drained = true
+		}
+	}
+	if c.dieHook != nil {
+		c.dieHook()
+		c.dieHook = nil
+	}
+	return true
+}
+
+// checkIdle is run by the idle timer of server associations
+func (c *PacketConn) checkIdle() {
+	idle := time.Since(time.Unix(0, c.lastActive.Load()))
+	if idle >= c.idleTimeout {
+		c.close()
+		return
+	}
+	c.idleTimer.Reset(c.idleTimeout - idle)
+}
+
+// LocalAddr implements N.PacketConn
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.sess.currentConn().LocalAddr()
+}
+
+// SetDeadline implements N.PacketConn
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements N.PacketConn
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline implements N.PacketConn, writes never block
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// OpenPacketConn opens a datagram association, the peer must support CapDatagram
+func (s *Session) OpenPacketConn() (*PacketConn, error) {
+	if s.IsClosed() {
+		return nil, io.ErrClosedPipe
+	}
+	if !s.isClient {
+		return nil, errors.New("datagram associations are opened by clients")
+	}
+	if !s.has(CapDatagram) {
+		return nil, ErrDatagramNotSupported
+	}
+	if s.draining.Load() {
+		return nil, errSessionDraining
+	}
+	s.datagramLock.Lock()
+	defer s.datagramLock.Unlock()
+	select {
+	case <-s.die:
+		return nil, io.ErrClosedPipe
+	default:
+	}
+	s.associationID++
+	c := newPacketConn(s.associationID, s)
+	s.associations[c.id] = c
+	s.memory.charge(memoryAssociations, associationMemory)
+	return c, nil
+}
+
+// associationCount returns the number of open datagram associations
+func (s *Session) associationCount() int {
+	s.datagramLock.Lock()
+	defer s.datagramLock.Unlock()
+	return len(s.associations)
+}
+
+// busy reports whether the session has open streams or datagram associations
+func (s *Session) busy() bool {
+	return s.streamCount() > 0 || s.associationCount() > 0
+}
+
+// handleDatagram is called for cmdDatagram, servers create the association on its first datagram
+func (s *Session) handleDatagram(id uint32, buffer *buf.Buffer) error {
+	addr, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
+	if err != nil {
+		buffer.Release()
+		return s.violation(newViolation(ViolationInvalidPayload, "datagram %d: %s", id, err))
+	}
+
+	s.datagramLock.Lock()
+	c, ok := s.associations[id]
+	if !ok && !s.isClient && !s.draining.Load() && s.config.OnPacketConn != nil {
+		if err := s.admitAssociation(); err != nil {
+			s.datagramLock.Unlock()
+			buffer.Release()
+			if s.has(CapDatagramClose) {
+				s.writeFrame(newFrame(cmdDatagramClose, id))
+			}
+			return nil
+		}
+		c = newPacketConn(id, s)
+		c.idleTimeout = s.config.DatagramIdleTimeout
+		if c.idleTimeout <= 0 {
+			c.idleTimeout = defaultDatagramIdleTimeout
+		}
+		c.idleTimer = time.AfterFunc(c.idleTimeout, c.checkIdle)
+		s.associations[id] = c
+		s.memory.charge(memoryAssociations, associationMemory)
+		ok = true
+		go func() {
+			s.config.OnPacketConn(c)
+			c.close()
+		}()
+	}
+	s.datagramLock.Unlock()
+
+	if !ok {
+		// closed, or the server is draining
+		buffer.Release()
+		return nil
+	}
+	c.deliver(datagram{buffer: buffer, addr: addr})
+	return nil
+}
+
+// admitAssociation checks that the server can open one more association, must be called with datagramLock held
+func (s *Session) admitAssociation() error {
+	limit := s.config.MaxAssociations
+	if limit <= 0 {
+		limit = defaultMaxAssociations
+	}
+	if len(s.associations) >= limit {
+		return errTooManyAssociations
+	}
+	if s.memory.exhausted() {
+		s.memory.budget.rejectedAssociations.Add(1)
+		return errMemoryExhausted
+	}
+	return nil
+}
+
+// handleDatagramClose is called for cmdDatagramClose, the association is closed without telling the peer
+func (s *Session) handleDatagramClose(id uint32) {
+	s.datagramLock.Lock()
+	c, ok := s.associations[id]
+	s.datagramLock.Unlock()
+	if ok {
+		c.close()
+	}
+}
+
+// CreatePacketConn opens a datagram association on a session of the client,
+// ErrDatagramNotSupported tells the caller to use udp over tcp instead.
+// On a new session it waits for cmdServerSettings to know whether the server supports it.
+func (c *Client) CreatePacketConn(ctx context.Context) (*PacketConn, error) {
+	select {
+	case <-c.die.Done():
+		return nil, io.ErrClosedPipe
+	default:
+	}
+
+	var err error
+	for i := 0; i < 3; i++ {
+		var session *Session
+		session, err = c.findSession(ctx)
+		if session == nil {
+			return nil, err
+		}
+		// the settings are held for the first stream, which may never come
+		session.flushSettings()
+		if !session.has(CapServerSettings) {
+			timer := time.NewTimer(serverSettingsTimeout)
+			select {
+			case <-session.serverSettingsDone:
+			case <-timer.C:
+				// version 1 server
+				session.settingsTimedOut()
+			case <-session.die:
+			case <-ctx.Done():
+				timer.Stop()
+				c.release(session)
+				return nil, ctx.Err()
+			}
+			timer.Stop()
+		}
+
+		var conn *PacketConn
+		conn, err = session.OpenPacketConn()
+		if err != nil {
+			if err == ErrDatagramNotSupported {
+				c.release(session)
+				return nil, err
+			}
+			if err != errSessionDraining {
+				session.Close()
+			}
+			continue
+		}
+		conn.dieHook = func() {
+			c.release(session)
+		}
+		return conn, nil
+	}
+	return nil, err
+}
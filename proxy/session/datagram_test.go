@@ -0,0 +1,162 @@
+package session
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// echoPackets sends the datagrams of an association back to their destination
+func echoPackets(conn *PacketConn) {
+	for {
+		buffer := buf.New()
+		addr, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			return
+		}
+		conn.WritePacket(buffer, addr)
+	}
+}
+
+func writePacket(t *testing.T, conn *PacketConn, payload string, destination M.Socksaddr) {
+	t.Helper()
+	buffer := buf.New()
+	buffer.WriteString(payload)
+	if err := conn.WritePacket(buffer, destination); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPacket(conn *PacketConn) (string, M.Socksaddr, error) {
+	buffer := buf.New()
+	defer buffer.Release()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	addr, err := conn.ReadPacket(buffer)
+	return string(buffer.Bytes()), addr, err
+}
+
+// waitAssociations waits until the session has n associations
+func waitAssociations(t *testing.T, s *Session, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.associationCount() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d associations, want %d", s.associationCount(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	client, server, _ := testPair(t, &ServerConfig{OnPacketConn: echoPackets})
+	destination := M.ParseSocksaddr("1.2.3.4:53")
+
+	conns := make([]*PacketConn, 2)
+	for i := range conns {
+		conn, err := client.OpenPacketConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	for i, conn := range conns {
+		payload := string(rune('a' + i))
+		writePacket(t, conn, payload, destination)
+		got, addr, err := readPacket(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != payload || addr != destination {
+			t.Fatalf("association %d: got %q from %s", conn.id, got, addr)
+		}
+	}
+	waitAssociations(t, server, 2)
+
+	// closing tells the server to forget the association
+	conns[0].Close()
+	waitAssociations(t, server, 1)
+	waitAssociations(t, client, 1)
+	if err := conns[0].WritePacket(buf.New(), destination); err != io.ErrClosedPipe {
+		t.Fatal("write on a closed association:", err)
+	}
+}
+
+func TestDatagramNotSupported(t *testing.T) {
+	client, _, _ := testPair(t, nil)
+	if _, err := client.OpenPacketConn(); err != ErrDatagramNotSupported {
+		t.Fatal(err)
+	}
+}
+
+func TestDatagramMaxAssociations(t *testing.T) {
+	client, server, _ := testPair(t, &ServerConfig{OnPacketConn: echoPackets, MaxAssociations: 2})
+	destination := M.ParseSocksaddr("1.2.3.4:53")
+
+	conns := make([]*PacketConn, 3)
+	for i := range conns {
+		conn, err := client.OpenPacketConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+		writePacket(t, conn, "x", destination)
+	}
+	for _, conn := range conns[:2] {
+		if _, _, err := readPacket(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the server rejects the third association with cmdDatagramClose
+	if _, _, err := readPacket(conns[2]); err != io.EOF {
+		t.Fatal("rejected association:", err)
+	}
+	waitAssociations(t, server, 2)
+
+	// a closed association makes room for a new one
+	conns[0].Close()
+	waitAssociations(t, server, 1)
+	conn, err := client.OpenPacketConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePacket(t, conn, "y", destination)
+	if got, _, err := readPacket(conn); err != nil || got != "y" {
+		t.Fatal(got, err)
+	}
+	waitAssociations(t, server, 2)
+}
+
+func TestDatagramIdleTimeout(t *testing.T) {
+	client, server, _ := testPair(t, &ServerConfig{OnPacketConn: echoPackets, DatagramIdleTimeout: 200 * time.Millisecond})
+	destination := M.ParseSocksaddr("1.2.3.4:53")
+
+	conn, err := client.OpenPacketConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// datagrams keep the association
+	for i := 0; i < 4; i++ {
+		writePacket(t, conn, "x", destination)
+		if _, _, err := readPacket(conn); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	waitAssociations(t, server, 1)
+
+	// the server forgets it when idle, the client keeps it
+	time.Sleep(300 * time.Millisecond)
+	waitAssociations(t, server, 0)
+	waitAssociations(t, client, 1)
+
+	// a later datagram creates it again
+	writePacket(t, conn, "y", destination)
+	if got, _, err := readPacket(conn); err != nil || got != "y" {
+		t.Fatal(got, err)
+	}
+	waitAssociations(t, server, 1)
+}
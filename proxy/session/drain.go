@@ -0,0 +1,100 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// Drain gracefully shuts down a server session: the client is told to open no more
+// streams on it (if it supports cmdGoAway), the open streams and datagram associations
+// are allowed to finish, and the session is closed once they are done or timeout expires.
+func (s *Session) Drain(timeout time.Duration) {
+	if s.IsClosed() {
+		return
+	}
+	if s.draining.CompareAndSwap(false, true) && s.has(CapGoAway) {
+		s.writeFrame(newFrame(cmdGoAway, 0))
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for s.busy() {
+		select {
+		case <-s.drainNotify:
+		case <-timer.C:
+			s.Close()
+			return
+		case <-s.die:
+			return
+		}
+	}
+	s.Close()
+}
+
+// notifyDrain wakes up Drain after a stream or an association is closed
+func (s *Session) notifyDrain() {
+	if s.draining.Load() {
+		select {
+		case s.drainNotify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// IsDraining reports whether the session accepts no more new streams
+func (s *Session) IsDraining() bool {
+	return s.draining.Load()
+}
+
+// SessionGroup tracks the sessions of a server so they can be drained together.
+// The zero value is ready to use.
+type SessionGroup struct {
+	mu       sync.Mutex
+	sessions map[*Session]struct{}
+	draining bool
+	timeout  time.Duration
+}
+
+// Add tracks a session until it is removed, a session added while the group
+// is draining is drained right away.
+func (g *SessionGroup) Add(s *Session) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.draining {
+		go s.Drain(g.timeout)
+		return
+	}
+	if g.sessions == nil {
+		g.sessions = make(map[*Session]struct{})
+	}
+	g.sessions[s] = struct{}{}
+}
+
+// Remove stops tracking a session
+func (g *SessionGroup) Remove(s *Session) {
+	g.mu.Lock()
+	delete(g.sessions, s)
+	g.mu.Unlock()
+}
+
+// Drain drains all sessions of the group concurrently and waits until they are closed
+func (g *SessionGroup) Drain(timeout time.Duration) {
+	g.mu.Lock()
+	g.draining = true
+	g.timeout = timeout
+	sessions := make([]*Session, 0, len(g.sessions))
+	for s := range g.sessions {
+		sessions = append(sessions, s)
+	}
+	g.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Drain(timeout)
+		}()
+	}
+	wg.Wait()
+}
@@ -2,6 +2,10 @@ package session
 
 import (
 	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/sagernet/sing/common/buf"
 )
 
 const ( // cmds
@@ -17,10 +21,34 @@ const ( // cmds
 	cmdHeartRequest   = 8  // Keep alive command
 	cmdHeartResponse  = 9  // Keep alive command
 	cmdServerSettings = 10 // Settings (Server send to client)
+	// Since version 3
+	cmdWindowUpdate = 11 // Grant more send window of a stream to the peer
+	// Since version 4
+	cmdCloseWrite = 12 // half close, the sender will not write to the stream anymore
+	// Since version 6
+	cmdGoAway = 13 // Server tells the client to open no more streams on the session
+	// Since version 7
+	cmdBind    = 14 // Client asks the server to listen for a reverse tunnel
+	cmdBindAck = 15 // Server reports the result of cmdBind
+	// With CapDatagram
+	cmdDatagram      = 16 // UDP packet of an association, the id is the association
+	cmdDatagramClose = 17 // Client closes an association, or server rejects one
+	// With CapResume
+	cmdAck    = 18 // Acknowledge the stream frames received
+	cmdResume = 19 // Resume a session on a new connection
 )
 
 const (
 	headerOverHeadSize = 1 + 4 + 2
+	// maxFramePayloadSize keeps a whole frame within one pooled buffer
+	maxFramePayloadSize = math.MaxUint16 - headerOverHeadSize
+)
+
+var errFrameTooLarge = errors.New("frame too large")
+
+const (
+	// defaultStreamWindow is the receive window of a stream, used until the peer advertises its own
+	defaultStreamWindow = 512 * 1024
 )
 
 // frame defines a packet from or to be multiplexed into a single connection
@@ -34,6 +62,28 @@ func newFrame(cmd byte, sid uint32) frame {
 	return frame{cmd: cmd, sid: sid}
 }
 
+// encodeHeader writes the frame header into b
+func (f frame) encodeHeader(b []byte) {
+	b[0] = f.cmd
+	binary.BigEndian.PutUint32(b[1:5], f.sid)
+	binary.BigEndian.PutUint16(b[5:7], uint16(len(f.data)))
+}
+
+// encodeTo appends the whole frame to buffer
+func (f frame) encodeTo(buffer *buf.Buffer) {
+	f.encodeHeader(buffer.Extend(headerOverHeadSize))
+	buffer.Write(f.data)
+}
+
+// encodeWasteTo appends a cmdWaste frame carrying paddingLen zero bytes to buffer
+func encodeWasteTo(buffer *buf.Buffer, paddingLen int) {
+	header := buffer.Extend(headerOverHeadSize)
+	header[0] = cmdWaste
+	binary.BigEndian.PutUint32(header[1:5], 0)
+	binary.BigEndian.PutUint16(header[5:7], uint16(paddingLen))
+	buffer.WriteZeroN(paddingLen)
+}
+
 type rawHeader [headerOverHeadSize]byte
 
 func (h rawHeader) Cmd() byte {
@@ -0,0 +1,166 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	errSYNACKTimeout    = errors.New("no SYNACK from server")
+	errHeartbeatTimeout = errors.New("heartbeat timeout")
+)
+
+// Health is the state of the server of a Client, as seen by its sessions and probes
+type Health struct {
+	// Handshake is the smoothed time to dial the server, including TCP, TLS and authentication
+	Handshake time.Duration
+	// RTT is the smoothed heartbeat round trip time, zero if the server never answered one
+	RTT time.Duration
+	// Failures counts the failures since the last success
+	Failures int
+	// LastError is the error of the last failure
+	LastError error
+	// LastProbe is the time of the last probe
+	LastProbe time.Time
+}
+
+// Latency returns the heartbeat round trip time, or the handshake time for servers
+// without heartbeat, zero if nothing has been measured yet
+func (h Health) Latency() time.Duration {
+	if h.RTT > 0 {
+		return h.RTT
+	}
+	return h.Handshake
+}
+
+// clientHealth collects the samples and failures reported by the sessions of a client
+type clientHealth struct {
+	mu     sync.Mutex
+	health Health
+}
+
+func smooth(old, sample time.Duration) time.Duration {
+	if old == 0 {
+		return sample
+	}
+	return old - old/8 + sample/8
+}
+
+// dialed records a successful dial
+func (h *clientHealth) dialed(d time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.health.Handshake = smooth(h.health.Handshake, d)
+	h.health.Failures = 0
+	h.mu.Unlock()
+}
+
+// pong records an answered heartbeat
+func (h *clientHealth) pong(rtt time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.health.RTT = smooth(h.health.RTT, rtt)
+	h.health.Failures = 0
+	h.mu.Unlock()
+}
+
+// success records a stream opened by the server
+func (h *clientHealth) success() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.health.Failures = 0
+	h.mu.Unlock()
+}
+
+func (h *clientHealth) failure(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.health.Failures++
+	h.health.LastError = err
+	h.mu.Unlock()
+}
+
+func (h *clientHealth) probed() {
+	h.mu.Lock()
+	h.health.LastProbe = time.Now()
+	h.mu.Unlock()
+}
+
+func (h *clientHealth) get() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health
+}
+
+// Health returns the state of the server
+func (c *Client) Health() Health {
+	return c.health.get()
+}
+
+// Probe measures the heartbeat round trip time on a session of the server. It only dials a new session,
+// kept as an idle session afterwards, when the client has none, which also measures the handshake time.
+// Servers which do not send cmdServerSettings are only measured by the handshake, after waiting for the
+// settings of the new session until ctx is done.
+func (c *Client) Probe(ctx context.Context) error {
+	defer c.health.probed()
+	session := c.probeSession()
+	if session == nil {
+		var err error
+		if session, err = c.createSession(ctx); err != nil {
+			return err
+		}
+		session.flushSettings()
+		select {
+		case <-session.serverSettingsDone:
+		case <-ctx.Done():
+			// version 1 server
+			c.putIdle(session)
+			return nil
+		case <-session.die:
+			c.health.failure(io.ErrClosedPipe)
+			return io.ErrClosedPipe
+		}
+		defer c.release(session)
+	}
+
+	timeout := c.keepalive.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+	if _, err := session.Ping(timeout); err != nil && err != errHeartbeatNotSupported {
+		// the keepalive of the session closes it if it is dead
+		c.health.failure(err)
+		return err
+	}
+	return nil
+}
+
+// probeSession returns the most recent open session of the client, nil if there is none
+func (c *Client) probeSession() *Session {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	var session *Session
+	for _, s := range c.sessions {
+		if s.IsClosed() || s.IsDraining() {
+			continue
+		}
+		if session == nil || s.seq > session.seq {
+			session = s
+		}
+	}
+	return session
+}
@@ -0,0 +1,148 @@
+package session
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// KeepaliveConfig controls the active heartbeat of client sessions
+type KeepaliveConfig struct {
+	// Interval between two heartbeat requests, zero disables the heartbeat
+	Interval time.Duration
+	// Timeout after which an unanswered heartbeat request is counted as missed
+	Timeout time.Duration
+	// MaxMissed consecutive missed heartbeats close the session
+	MaxMissed int
+}
+
+var errHeartbeatNotSupported = errors.New("peer does not support heartbeat")
+
+func (c KeepaliveConfig) normalize() KeepaliveConfig {
+	if c.Interval <= 0 {
+		return KeepaliveConfig{}
+	}
+	if c.Timeout <= 0 || c.Timeout > c.Interval {
+		c.Timeout = c.Interval
+	}
+	if c.MaxMissed <= 0 {
+		c.MaxMissed = 3
+	}
+	return c
+}
+
+// Ping sends a heartbeat request and waits for the response, returning the round trip time.
+// It requires the peer to support heartbeats.
+func (s *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	if s.IsClosed() {
+		return 0, io.ErrClosedPipe
+	}
+	if !s.has(CapHeartbeat) {
+		return 0, errHeartbeatNotSupported
+	}
+
+	id := s.heartSeq.Add(1)
+	ch := make(chan struct{})
+	s.heartLock.Lock()
+	s.heartPending[id] = ch
+	s.heartLock.Unlock()
+	defer func() {
+		s.heartLock.Lock()
+		delete(s.heartPending, id)
+		s.heartLock.Unlock()
+	}()
+
+	start := time.Now()
+	if _, err := s.writeFrame(newFrame(cmdHeartRequest, id)); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		rtt := time.Since(start)
+		s.updateRTT(rtt)
+		s.health.pong(rtt)
+		return rtt, nil
+	case <-timer.C:
+		return 0, os.ErrDeadlineExceeded
+	case <-s.die:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// RTT returns the smoothed heartbeat round trip time, zero if not measured yet
+func (s *Session) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+func (s *Session) updateRTT(sample time.Duration) {
+	for {
+		old := s.rtt.Load()
+		srtt := int64(sample)
+		if old != 0 {
+			srtt = old - old/8 + int64(sample)/8
+		}
+		if s.rtt.CompareAndSwap(old, srtt) {
+			return
+		}
+	}
+}
+
+func (s *Session) heartResponse(id uint32) {
+	s.heartLock.Lock()
+	ch, ok := s.heartPending[id]
+	delete(s.heartPending, id)
+	s.heartLock.Unlock()
+	if ok {
+		close(ch)
+	}
+}
+
+// lastRecvSince returns the time elapsed since the last frame from the peer
+func (s *Session) lastRecvSince() time.Duration {
+	return time.Since(time.Unix(0, s.lastRecv.Load()))
+}
+
+// keepaliveLoop sends heartbeats periodically and closes the session, or its connection
+// if it can be resumed, when too many of them are not answered
+func (s *Session) keepaliveLoop() {
+	ticker := time.NewTicker(s.keepalive.Interval)
+	defer ticker.Stop()
+
+	var missed int
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+		}
+		if s.suspended.Load() {
+			// answered once the session is resumed
+			missed = 0
+			continue
+		}
+		_, err := s.Ping(s.keepalive.Timeout)
+		switch err {
+		case nil:
+			missed = 0
+		case errHeartbeatNotSupported:
+			// v1 server, nothing to check
+		case io.ErrClosedPipe:
+			return
+		default:
+			missed++
+			if missed >= s.keepalive.MaxMissed {
+				logrus.Debugln("[Session] connection lost after", missed, "missed heartbeats", s.currentConn().RemoteAddr())
+				s.health.failure(errHeartbeatTimeout)
+				// a resumable session goes on with a new connection
+				s.breakConn()
+				missed = 0
+			}
+		}
+	}
+}
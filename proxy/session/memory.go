@@ -0,0 +1,222 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Memory budget
+//
+// Sessions account the memory they hold for their peer: data received and not read yet,
+// frames waiting to be sent, frames kept for resumption, and their open streams.
+// When the session or all the sessions together exceed their limit, the session stops reading
+// from its connection until enough has been consumed, stream writes send one frame at a time,
+// datagrams are dropped, frames are no longer kept for resumption and new streams are rejected.
+
+var errMemoryExhausted = errors.New("memory budget exhausted")
+
+// streamMemory is accounted for each open stream, it estimates the stream with its pipe and channels
+const streamMemory = 2048
+
+// associationMemory is accounted for each datagram association, it estimates the association
+// with its receive queue and the UDP socket of the server
+const associationMemory = 4096
+
+type memoryKind uint8
+
+const (
+	memoryReceive memoryKind = iota
+	memoryPending
+	memoryReplay
+	memoryStreams
+	memoryAssociations
+
+	memoryKindCount
+)
+
+// MemoryStats is a snapshot of the memory accounted by the sessions of a MemoryBudget, in bytes
+type MemoryStats struct {
+	Limit        int64 `json:"limit"`
+	SessionLimit int64 `json:"session_limit"`
+	Used         int64 `json:"used"`
+	Peak         int64 `json:"peak"`
+
+	// data received and not read yet by streams and datagram associations
+	Receive int64 `json:"receive"`
+	// frames waiting in the send scheduler
+	Pending int64 `json:"pending"`
+	// frames kept until the peer acknowledges them, for session resumption
+	Replay int64 `json:"replay"`
+	// estimate of the open streams
+	Streams int64 `json:"streams"`
+	// estimate of the open datagram associations
+	Associations int64 `json:"associations"`
+
+	Sessions             int64  `json:"sessions"`
+	RejectedStreams      uint64 `json:"rejected_streams"`
+	RejectedAssociations uint64 `json:"rejected_associations"`
+	DroppedDatagrams     uint64 `json:"dropped_datagrams"`
+	// times a stream held back the window of its peer
+	Throttled uint64 `json:"throttled"`
+}
+
+// MemoryBudget accounts the memory of the sessions sharing it through ServerConfig.Memory,
+// limit bounds all of them together and sessionLimit each of them, zero means unlimited.
+type MemoryBudget struct {
+	limit        int64
+	sessionLimit int64
+
+	used     atomic.Int64
+	peak     atomic.Int64
+	kinds    [memoryKindCount]atomic.Int64
+	sessions atomic.Int64
+
+	rejectedStreams      atomic.Uint64
+	rejectedAssociations atomic.Uint64
+	droppedDatagrams     atomic.Uint64
+	throttled            atomic.Uint64
+
+	// released is closed when memory is released while sessions wait for it
+	waiters  atomic.Int32
+	mu       sync.Mutex
+	released chan struct{}
+}
+
+// NewMemoryBudget creates a budget of limit bytes for all sessions and sessionLimit bytes for each
+func NewMemoryBudget(limit, sessionLimit int64) *MemoryBudget {
+	return &MemoryBudget{
+		limit:        max(limit, 0),
+		sessionLimit: max(sessionLimit, 0),
+	}
+}
+
+// Stats returns the current usage of the budget
+func (b *MemoryBudget) Stats() MemoryStats {
+	return MemoryStats{
+		Limit:                b.limit,
+		SessionLimit:         b.sessionLimit,
+		Used:                 b.used.Load(),
+		Peak:                 b.peak.Load(),
+		Receive:              b.kinds[memoryReceive].Load(),
+		Pending:              b.kinds[memoryPending].Load(),
+		Replay:               b.kinds[memoryReplay].Load(),
+		Streams:              b.kinds[memoryStreams].Load(),
+		Associations:         b.kinds[memoryAssociations].Load(),
+		Sessions:             b.sessions.Load(),
+		RejectedStreams:      b.rejectedStreams.Load(),
+		RejectedAssociations: b.rejectedAssociations.Load(),
+		DroppedDatagrams:     b.droppedDatagrams.Load(),
+		Throttled:            b.throttled.Load(),
+	}
+}
+
+func (b *MemoryBudget) charge(kind memoryKind, n int64) {
+	b.kinds[kind].Add(n)
+	used := b.used.Add(n)
+	for {
+		peak := b.peak.Load()
+		if used <= peak || b.peak.CompareAndSwap(peak, used) {
+			return
+		}
+	}
+}
+
+func (b *MemoryBudget) release(kind memoryKind, n int64) {
+	b.kinds[kind].Add(-n)
+	b.used.Add(-n)
+	if b.waiters.Load() > 0 {
+		b.mu.Lock()
+		if b.released != nil {
+			close(b.released)
+			b.released = nil
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *MemoryBudget) exhausted() bool {
+	return b.limit > 0 && b.used.Load() >= b.limit
+}
+
+// releasedChan returns a channel closed on the next release, the caller counts itself in waiters
+func (b *MemoryBudget) releasedChan() chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.released == nil {
+		b.released = make(chan struct{})
+	}
+	return b.released
+}
+
+// memoryAccount is the share of a session in a MemoryBudget.
+// A nil account belongs to a session without budget, nothing is accounted.
+type memoryAccount struct {
+	budget *MemoryBudget
+	used   atomic.Int64
+}
+
+func newMemoryAccount(budget *MemoryBudget) *memoryAccount {
+	if budget == nil {
+		return nil
+	}
+	budget.sessions.Add(1)
+	return &memoryAccount{budget: budget}
+}
+
+func (a *memoryAccount) charge(kind memoryKind, n int) {
+	if a == nil || n == 0 {
+		return
+	}
+	a.used.Add(int64(n))
+	a.budget.charge(kind, int64(n))
+}
+
+func (a *memoryAccount) release(kind memoryKind, n int) {
+	if a == nil || n == 0 {
+		return
+	}
+	a.used.Add(-int64(n))
+	a.budget.release(kind, int64(n))
+}
+
+// exhausted reports whether the session or the budget is over its limit
+func (a *memoryAccount) exhausted() bool {
+	if a == nil {
+		return false
+	}
+	if limit := a.budget.sessionLimit; limit > 0 && a.used.Load() >= limit {
+		return true
+	}
+	return a.budget.exhausted()
+}
+
+// wait blocks while the account is exhausted, or until die is closed
+func (a *memoryAccount) wait(die <-chan struct{}) {
+	if !a.exhausted() {
+		return
+	}
+	a.budget.throttled.Add(1)
+	a.budget.waiters.Add(1)
+	defer a.budget.waiters.Add(-1)
+	for {
+		released := a.budget.releasedChan()
+		// released before the channel was taken
+		if !a.exhausted() {
+			return
+		}
+		select {
+		case <-released:
+		case <-die:
+			return
+		}
+	}
+}
+
+// close is called when the session is closed, the memory it still holds is released by its owners
+func (a *memoryAccount) close() {
+	if a == nil {
+		return
+	}
+	a.budget.sessions.Add(-1)
+}
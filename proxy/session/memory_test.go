@@ -0,0 +1,161 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(100, 60)
+	a1, a2 := newMemoryAccount(b), newMemoryAccount(b)
+
+	a1.charge(memoryReceive, 50)
+	if a1.exhausted() {
+		t.Fatal("exhausted below the session limit")
+	}
+	a1.charge(memoryPending, 10)
+	if !a1.exhausted() {
+		t.Fatal("not exhausted at the session limit")
+	}
+	if a2.exhausted() {
+		t.Fatal("session limit applied to another session")
+	}
+	a2.charge(memoryStreams, 40)
+	if !a2.exhausted() {
+		t.Fatal("not exhausted at the limit")
+	}
+	stats := b.Stats()
+	if stats.Used != 100 || stats.Receive != 50 || stats.Pending != 10 || stats.Streams != 40 || stats.Sessions != 2 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	a1.release(memoryReceive, 50)
+	a1.release(memoryPending, 10)
+	a2.release(memoryStreams, 40)
+	a1.close()
+	stats = b.Stats()
+	if stats.Used != 0 || stats.Receive != 0 || stats.Pending != 0 || stats.Streams != 0 || stats.Peak != 100 || stats.Sessions != 1 {
+		t.Fatalf("stats after release %+v", stats)
+	}
+	if a1.exhausted() || a2.exhausted() {
+		t.Fatal("exhausted after release")
+	}
+
+	// sessions without budget account nothing
+	var none *memoryAccount
+	none.charge(memoryReceive, 10)
+	none.release(memoryReceive, 10)
+	if none.exhausted() {
+		t.Fatal("nil account exhausted")
+	}
+	none.wait(nil)
+}
+
+func TestMemoryWait(t *testing.T) {
+	b := NewMemoryBudget(10, 0)
+	a := newMemoryAccount(b)
+	a.charge(memoryReceive, 10)
+
+	done := make(chan struct{})
+	go func() {
+		a.wait(nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("wait returned while exhausted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.release(memoryReceive, 5)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after a release")
+	}
+	if b.Stats().Throttled != 1 {
+		t.Fatalf("throttled %d", b.Stats().Throttled)
+	}
+
+	a.charge(memoryReceive, 5)
+	die := make(chan struct{})
+	done = make(chan struct{})
+	go func() {
+		a.wait(die)
+		close(done)
+	}()
+	close(die)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return when the session died")
+	}
+}
+
+// TestMemoryHoldsWindow checks that an exhausted budget holds back the window of the streams
+// read by the application, while the session goes on reading its connection
+func TestMemoryHoldsWindow(t *testing.T) {
+	budget := NewMemoryBudget(defaultStreamWindow/2, 0)
+	client, _, streams := testPair(t, &ServerConfig{Memory: budget})
+
+	// new streams are rejected once the budget is exhausted
+	a, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Write([]byte("a"))
+	serverA := acceptStream(t, streams)
+	b, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data of b is not read, it exhausts the budget
+	if _, err := b.Write(make([]byte, defaultStreamWindow)); err != nil {
+		t.Fatal(err)
+	}
+	serverB := acceptStream(t, streams)
+	if !budget.exhausted() {
+		t.Fatalf("budget not exhausted: %+v", budget.Stats())
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), defaultStreamWindow*2/16)
+	written := make(chan error, 1)
+	go func() {
+		_, err := a.Write(data)
+		written <- err
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(io.LimitReader(serverA, int64(len(data)+1)))
+		received <- b
+	}()
+
+	select {
+	case err := <-written:
+		t.Fatalf("write of %d bytes returned with the window held: %v", len(data), err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// heartbeats are still answered
+	if _, err := client.Ping(time.Second); err != nil {
+		t.Fatal("ping while the budget is exhausted:", err)
+	}
+
+	if _, err := io.ReadFull(serverB, make([]byte, defaultStreamWindow)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the window was not granted after the budget was released")
+	}
+	if got := <-received; !bytes.Equal(got[1:], data) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(data)+1)
+	}
+	if budget.Stats().Throttled == 0 {
+		t.Fatal("no window held")
+	}
+}
@@ -0,0 +1,429 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sirupsen/logrus"
+)
+
+// Session resumption (CapResume)
+//
+// The server issues a ticket in cmdServerSettings. Both sides count the stream frames they
+// receive (the commands with replay in frameRules) and acknowledge them with cmdAck, the sender
+// keeps the frames until they are acknowledged. When the connection breaks, the server keeps
+// the session for a while, and the client dials a new connection which starts with cmdResume
+// carrying the ticket and its count of received frames. The server answers with cmdResume
+// carrying its own count, then both sides send again the frames the other has not received.
+
+var (
+	errResumeRejected = errors.New("session resumption rejected")
+	errHandedOver     = errors.New("connection handed over to a resumed session")
+)
+
+const (
+	ticketSize = 16
+	// maxReplayBytes limits the frames kept until acknowledged,
+	// a session which exceeds it can not be resumed anymore
+	maxReplayBytes = 8 << 20
+	// replayAckBytes of received stream frames are acknowledged together
+	replayAckBytes = 64 * 1024
+	// resumeHandshakeTimeout bounds the cmdResume exchange on a new connection
+	resumeHandshakeTimeout = time.Second * 10
+	maxResumeTimeout       = time.Hour
+)
+
+// ResumeStore keeps the sessions of a server which may be resumed by their ticket.
+// It is shared by the sessions through ServerConfig.Resume.
+type ResumeStore struct {
+	timeout  time.Duration
+	mu       sync.Mutex
+	sessions map[[ticketSize]byte]*Session
+}
+
+// NewResumeStore keeps the sessions for timeout after their connection breaks
+func NewResumeStore(timeout time.Duration) *ResumeStore {
+	return &ResumeStore{
+		timeout:  min(timeout, maxResumeTimeout),
+		sessions: make(map[[ticketSize]byte]*Session),
+	}
+}
+
+// issue returns a new ticket for the session
+func (r *ResumeStore) issue(s *Session) []byte {
+	var ticket [ticketSize]byte
+	rand.Read(ticket[:])
+	r.mu.Lock()
+	r.sessions[ticket] = s
+	r.mu.Unlock()
+	return ticket[:]
+}
+
+func (r *ResumeStore) get(ticket []byte) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[[ticketSize]byte(ticket)]
+}
+
+func (r *ResumeStore) remove(ticket []byte) {
+	r.mu.Lock()
+	delete(r.sessions, [ticketSize]byte(ticket))
+	r.mu.Unlock()
+}
+
+// replayFrame is a sent stream frame, encoded
+type replayFrame struct {
+	seq  uint32
+	data []byte
+}
+
+// replayBuffer keeps the sent stream frames until the peer acknowledges them
+type replayBuffer struct {
+	mu       sync.Mutex
+	disabled bool
+	// sent is the number of stream frames sent
+	sent   uint32
+	frames []replayFrame
+	size   int
+	memory *memoryAccount
+}
+
+// record keeps a copy of a stream frame, must be called by the writer in send order
+func (r *replayBuffer) record(f frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled {
+		return
+	}
+	r.sent++
+	data := make([]byte, headerOverHeadSize+len(f.data))
+	f.encodeHeader(data)
+	copy(data[headerOverHeadSize:], f.data)
+	r.frames = append(r.frames, replayFrame{seq: r.sent, data: data})
+	r.size += len(data)
+	r.memory.charge(memoryReplay, len(data))
+	if r.size > maxReplayBytes {
+		logrus.Debugln("[Session] too much data not acknowledged, the session can not be resumed")
+		r.disable()
+	} else if r.memory.exhausted() {
+		logrus.Debugln("[Session] memory budget exhausted, the session can not be resumed")
+		r.disable()
+	}
+}
+
+// ack drops the frames received by the peer, received is its count of stream frames
+func (r *replayBuffer) ack(received uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, acked := 0, 0
+	for ; i < len(r.frames) && int32(r.frames[i].seq-received) <= 0; i++ {
+		acked += len(r.frames[i].data)
+	}
+	r.size -= acked
+	r.memory.release(memoryReplay, acked)
+	if i > 0 {
+		clear(r.frames[:i])
+		r.frames = r.frames[i:]
+	}
+}
+
+// pending returns the frames not received by the peer after ack, false if some are missing
+func (r *replayBuffer) pending(received uint32) ([]replayFrame, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled || int32(r.sent-received) < 0 {
+		return nil, false
+	}
+	if len(r.frames) > 0 && r.frames[0].seq != received+1 || len(r.frames) == 0 && r.sent != received {
+		return nil, false
+	}
+	return r.frames, true
+}
+
+func (r *replayBuffer) enabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.disabled
+}
+
+// disable stops keeping frames, must be called with mu held
+func (r *replayBuffer) disable() {
+	r.disabled = true
+	r.frames = nil
+	r.memory.release(memoryReplay, r.size)
+	r.size = 0
+}
+
+// disableReplay is called when the session will not be resumed
+func (s *Session) disableReplay() {
+	s.replay.mu.Lock()
+	s.replay.disable()
+	s.replay.mu.Unlock()
+}
+
+// resumable reports whether the session may survive its connection
+func (s *Session) resumable() bool {
+	if s.IsClosed() || s.negotiated().ticket == nil || !s.has(CapResume) || !s.replay.enabled() {
+		return false
+	}
+	if s.isClient {
+		return s.redial != nil
+	}
+	return s.config.Resume != nil
+}
+
+// currentConn returns the connection carrying the session
+func (s *Session) currentConn() net.Conn {
+	return s.conn.Load()
+}
+
+// breakConn closes the connection of a resumable session so it is resumed on a new one,
+// other sessions are closed
+func (s *Session) breakConn() {
+	if !s.resumable() {
+		s.Close()
+		return
+	}
+	if !s.suspended.Load() {
+		s.currentConn().Close()
+	}
+}
+
+// swapConn carries the session on a new connection, must be called with sendLock held.
+// released is closed when the session stops using the connection.
+func (s *Session) swapConn(conn net.Conn, released chan struct{}) error {
+	s.currentConn().Close()
+	if s.connReleased != nil {
+		close(s.connReleased)
+	}
+	s.connReleased = released
+	s.conn.Store(conn)
+	if s.buffer != nil {
+		s.buffer.Release()
+		s.buffer = nil
+	}
+	// the new connection looks like a new one
+	s.padder = newPadder(s.isClient)
+	s.sendPadding = s.isClient || s.has(CapPaddingDown) && s.padding.Load().Down != nil
+	close(s.connChanged)
+	s.connChanged = make(chan struct{})
+	if s.IsClosed() {
+		// Close may have missed the new connection
+		conn.Close()
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+// retransmit sends the frames the peer has not received, must be called with sendLock held
+func (s *Session) retransmit(received uint32) error {
+	s.replay.ack(received)
+	frames, ok := s.replay.pending(received)
+	if !ok {
+		return errors.New("frames to retransmit are missing")
+	}
+	for _, f := range frames {
+		if _, err := s.writeConn(f.data, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// suspend keeps the session after its connection broke, until it is resumed on a new one.
+// It returns false if the session should be closed.
+func (s *Session) suspend(cause error) bool {
+	if !s.resumable() || s.isClient && !s.busy() {
+		return false
+	}
+	s.suspended.Store(true)
+	defer s.suspended.Store(false)
+	s.currentConn().Close()
+	logrus.Debugln("[Session] connection lost, resuming:", cause)
+	if s.isClient {
+		return s.reconnect()
+	}
+
+	timer := time.NewTimer(s.config.Resume.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case req := <-s.resumeCh:
+			if err := s.resumeWith(req); err != nil {
+				logrus.Debugln("[Session] resume failed:", err)
+				continue
+			}
+			logrus.Debugln("[Session] resumed", req.conn.RemoteAddr())
+			return true
+		case <-timer.C:
+			return false
+		case <-s.die:
+			return false
+		}
+	}
+}
+
+// resumeRequest hands a new connection to a suspended server session
+type resumeRequest struct {
+	conn     net.Conn
+	received uint32
+	released chan struct{}
+}
+
+// handleResume is called by a server session whose connection starts with cmdResume,
+// the connection is handed to the session of the ticket until that session stops using it
+func (s *Session) handleResume(b []byte) error {
+	if len(b) != ticketSize+4 {
+		return s.violation(newViolation(ViolationInvalidPayload, "resume with %d bytes of data", len(b)))
+	}
+	var old *Session
+	if s.config.Resume != nil {
+		old = s.config.Resume.get(b[:ticketSize])
+	}
+	req := &resumeRequest{
+		conn:     s.currentConn(),
+		received: binary.BigEndian.Uint32(b[ticketSize:]),
+		released: make(chan struct{}),
+	}
+	if old == nil || !old.resumable() || !old.requestResume(req) {
+		f := newFrame(cmdAlert, 0)
+		f.data = []byte(errResumeRejected.Error())
+		s.writeFrameWait(f)
+		return errResumeRejected
+	}
+	s.handedOver.Store(true)
+	select {
+	case <-req.released:
+	case <-old.die:
+	}
+	return errHandedOver
+}
+
+// requestResume passes a new connection to the session, breaking its current one
+func (s *Session) requestResume(req *resumeRequest) bool {
+	select {
+	case s.resumeCh <- req:
+	default:
+		return false
+	}
+	s.currentConn().Close()
+	return true
+}
+
+// resumeWith continues a suspended server session on the connection of the request
+func (s *Session) resumeWith(req *resumeRequest) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if err := s.swapConn(req.conn, req.released); err != nil {
+		return err
+	}
+
+	f := newFrame(cmdResume, 0)
+	f.data = binary.BigEndian.AppendUint32(nil, s.recvReplay.Load())
+	buffer := buf.NewSize(headerOverHeadSize + len(f.data))
+	defer buffer.Release()
+	f.encodeTo(buffer)
+	if _, err := s.writeConn(buffer.Bytes(), false); err != nil {
+		return err
+	}
+	return s.retransmit(req.received)
+}
+
+// reconnect dials new connections until the client session is resumed or the ticket expires
+func (s *Session) reconnect() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), s.negotiated().resumeTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.die:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := time.Millisecond * 500
+	for {
+		conn, err := s.redial(ctx)
+		if err == nil {
+			err = s.resumeOn(conn)
+			if err == nil {
+				logrus.Debugln("[Session] resumed", conn.RemoteAddr())
+				return true
+			}
+			conn.Close()
+			if err == errResumeRejected {
+				logrus.Debugln("[Session] resume rejected by the server")
+				return false
+			}
+		}
+		logrus.Debugln("[Session] resume failed:", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Second*5)
+	}
+}
+
+// resumeOn continues a client session on a new connection
+func (s *Session) resumeOn(conn net.Conn) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if err := s.swapConn(conn, nil); err != nil {
+		return err
+	}
+
+	f := newFrame(cmdResume, 0)
+	f.data = binary.BigEndian.AppendUint32(append([]byte(nil), s.negotiated().ticket...), s.recvReplay.Load())
+	buffer := buf.NewSize(headerOverHeadSize + len(f.data))
+	defer buffer.Release()
+	f.encodeTo(buffer)
+	if _, err := s.writeConn(buffer.Bytes(), false); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(resumeHandshakeTimeout))
+	received, err := readResumeReply(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	return s.retransmit(received)
+}
+
+// readResumeReply reads the cmdResume of the server, after its padding
+func readResumeReply(conn net.Conn) (uint32, error) {
+	var hdr rawHeader
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		switch hdr.Cmd() {
+		case cmdWaste:
+			if _, err := io.CopyN(io.Discard, conn, int64(hdr.Length())); err != nil {
+				return 0, err
+			}
+		case cmdResume:
+			if hdr.Length() != 4 {
+				return 0, errors.New("invalid resume reply")
+			}
+			var received [4]byte
+			if _, err := io.ReadFull(conn, received[:]); err != nil {
+				return 0, err
+			}
+			return binary.BigEndian.Uint32(received[:]), nil
+		case cmdAlert:
+			return 0, errResumeRejected
+		default:
+			return 0, errors.New("unexpected reply to resume")
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"anytls/proxy/padding"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	tests := []struct {
+		name string
+		// count of stream frames sent before the test, the sequence numbers wrap around
+		start  uint32
+		frames int
+		// cmdAck received while the connection was up
+		acks []uint32
+		// count of frames received by the peer in cmdResume
+		received uint32
+		disabled bool
+		want     []uint32
+		ok       bool
+	}{
+		{name: "nothing sent", ok: true},
+		{name: "nothing acknowledged", frames: 3, want: []uint32{1, 2, 3}, ok: true},
+		{name: "acknowledged", frames: 3, acks: []uint32{2}, received: 2, want: []uint32{3}, ok: true},
+		{name: "all acknowledged", frames: 3, acks: []uint32{1, 3}, received: 3, ok: true},
+		{name: "received not acknowledged", frames: 5, acks: []uint32{1}, received: 4, want: []uint32{5}, ok: true},
+		{name: "old ack", frames: 3, acks: []uint32{2, 1}, received: 2, want: []uint32{3}, ok: true},
+		{name: "received less than acknowledged", frames: 3, acks: []uint32{2}, received: 1, ok: false},
+		{name: "received more than sent", frames: 3, received: 4, ok: false},
+		{name: "disabled", frames: 3, received: 1, disabled: true, ok: false},
+		{name: "wrap around", start: math.MaxUint32 - 1, frames: 4, acks: []uint32{math.MaxUint32}, received: 0, want: []uint32{1, 2}, ok: true},
+		{name: "wrap around acknowledged", start: math.MaxUint32 - 1, frames: 4, acks: []uint32{2}, received: 2, ok: true},
+		{name: "wrap around received more than sent", start: math.MaxUint32 - 1, frames: 2, received: 1, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := NewMemoryBudget(0, 0)
+			r := &replayBuffer{sent: tt.start, memory: newMemoryAccount(budget)}
+			for i := 0; i < tt.frames; i++ {
+				f := newFrame(cmdPSH, 1)
+				f.data = []byte("data")
+				r.record(f)
+			}
+			for _, received := range tt.acks {
+				r.ack(received)
+			}
+			if tt.disabled {
+				r.mu.Lock()
+				r.disable()
+				r.mu.Unlock()
+			}
+			r.ack(tt.received)
+			frames, ok := r.pending(tt.received)
+			if ok != tt.ok {
+				t.Fatalf("pending(%d) = %v, want %v", tt.received, ok, tt.ok)
+			}
+			var seqs []uint32
+			for _, f := range frames {
+				seqs = append(seqs, f.seq)
+			}
+			if !slices.Equal(seqs, tt.want) {
+				t.Fatalf("pending(%d) = %v, want %v", tt.received, seqs, tt.want)
+			}
+
+			size := 0
+			for _, f := range r.frames {
+				size += len(f.data)
+			}
+			if r.size != size {
+				t.Fatalf("size %d, the frames hold %d", r.size, size)
+			}
+			if used := budget.Stats().Replay; used != int64(size) {
+				t.Fatalf("%d bytes charged, the frames hold %d", used, size)
+			}
+		})
+	}
+}
+
+func TestReplayBufferLimit(t *testing.T) {
+	budget := NewMemoryBudget(0, 0)
+	r := &replayBuffer{memory: newMemoryAccount(budget)}
+	f := newFrame(cmdPSH, 1)
+	f.data = make([]byte, maxFramePayloadSize)
+	for i := 0; i <= maxReplayBytes/len(f.data); i++ {
+		r.record(f)
+	}
+	if r.enabled() {
+		t.Fatal("still enabled after more than maxReplayBytes")
+	}
+	if _, ok := r.pending(0); ok {
+		t.Fatal("frames pending after the buffer was disabled")
+	}
+	if used := budget.Stats().Replay; used != 0 {
+		t.Fatalf("%d bytes still charged", used)
+	}
+}
+
+// TestResume breaks the connection of a session in the middle of a transfer in both directions,
+// the session is resumed on a new one and the data is delivered exactly once
+func TestResume(t *testing.T) {
+	storage := padding.NewStorage(nil)
+	config := &ServerConfig{Resume: NewResumeStore(time.Minute)}
+	streams := make(chan *Stream, 1)
+	// the handshake of a resumption needs the buffers of a real connection, both sides write at once
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server := NewServerSession(conn, func(stream *Stream) {
+				stream.HandshakeSuccess()
+				streams <- stream
+			}, storage, config)
+			go server.Run()
+			t.Cleanup(func() { server.Close() })
+		}
+	}()
+	var dialer net.Dialer
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClientSession(conn, storage)
+	redials := make(chan struct{}, 4)
+	client.redial = func(ctx context.Context) (net.Conn, error) {
+		redials <- struct{}{}
+		return dialer.DialContext(ctx, "tcp", listener.Addr().String())
+	}
+	client.Run()
+	t.Cleanup(func() { client.Close() })
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	uploaded := make(chan error, 1)
+	go func() {
+		for b := data; len(b) > 0; b = b[min(len(b), 16<<10):] {
+			if _, err := stream.Write(b[:min(len(b), 16<<10)]); err != nil {
+				uploaded <- err
+				return
+			}
+		}
+		uploaded <- nil
+	}()
+	peer := acceptStream(t, streams)
+	select {
+	case <-client.serverSettingsDone:
+	case <-time.After(time.Second):
+		t.Fatal("no server settings")
+	}
+	if !client.resumable() {
+		t.Fatal("session not resumable")
+	}
+	downloaded := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(io.LimitReader(stream, int64(len(data)+1)))
+		downloaded <- b
+	}()
+	sent := make(chan error, 1)
+	go func() {
+		_, err := peer.Write(data)
+		sent <- err
+	}()
+
+	received := make([]byte, len(data))
+	peer.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(peer, received[:len(data)/4]); err != nil {
+		t.Fatal(err)
+	}
+	// the connection breaks
+	client.currentConn().Close()
+	if _, err := io.ReadFull(peer, received[len(data)/4:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-uploaded; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("uploaded data corrupted")
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	peer.Close()
+	if b := <-downloaded; !bytes.Equal(b, data) {
+		t.Fatalf("downloaded %d bytes, want %d", len(b), len(data))
+	}
+	if len(redials) == 0 {
+		t.Fatal("session not resumed on a new connection")
+	}
+	if client.IsClosed() {
+		t.Fatal("session closed")
+	}
+}
+
+// TestResumeDisabledForVersion1 checks that a client stops keeping frames for the replay
+// once it takes its server as version 1
+func TestResumeDisabledForVersion1(t *testing.T) {
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	client := NewClientSession(conn, padding.NewStorage(nil))
+	client.redial = func(ctx context.Context) (net.Conn, error) {
+		return nil, io.EOF
+	}
+	client.Run()
+	t.Cleanup(func() {
+		peer.Close()
+		client.Close()
+	})
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	client.replay.mu.Lock()
+	kept := len(client.replay.frames)
+	client.replay.mu.Unlock()
+	if kept == 0 {
+		t.Fatal("no frame kept before the settings of the server")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*serverSettingsTimeout)
+	defer cancel()
+	if err := stream.waitSYNACK(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if client.replay.enabled() {
+		t.Fatal("replay enabled with a version 1 server")
+	}
+	client.replay.mu.Lock()
+	kept = len(client.replay.frames)
+	client.replay.mu.Unlock()
+	if kept != 0 {
+		t.Fatalf("%d frames kept", kept)
+	}
+	if client.resumable() {
+		t.Fatal("session resumable with a version 1 server")
+	}
+}
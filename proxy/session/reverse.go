@@ -0,0 +1,219 @@
+package session
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+// Reverse tunnels (CapReverse, since version 7)
+//
+// The client registers binds on a dedicated session with cmdBind, the server listens on
+// the requested address and opens a stream back to the client for every accepted connection.
+// Streams opened by the client have odd ids and streams opened by the server have even ids.
+// A server-initiated stream starts with the bind id (uint32) and the SocksAddr of the source.
+
+var (
+	errReverseNotSupported = errors.New("peer does not support reverse tunnels")
+	errBindNotAllowed      = errors.New("reverse bind is not allowed")
+)
+
+// BindHandler is called by servers when a client registers a reverse bind on a session.
+// It should listen on address and open a stream with OpenReverseStream for each connection,
+// until the session is closed.
+type BindHandler func(session *Session, bindID uint32, address string) error
+
+// ReverseBind is a service exposed by the client on the server
+type ReverseBind struct {
+	// Address to listen on the server
+	Address string
+	// Handler is called for each connection forwarded from the server,
+	// it should report the result of its outbound with HandshakeSuccess or HandshakeFailure
+	Handler func(stream *Stream, source M.Socksaddr)
+}
+
+// Done returns a channel which is closed when the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.die
+}
+
+// OpenReverseStream opens a stream from the server to the client for a connection accepted by the bind
+func (s *Session) OpenReverseStream(bindID uint32, source M.Socksaddr) (*Stream, error) {
+	if s.isClient {
+		return nil, errors.New("reverse streams are opened by servers")
+	}
+	stream, err := s.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	header := buf.NewSize(4 + M.SocksaddrSerializer.AddrPortLen(source))
+	defer header.Release()
+	binary.BigEndian.PutUint32(header.Extend(4), bindID)
+	if err = M.SocksaddrSerializer.WriteAddrPort(header, source); err == nil {
+		_, err = stream.Write(header.Bytes())
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// bind registers a reverse bind on the server and waits for the result
+func (s *Session) bind(bindID uint32, address string, timeout time.Duration) error {
+	if !s.has(CapReverse) {
+		return errReverseNotSupported
+	}
+	ch := make(chan error, 1)
+	s.bindLock.Lock()
+	s.bindPending[bindID] = ch
+	s.bindLock.Unlock()
+	defer func() {
+		s.bindLock.Lock()
+		delete(s.bindPending, bindID)
+		s.bindLock.Unlock()
+	}()
+
+	f := newFrame(cmdBind, bindID)
+	f.data = []byte(address)
+	if _, err := s.writeFrame(f); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-ch:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("bind %s: no response from server", address)
+	case <-s.die:
+		return io.ErrClosedPipe
+	}
+}
+
+func (s *Session) bindResult(bindID uint32, err error) {
+	s.bindLock.Lock()
+	ch, ok := s.bindPending[bindID]
+	s.bindLock.Unlock()
+	if ok {
+		ch <- err
+	}
+}
+
+// handleBind is called by the server for cmdBind
+func (s *Session) handleBind(bindID uint32, address string) {
+	var err error
+	if !s.has(CapReverse) || s.config.OnBind == nil {
+		err = errBindNotAllowed
+	} else {
+		err = s.config.OnBind(s, bindID, address)
+	}
+	f := newFrame(cmdBindAck, bindID)
+	if err != nil {
+		f.data = []byte(err.Error())
+	}
+	s.writeFrame(f)
+}
+
+// Reverse keeps a dedicated session to the server with the binds registered on it,
+// and reconnects when that session dies. It returns after the client is closed.
+func (c *Client) Reverse(binds []ReverseBind) {
+	const maxBackoff = time.Minute
+	backoff := time.Second
+	for {
+		registered, err := c.runReverseSession(binds)
+		if err == errReverseNotSupported {
+			logrus.Errorln("[Client] reverse tunnels:", err)
+			return
+		}
+		if registered {
+			backoff = time.Second
+		}
+		if err != nil {
+			logrus.Warnln("[Client] reverse session:", err, "retry in", backoff)
+		}
+		select {
+		case <-c.die.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// runReverseSession registers the binds on a new session and waits until it is closed
+func (c *Client) runReverseSession(binds []ReverseBind) (registered bool, err error) {
+	ctx, cancel := context.WithTimeout(c.die, time.Second*10)
+	defer cancel()
+	session, err := c.createSessionWith(ctx, func(session *Session) {
+		session.reverse = true
+		session.onNewStream = func(stream *Stream) {
+			handleReverseStream(stream, binds)
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	// a reverse session opens no stream to carry the settings
+	session.flushSettings()
+	select {
+	case <-session.serverSettingsDone:
+	case <-ctx.Done():
+		// the server did not send cmdServerSettings, version 1
+		return false, errReverseNotSupported
+	case <-session.die:
+		return false, io.ErrClosedPipe
+	}
+
+	for i, bind := range binds {
+		if err := session.bind(uint32(i+1), bind.Address, time.Second*10); err != nil {
+			if err == errReverseNotSupported {
+				return false, err
+			}
+			logrus.Errorln("[Client] reverse bind", bind.Address, "failed:", err)
+			continue
+		}
+		registered = true
+		logrus.Infoln("[Client] reverse bind", bind.Address, "registered")
+	}
+	if !registered {
+		return false, errors.New("no reverse bind registered")
+	}
+
+	select {
+	case <-session.die:
+	case <-c.die.Done():
+	}
+	return true, nil
+}
+
+// handleReverseStream reads the header of a server-initiated stream and passes it to its bind
+func handleReverseStream(stream *Stream, binds []ReverseBind) {
+	var id [4]byte
+	if _, err := io.ReadFull(stream, id[:]); err != nil {
+		stream.Close()
+		return
+	}
+	source, err := M.SocksaddrSerializer.ReadAddrPort(stream)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	bindID := binary.BigEndian.Uint32(id[:])
+	if bindID == 0 || int(bindID) > len(binds) {
+		stream.HandshakeFailure(fmt.Errorf("%w: unknown bind %d", ErrNotAllowed, bindID))
+		stream.Close()
+		return
+	}
+	binds[bindID-1].Handler(stream, source)
+}
@@ -0,0 +1,298 @@
+package session
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+// Priority is the scheduling class of a stream.
+// Streams of a higher class get more turns to send when the session is busy.
+type Priority uint8
+
+const (
+	PriorityBulk Priority = iota
+	PriorityNormal
+	PriorityInteractive
+
+	priorityCount
+)
+
+// priorityWeights are the frames a class may send in one scheduling round
+var priorityWeights = [priorityCount]int{
+	PriorityBulk:        1,
+	PriorityNormal:      4,
+	PriorityInteractive: 16,
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBulk:
+		return "bulk"
+	case PriorityNormal:
+		return "normal"
+	case PriorityInteractive:
+		return "interactive"
+	default:
+		return "unknown"
+	}
+}
+
+// writeRequest is a frame waiting for the writer goroutine
+type writeRequest struct {
+	frame frame
+	// buffer owns frame.data when the sender does not wait for the request
+	buffer *buf.Buffer
+	// hold keeps the frame in the session buffer to be sent with the next one
+	hold bool
+	done chan error
+}
+
+var writeRequestPool = sync.Pool{
+	New: func() any { return new(writeRequest) },
+}
+
+func newWriteRequest(f frame, done chan error) *writeRequest {
+	req := writeRequestPool.Get().(*writeRequest)
+	req.frame = f
+	req.done = done
+	return req
+}
+
+// newOwnedWriteRequest copies the frame payload, so the sender does not have to wait
+func newOwnedWriteRequest(f frame) *writeRequest {
+	req := newWriteRequest(f, nil)
+	if len(f.data) > 0 {
+		req.buffer = buf.NewSize(len(f.data))
+		req.buffer.Write(f.data)
+		req.frame.data = req.buffer.Bytes()
+	}
+	return req
+}
+
+// finish reports the result to the sender and recycles the request
+func (r *writeRequest) finish(err error) {
+	if r.done != nil {
+		r.done <- err
+	}
+	r.release()
+}
+
+// release recycles a request without reporting to the sender
+func (r *writeRequest) release() {
+	if r.buffer != nil {
+		r.buffer.Release()
+	}
+	*r = writeRequest{}
+	writeRequestPool.Put(r)
+}
+
+// streamQueue holds the pending data frames of one stream
+type streamQueue struct {
+	sid      uint32
+	priority Priority
+	requests []*writeRequest
+}
+
+// sendScheduler decides the order in which the writer goroutine sends frames.
+//
+// Control frames are sent first in FIFO order. Data frames are queued per stream;
+// the classes are served by weighted round robin and the streams inside a class
+// by plain round robin, one frame per turn, so a bulk transfer can not starve
+// the other streams of the session.
+type sendScheduler struct {
+	mu      sync.Mutex
+	closed  bool
+	control []*writeRequest
+	streams map[uint32]*streamQueue
+	active  [priorityCount][]*streamQueue
+	credits [priorityCount]int
+	notify  chan struct{}
+	// the queued frames are accounted as pending memory
+	memory *memoryAccount
+}
+
+func newSendScheduler(memory *memoryAccount) *sendScheduler {
+	return &sendScheduler{
+		streams: make(map[uint32]*streamQueue),
+		credits: priorityWeights,
+		notify:  make(chan struct{}, 1),
+		memory:  memory,
+	}
+}
+
+// queuedSize is the memory accounted for a queued frame
+func queuedSize(req *writeRequest) int {
+	return headerOverHeadSize + len(req.frame.data)
+}
+
+// pushControl queues a control frame ahead of all data frames.
+// cmdFIN and cmdCloseWrite must not overtake the data of their stream,
+// so the pending data frames of that stream are moved in front of them.
+func (q *sendScheduler) pushControl(req *writeRequest) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	switch req.frame.cmd {
+	case cmdFIN, cmdCloseWrite:
+		if sq, ok := q.streams[req.frame.sid]; ok {
+			q.control = append(q.control, sq.requests...)
+			q.removeQueue(sq)
+		}
+	}
+	// charged before the request is visible to the writer, which releases and recycles it
+	q.memory.charge(memoryPending, queuedSize(req))
+	q.control = append(q.control, req)
+	q.mu.Unlock()
+	q.wakeup()
+	return nil
+}
+
+// pushStream queues a data frame of the stream sid
+func (q *sendScheduler) pushStream(sid uint32, priority Priority, req *writeRequest) error {
+	return q.push(sid, priority, req, 0)
+}
+
+// pushDatagram queues a datagram frame with the interactive streams.
+// Like a full socket buffer, it drops the frame with errDatagramDropped
+// instead of queueing it when too many datagrams are pending or the memory budget is exhausted.
+func (q *sendScheduler) pushDatagram(req *writeRequest) error {
+	if q.memory.exhausted() {
+		q.memory.budget.droppedDatagrams.Add(1)
+		return errDatagramDropped
+	}
+	return q.push(datagramQueueID, PriorityInteractive, req, maxQueuedDatagrams)
+}
+
+// push queues a data frame, limit is the frames the queue may hold, zero means unlimited
+func (q *sendScheduler) push(sid uint32, priority Priority, req *writeRequest, limit int) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	sq, ok := q.streams[sid]
+	if ok && limit > 0 && len(sq.requests) >= limit {
+		q.mu.Unlock()
+		return errDatagramDropped
+	}
+	if !ok {
+		sq = &streamQueue{sid: sid, priority: priority}
+		q.streams[sid] = sq
+		q.active[priority] = append(q.active[priority], sq)
+	}
+	q.memory.charge(memoryPending, queuedSize(req))
+	sq.requests = append(sq.requests, req)
+	q.mu.Unlock()
+	q.wakeup()
+	return nil
+}
+
+// setPriority moves the pending frames of the stream sid to another class
+func (q *sendScheduler) setPriority(sid uint32, priority Priority) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sq, ok := q.streams[sid]
+	if !ok || sq.priority == priority {
+		return
+	}
+	q.removeQueue(sq)
+	sq.priority = priority
+	q.streams[sid] = sq
+	q.active[priority] = append(q.active[priority], sq)
+}
+
+// removeQueue must be called with mu held
+func (q *sendScheduler) removeQueue(sq *streamQueue) {
+	delete(q.streams, sq.sid)
+	list := q.active[sq.priority]
+	for i, x := range list {
+		if x == sq {
+			copy(list[i:], list[i+1:])
+			list[len(list)-1] = nil
+			q.active[sq.priority] = list[:len(list)-1]
+			break
+		}
+	}
+}
+
+func (q *sendScheduler) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the frame to be sent next, nil if nothing is pending
+func (q *sendScheduler) next() *writeRequest {
+	req := q.pop()
+	if req != nil {
+		q.memory.release(memoryPending, queuedSize(req))
+	}
+	return req
+}
+
+// pop implements next without the accounting
+func (q *sendScheduler) pop() *writeRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.control) > 0 {
+		req := q.control[0]
+		q.control[0] = nil
+		q.control = q.control[1:]
+		return req
+	}
+	for round := 0; round < 2; round++ {
+		for p := int(priorityCount) - 1; p >= 0; p-- {
+			if q.credits[p] > 0 && len(q.active[p]) > 0 {
+				q.credits[p]--
+				return q.popStream(Priority(p))
+			}
+		}
+		// every class with pending frames has used its turns
+		q.credits = priorityWeights
+	}
+	return nil
+}
+
+// popStream takes one frame from the first stream of the class and
+// moves that stream to the end of the class, must be called with mu held
+func (q *sendScheduler) popStream(p Priority) *writeRequest {
+	list := q.active[p]
+	sq := list[0]
+	req := sq.requests[0]
+	sq.requests[0] = nil
+	sq.requests = sq.requests[1:]
+	copy(list, list[1:])
+	if len(sq.requests) > 0 {
+		list[len(list)-1] = sq
+	} else {
+		list[len(list)-1] = nil
+		q.active[p] = list[:len(list)-1]
+		delete(q.streams, sq.sid)
+	}
+	return req
+}
+
+// close rejects new frames and returns the ones still pending
+func (q *sendScheduler) close() []*writeRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	pending := q.control
+	q.control = nil
+	for p := range q.active {
+		for _, sq := range q.active[p] {
+			pending = append(pending, sq.requests...)
+		}
+		q.active[p] = nil
+	}
+	q.streams = make(map[uint32]*streamQueue)
+	for _, req := range pending {
+		q.memory.release(memoryPending, queuedSize(req))
+	}
+	return pending
+}
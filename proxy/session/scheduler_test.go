@@ -0,0 +1,142 @@
+package session
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+// popAll pops n frames and returns their commands and stream ids
+func popAll(t *testing.T, q *sendScheduler, n int) (cmds []byte, sids []uint32) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		req := q.next()
+		if req == nil {
+			t.Fatalf("%d frames popped, want %d", i, n)
+		}
+		cmds = append(cmds, req.frame.cmd)
+		sids = append(sids, req.frame.sid)
+		req.release()
+	}
+	return
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	q := newSendScheduler(nil)
+	streams := map[uint32]Priority{1: PriorityBulk, 3: PriorityNormal, 5: PriorityInteractive, 7: PriorityInteractive}
+	for sid, priority := range streams {
+		for i := 0; i < 100; i++ {
+			q.pushStream(sid, priority, newWriteRequest(newFrame(cmdPSH, sid), nil))
+		}
+	}
+
+	// each round sends 1 bulk, 4 normal and 16 interactive frames
+	const rounds = 4
+	_, sids := popAll(t, q, rounds*21)
+	counts := make(map[uint32]int)
+	for _, sid := range sids {
+		counts[sid]++
+	}
+	if counts[1] != rounds || counts[3] != rounds*4 || counts[5]+counts[7] != rounds*16 {
+		t.Fatalf("frames per stream %v", counts)
+	}
+	// the streams of a class take turns
+	if counts[5] != counts[7] {
+		t.Fatalf("interactive streams sent %d and %d frames", counts[5], counts[7])
+	}
+	var interactive []uint32
+	for _, sid := range sids {
+		if streams[sid] == PriorityInteractive {
+			interactive = append(interactive, sid)
+		}
+	}
+	for i := 1; i < len(interactive); i++ {
+		if interactive[i] == interactive[i-1] {
+			t.Fatalf("stream %d sent twice in a row: %v", interactive[i], interactive)
+		}
+	}
+
+	// a class alone is not held back by the weights of the others
+	q = newSendScheduler(nil)
+	for i := 0; i < 10; i++ {
+		q.pushStream(1, PriorityBulk, newWriteRequest(newFrame(cmdPSH, 1), nil))
+	}
+	popAll(t, q, 10)
+	if q.next() != nil {
+		t.Fatal("frame popped from an empty scheduler")
+	}
+}
+
+// TestSchedulerFINOrder checks that control frames go first,
+// but cmdFIN and cmdCloseWrite wait for the data queued before them on their stream
+func TestSchedulerFINOrder(t *testing.T) {
+	q := newSendScheduler(nil)
+	for i := 0; i < 3; i++ {
+		q.pushStream(1, PriorityNormal, newWriteRequest(newFrame(cmdPSH, 1), nil))
+		q.pushStream(3, PriorityNormal, newWriteRequest(newFrame(cmdPSH, 3), nil))
+		q.pushStream(5, PriorityNormal, newWriteRequest(newFrame(cmdPSH, 5), nil))
+	}
+	q.pushControl(newOwnedWriteRequest(newFrame(cmdHeartRequest, 0)))
+	q.pushControl(newOwnedWriteRequest(newFrame(cmdFIN, 1)))
+	q.pushControl(newOwnedWriteRequest(newFrame(cmdCloseWrite, 3)))
+	q.pushControl(newOwnedWriteRequest(newFrame(cmdWindowUpdate, 5)))
+
+	cmds, sids := popAll(t, q, 13)
+	wantCmds := []byte{cmdHeartRequest, cmdPSH, cmdPSH, cmdPSH, cmdFIN, cmdPSH, cmdPSH, cmdPSH, cmdCloseWrite, cmdWindowUpdate, cmdPSH, cmdPSH, cmdPSH}
+	wantSids := []uint32{0, 1, 1, 1, 1, 3, 3, 3, 3, 5, 5, 5, 5}
+	if !slices.Equal(cmds, wantCmds) || !slices.Equal(sids, wantSids) {
+		t.Fatalf("sent %v of %v, want %v of %v", cmds, sids, wantCmds, wantSids)
+	}
+	// the data of the stream after cmdFIN starts a new queue
+	if q.next() != nil {
+		t.Fatal("frames left")
+	}
+}
+
+func TestSchedulerDatagramLimit(t *testing.T) {
+	q := newSendScheduler(nil)
+	for i := 0; i < maxQueuedDatagrams; i++ {
+		if err := q.pushDatagram(newOwnedWriteRequest(newFrame(cmdDatagram, 1))); err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+	}
+	req := newOwnedWriteRequest(newFrame(cmdDatagram, 1))
+	if err := q.pushDatagram(req); err != errDatagramDropped {
+		t.Fatalf("datagram over the limit: %v", err)
+	}
+	req.release()
+	// the streams are not limited
+	for i := 0; i < maxQueuedDatagrams+1; i++ {
+		if err := q.pushStream(1, PriorityInteractive, newWriteRequest(newFrame(cmdPSH, 1), nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	popAll(t, q, 1)
+	if err := q.pushDatagram(newOwnedWriteRequest(newFrame(cmdDatagram, 1))); err != nil {
+		t.Fatal("datagram after a pop:", err)
+	}
+
+	// an exhausted budget drops the datagrams
+	budget := NewMemoryBudget(10, 0)
+	account := newMemoryAccount(budget)
+	account.charge(memoryReceive, 10)
+	q = newSendScheduler(account)
+	req = newOwnedWriteRequest(newFrame(cmdDatagram, 1))
+	if err := q.pushDatagram(req); err != errDatagramDropped {
+		t.Fatalf("datagram over the budget: %v", err)
+	}
+	req.release()
+	if budget.Stats().DroppedDatagrams != 1 {
+		t.Fatalf("dropped %d datagrams", budget.Stats().DroppedDatagrams)
+	}
+
+	if pending := q.close(); len(pending) != 0 {
+		t.Fatalf("%d frames pending", len(pending))
+	}
+	account.release(memoryReceive, 10)
+	req = newOwnedWriteRequest(newFrame(cmdDatagram, 1))
+	if err := q.pushDatagram(req); err != io.ErrClosedPipe {
+		t.Fatalf("datagram after close: %v", err)
+	}
+	req.release()
+}
@@ -6,31 +6,66 @@ import (
 	"anytls/util"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"runtime/debug"
-	"slices"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/sagernet/sing/common/atomic"
 	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
 	"github.com/sirupsen/logrus"
 )
 
 var clientDebugPaddingScheme = os.Getenv("CLIENT_DEBUG_PADDING_SCHEME") == "1"
 
+var (
+	errTooManyStreams  = errors.New("too many streams")
+	errSessionDraining = errors.New("session is draining")
+)
+
+// ServerConfig holds the options of server sessions
+type ServerConfig struct {
+	// MaxStreams limits the concurrent streams of a session, zero means unlimited.
+	// It is advertised to clients of version >= 5, older clients are not limited.
+	MaxStreams int
+	// OnBind handles the reverse binds of clients, nil rejects them
+	OnBind BindHandler
+	// Resume keeps the sessions of clients with CapResume after their connection breaks,
+	// so they can be resumed on a new one. CapResume is not offered when it is nil.
+	Resume *ResumeStore
+	// OnPacketConn handles the datagram associations of clients, it returns when the association
+	// should be closed. CapDatagram is not offered when it is nil.
+	OnPacketConn func(conn *PacketConn)
+	// DatagramIdleTimeout closes the associations without datagrams for this long, zero means 1 minute
+	DatagramIdleTimeout time.Duration
+	// MaxAssociations limits the datagram associations of a session, each with its UDP socket, zero means 64
+	MaxAssociations int
+	// Memory accounts the memory held by the sessions and bounds it, nil accounts nothing
+	Memory *MemoryBudget
+}
+
 type Session struct {
-	conn     net.Conn
-	connLock sync.Mutex
+	conn  atomic.TypedValue[net.Conn]
+	sched *sendScheduler
+
+	// write path, only used by sendLoop and with sendLock held
+	sendLock     sync.Mutex
+	connChanged  chan struct{}
+	encodeBuffer *buf.Buffer
 
 	streams    map[uint32]*Stream
 	streamId   atomic.Uint32
 	streamLock sync.RWMutex
 
+	associations  map[uint32]*PacketConn
+	associationID uint32
+	datagramLock  sync.Mutex
+
 	dieOnce sync.Once
 	die     chan struct{}
 	dieHook func()
@@ -42,18 +77,51 @@ type Session struct {
 	seq       uint64
 	idleSince time.Time
 	padding   *atomic.TypedValue[*padding.PaddingFactory]
-
-	peerVersion byte
+	// onPaddingUpdate is called with the schemes pushed by the server
+	onPaddingUpdate func(p *padding.PaddingFactory)
+
+	peer atomic.TypedValue[*negotiated]
+
+	// resumption
+	replay       replayBuffer
+	recvReplay   atomic.Uint32
+	suspended    atomic.Bool
+	redial       util.DialOutFunc
+	resumeCh     chan *resumeRequest
+	connReleased chan struct{}
+	handedOver   atomic.Bool
+
+	memory *memoryAccount
+
+	// drain
+	draining    atomic.Bool
+	drainNotify chan struct{}
+
+	// keepalive
+	keepalive    KeepaliveConfig
+	heartSeq     atomic.Uint32
+	heartPending map[uint32]chan struct{}
+	heartLock    sync.Mutex
+	rtt          atomic.Int64
+	lastRecv     atomic.Int64
 
 	// client
-	isClient    bool
+	isClient           bool
+	reverse            bool
+	serverSettingsDone chan struct{}
+	serverSettingsOnce sync.Once
+	bindPending        map[uint32]chan error
+	bindLock           sync.Mutex
+	health             *clientHealth
+
 	sendPadding bool
-	buffering   bool
-	buffer      []byte
-	pktCounter  atomic.Uint32
+	buffering   atomic.Bool
+	buffer      *buf.Buffer
+	padder      padding.Padder // guarded by sendLock
 
 	// server
 	onNewStream func(stream *Stream)
+	config      ServerConfig
 
 	// addons
 	tracker *R.Recorder
@@ -61,45 +129,72 @@ type Session struct {
 
 func NewClientSession(conn net.Conn, _padding *atomic.TypedValue[*padding.PaddingFactory]) *Session {
 	s := &Session{
-		conn:        conn,
 		isClient:    true,
 		sendPadding: true,
+		padder:      newPadder(true),
 		padding:     _padding,
 	}
+	s.conn.Store(conn)
+	s.connChanged = make(chan struct{})
+	s.sched = newSendScheduler(nil)
+	s.drainNotify = make(chan struct{}, 1)
 	s.die = make(chan struct{})
 	s.streams = make(map[uint32]*Stream)
+	s.associations = make(map[uint32]*PacketConn)
+	s.heartPending = make(map[uint32]chan struct{})
+	s.serverSettingsDone = make(chan struct{})
+	s.bindPending = make(map[uint32]chan error)
+	s.lastRecv.Store(time.Now().UnixNano())
 	return s
 }
 
-func NewServerSession(conn net.Conn, onNewStream func(stream *Stream), _padding *atomic.TypedValue[*padding.PaddingFactory]) *Session {
+func NewServerSession(conn net.Conn, onNewStream func(stream *Stream), _padding *atomic.TypedValue[*padding.PaddingFactory], config *ServerConfig) *Session {
+	if config == nil {
+		config = &ServerConfig{}
+	}
 	s := &Session{
-		conn:        conn,
+		config:      *config,
 		onNewStream: onNewStream,
+		padder:      newPadder(false),
 		padding:     _padding,
 		tracker:     R.Tracker.WithIP(conn.RemoteAddr()),
 	}
+	s.conn.Store(conn)
+	s.connChanged = make(chan struct{})
+	s.resumeCh = make(chan *resumeRequest, 1)
+	if config.Resume == nil {
+		s.replay.disabled = true
+	}
+	s.memory = newMemoryAccount(config.Memory)
+	s.replay.memory = s.memory
+	s.sched = newSendScheduler(s.memory)
+	s.drainNotify = make(chan struct{}, 1)
 	s.die = make(chan struct{})
 	s.streams = make(map[uint32]*Stream)
+	s.associations = make(map[uint32]*PacketConn)
+	s.heartPending = make(map[uint32]chan struct{})
+	s.lastRecv.Store(time.Now().UnixNano())
 	return s
 }
 
 func (s *Session) Run() {
 	if !s.isClient {
+		go s.sendLoop()
 		s.recvLoop()
 		return
 	}
 
-	settings := util.StringMap{
-		"v":           "2",
-		"client":      util.ProgramVersionName,
-		"padding-md5": s.padding.Load().Md5,
-	}
 	f := newFrame(cmdSettings, 0)
-	f.data = settings.ToBytes()
-	s.buffering = true
-	s.writeFrame(f)
+	f.data = newLocalSettings(s.padding.Load().Md5).Encode()
+	// held until the first stream writes its SocksAddr
+	s.buffering.Store(true)
+	s.queueFrame(f, true)
 
+	go s.sendLoop()
 	go s.recvLoop()
+	if s.keepalive.Interval > 0 {
+		go s.keepaliveLoop()
+	}
 }
 
 // IsClosed does a safe check to see if we have shutdown
@@ -128,50 +223,121 @@ func (s *Session) Close() error {
 		for _, stream := range s.streams {
 			stream.Close()
 		}
+		s.memory.release(memoryStreams, len(s.streams)*streamMemory)
 		s.streams = make(map[uint32]*Stream)
 		s.streamLock.Unlock()
-		return s.conn.Close()
+		s.datagramLock.Lock()
+		associations := make([]*PacketConn, 0, len(s.associations))
+		for _, c := range s.associations {
+			associations = append(associations, c)
+		}
+		s.datagramLock.Unlock()
+		for _, c := range associations {
+			c.close()
+		}
+		if ticket := s.negotiated().ticket; ticket != nil && !s.isClient {
+			s.config.Resume.remove(ticket)
+		}
+		// sendLoop is unblocked by the closed conn
+		var err error
+		if !s.handedOver.Load() {
+			err = s.currentConn().Close()
+		}
+		for _, req := range s.sched.close() {
+			req.finish(io.ErrClosedPipe)
+		}
+		s.sendLock.Lock()
+		if s.connReleased != nil {
+			close(s.connReleased)
+			s.connReleased = nil
+		}
+		s.sendLock.Unlock()
+		s.disableReplay()
+		s.memory.close()
+		return err
 	} else {
 		return io.ErrClosedPipe
 	}
 }
 
-// OpenStream is used to create a new stream for CLIENT
+// OpenStream is used to create a new stream.
+// Clients open streams with odd ids, servers open streams with even ids to clients of version >= 7.
 func (s *Session) OpenStream() (*Stream, error) {
+	return s.openStream(true)
+}
+
+// openStream creates a new stream, watchSYNACK closes the session
+// if the server does not report the outbound result in time
+func (s *Session) openStream(watchSYNACK bool) (*Stream, error) {
 	if s.IsClosed() {
 		return nil, io.ErrClosedPipe
 	}
+	if !s.isClient && !s.has(CapReverse) {
+		return nil, errReverseNotSupported
+	}
 
-	sid := s.streamId.Add(1)
+	if s.draining.Load() {
+		return nil, errSessionDraining
+	}
+
+	s.streamLock.Lock()
+	if limit := s.negotiated().maxStreams; limit > 0 && len(s.streams) >= int(limit) {
+		s.streamLock.Unlock()
+		return nil, errTooManyStreams
+	}
+	var sid uint32
+	if s.isClient {
+		sid = s.streamId.Add(2) - 1
+	} else {
+		sid = s.streamId.Add(2)
+	}
+	// created with the lock held, so its send window follows the negotiated one
 	stream := newStream(sid, s)
 
 	//logrus.Debugln("stream open", sid, s.streams)
 
-	if sid >= 2 && s.peerVersion >= 2 {
+	select {
+	case <-s.die:
+		s.streamLock.Unlock()
+		return nil, io.ErrClosedPipe
+	default:
+		s.streams[sid] = stream
+		s.memory.charge(memoryStreams, streamMemory)
+	}
+	s.streamLock.Unlock()
+
+	if watchSYNACK && s.isClient && sid >= 2 && s.has(CapSYNACK) {
 		s.synDoneLock.Lock()
 		if s.synDone != nil {
 			s.synDone()
 		}
 		s.synDone = util.NewDeadlineWatcher(time.Second*3, func() {
-			s.Close()
+			s.health.failure(errSYNACKTimeout)
+			s.breakConn()
 		})
 		s.synDoneLock.Unlock()
 	}
 
-	if _, err := s.writeFrame(newFrame(cmdSYN, sid)); err != nil {
+	// the first SYN is held with the settings, proxy Write it's SocksAddr to flush the buffer
+	if err := s.queueFrame(newFrame(cmdSYN, sid), s.buffering.CompareAndSwap(true, false)); err != nil {
+		s.removeStream(sid)
 		return nil, err
 	}
+	return stream, nil
+}
 
-	s.buffering = false // proxy Write it's SocksAddr to flush the buffer
+// streamCount returns the number of open streams
+func (s *Session) streamCount() int {
+	s.streamLock.RLock()
+	defer s.streamLock.RUnlock()
+	return len(s.streams)
+}
 
-	s.streamLock.Lock()
-	defer s.streamLock.Unlock()
-	select {
-	case <-s.die:
-		return nil, io.ErrClosedPipe
-	default:
-		s.streams[sid] = stream
-		return stream, nil
+// flushSettings sends the settings held for the first stream right away,
+// for client sessions which may not open a stream soon
+func (s *Session) flushSettings() {
+	if s.buffering.CompareAndSwap(true, false) {
+		s.writeFrame(newFrame(cmdWaste, 0))
 	}
 }
 
@@ -183,7 +349,19 @@ func (s *Session) recvLoop() error {
 	}()
 	defer s.Close()
 
-	var receivedSettingsFromClient bool
+	var state recvState
+	for {
+		err := s.recvFrames(&state)
+		var v *protocolViolation
+		if err == nil || err == errHandedOver || errors.As(err, &v) || !s.suspend(err) {
+			return err
+		}
+	}
+}
+
+// recvFrames handles the frames received on the current connection until it fails
+func (s *Session) recvFrames(state *recvState) error {
+	conn := s.currentConn()
 	var hdr rawHeader
 
 	for {
@@ -191,40 +369,92 @@ func (s *Session) recvLoop() error {
 			return io.ErrClosedPipe
 		}
 		// read header first
-		if _, err := io.ReadFull(s.conn, hdr[:]); err == nil {
+		if _, err := io.ReadFull(conn, hdr[:]); err == nil {
 			sid := hdr.StreamID()
+			s.lastRecv.Store(time.Now().UnixNano())
 
 			// rate
-			s.tracker.RecvChan() <- uint64(hdr.Length())
+			if s.tracker != nil {
+				s.tracker.RecvChan() <- uint64(hdr.Length())
+			}
+
+			if v := s.checkFrame(state, hdr); v != nil {
+				if err := s.violation(v); err != nil {
+					return err
+				}
+				// an unknown command of a newer version, skip its payload
+				if _, err := io.CopyN(io.Discard, conn, int64(hdr.Length())); err != nil {
+					return err
+				}
+				continue
+			}
 
 			switch hdr.Cmd() {
 			case cmdPSH:
 				if hdr.Length() > 0 {
-					buffer := buf.Get(int(hdr.Length()))
-					if _, err := io.ReadFull(s.conn, buffer); err == nil {
-						s.streamLock.RLock()
-						stream, ok := s.streams[sid]
-						s.streamLock.RUnlock()
-						if ok {
-							stream.pipeW.Write(buffer)
+					buffer := buf.NewSize(int(hdr.Length()))
+					if _, err := buffer.ReadFullFrom(conn, int(hdr.Length())); err != nil {
+						buffer.Release()
+						return err
+					}
+					s.streamLock.RLock()
+					stream, ok := s.streams[sid]
+					s.streamLock.RUnlock()
+					if ok {
+						if window := stream.recvWindow.Add(-int64(hdr.Length())); window < 0 && s.has(CapFlowControl) {
+							buffer.Release()
+							return s.violation(newViolation(ViolationFlowControl, "stream %d received %d bytes over its window", sid, -window))
+						}
+						// released by the pipe when the data is read or dropped
+						s.memory.charge(memoryReceive, buffer.Len())
+						if err := stream.pipe.WriteBuffer(buffer); err != nil {
+							// the read side has been closed locally, the data is dropped but its window is returned
+							s.memory.release(memoryReceive, int(hdr.Length()))
+							stream.consumeRecvWindow(int(hdr.Length()))
+						} else if !s.has(CapFlowControl) {
+							// The peer ignores our window, block until the data is consumed like before
+							stream.pipe.WaitBuffered(0)
 						}
-						buf.Put(buffer)
 					} else {
-						buf.Put(buffer)
-						return err
+						buffer.Release()
 					}
 				}
-			case cmdSYN: // should be server only
-				if !s.isClient && !receivedSettingsFromClient {
-					f := newFrame(cmdAlert, 0)
-					f.data = []byte("client did not send its settings")
-					s.writeFrame(f)
-					return nil
+			case cmdWindowUpdate:
+				var increment [4]byte
+				if _, err := io.ReadFull(conn, increment[:]); err != nil {
+					return err
 				}
+				s.streamLock.RLock()
+				stream, ok := s.streams[sid]
+				s.streamLock.RUnlock()
+				if ok {
+					stream.addSendWindow(int64(binary.BigEndian.Uint32(increment[:])))
+				}
+			case cmdSYN: // server, or client with CapReverse for reverse streams
+				state.lastPeerStream = sid
 				s.streamLock.Lock()
 				if _, ok := s.streams[sid]; !ok {
+					if s.config.MaxStreams > 0 && s.has(CapMaxStreams) && len(s.streams) >= s.config.MaxStreams {
+						s.streamLock.Unlock()
+						// the client knows the limit, it is not expected to get here
+						s.rejectStream(sid, errTooManyStreams)
+						break
+					}
+					if s.draining.Load() && !s.has(CapGoAway) {
+						// the client does not know about the drain, while newer clients may have sent the SYN before receiving cmdGoAway
+						s.streamLock.Unlock()
+						s.rejectStream(sid, errSessionDraining)
+						break
+					}
+					if s.memory.exhausted() {
+						s.streamLock.Unlock()
+						s.memory.budget.rejectedStreams.Add(1)
+						s.rejectStream(sid, errMemoryExhausted)
+						break
+					}
 					stream := newStream(sid, s)
 					s.streams[sid] = stream
+					s.memory.charge(memoryStreams, streamMemory)
 					go func() {
 						if s.onNewStream != nil {
 							s.onNewStream(stream)
@@ -234,92 +464,88 @@ func (s *Session) recvLoop() error {
 					}()
 				}
 				s.streamLock.Unlock()
-			case cmdSYNACK: // should be client only
+			case cmdSYNACK: // client, or server for reverse streams
 				s.synDoneLock.Lock()
 				if s.synDone != nil {
 					s.synDone()
 					s.synDone = nil
 				}
 				s.synDoneLock.Unlock()
+				var synackErr error
+				var bound M.Socksaddr
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
-					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+					if _, err := io.ReadFull(conn, buffer); err != nil {
 						buf.Put(buffer)
 						return err
 					}
-					// report error
-					s.streamLock.RLock()
-					stream, ok := s.streams[sid]
-					s.streamLock.RUnlock()
-					if ok {
-						stream.CloseWithError(fmt.Errorf("remote: %s", string(buffer)))
-					}
+					synackErr, bound = decodeSYNACK(buffer, s.has(CapSYNACKCode))
 					buf.Put(buffer)
 				}
+				// the server answered, an error is about the destination and not the server
+				s.health.success()
+				s.streamLock.RLock()
+				stream, ok := s.streams[sid]
+				s.streamLock.RUnlock()
+				if ok {
+					stream.synackReceived(synackErr, bound)
+					if synackErr != nil {
+						// report error
+						stream.CloseWithError(synackErr)
+					}
+				}
+			case cmdCloseWrite:
+				s.streamLock.RLock()
+				stream, ok := s.streams[sid]
+				s.streamLock.RUnlock()
+				if ok {
+					stream.remoteCloseWrite()
+				}
 			case cmdFIN:
 				s.streamLock.RLock()
 				stream, ok := s.streams[sid]
 				s.streamLock.RUnlock()
 				if ok {
-					stream.Close()
+					stream.closeRemote()
 				}
 				//logrus.Debugln("stream fin", sid, s.streams)
 			case cmdWaste:
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
-					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+					if _, err := io.ReadFull(conn, buffer); err != nil {
 						buf.Put(buffer)
 						return err
 					}
 					buf.Put(buffer)
 				}
-			case cmdSettings:
+			case cmdSettings: // server
+				var buffer []byte
 				if hdr.Length() > 0 {
-					buffer := buf.Get(int(hdr.Length()))
-					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+					buffer = buf.Get(int(hdr.Length()))
+					if _, err := io.ReadFull(conn, buffer); err != nil {
 						buf.Put(buffer)
 						return err
 					}
-					if !s.isClient {
-						receivedSettingsFromClient = true
-						m := util.StringMapFromBytes(buffer)
-						paddingF := s.padding.Load()
-						if m["padding-md5"] != paddingF.Md5 {
-							// logrus.Debugln("remote md5 is", m["padding-md5"])
-							f := newFrame(cmdUpdatePaddingScheme, 0)
-							f.data = paddingF.RawScheme
-							_, err = s.writeFrame(f)
-							if err != nil {
-								buf.Put(buffer)
-								return err
-							}
-						}
-						// check client's version
-						if v, err := strconv.Atoi(m["v"]); err == nil && v >= 2 {
-							s.peerVersion = byte(v)
-							// send cmdServerSettings
-							f := newFrame(cmdServerSettings, 0)
-							f.data = util.StringMap{
-								"v": "2",
-							}.ToBytes()
-							_, err = s.writeFrame(f)
-							if err != nil {
-								buf.Put(buffer)
-								return err
-							}
-						}
-					}
+				}
+				state.settings = true
+				err := s.handleSettings(buffer)
+				if buffer != nil {
 					buf.Put(buffer)
 				}
+				if err != nil {
+					return s.violation(newViolation(ViolationInvalidSettings, "%s", err))
+				}
 			case cmdAlert:
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
-					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+					if _, err := io.ReadFull(conn, buffer); err != nil {
 						buf.Put(buffer)
 						return err
 					}
 					if s.isClient {
 						logrus.Errorln("[Alert from server]", string(buffer))
+					} else {
+						logrus.Debugln("[Session] alert from client", conn.RemoteAddr(), string(buffer))
 					}
 					buf.Put(buffer)
 					return nil
@@ -328,12 +554,17 @@ func (s *Session) recvLoop() error {
 				if hdr.Length() > 0 {
 					// `rawScheme` Do not use buffer to prevent subsequent misuse
 					rawScheme := make([]byte, int(hdr.Length()))
-					if _, err := io.ReadFull(s.conn, rawScheme); err != nil {
+					if _, err := io.ReadFull(conn, rawScheme); err != nil {
 						return err
 					}
-					if s.isClient && !clientDebugPaddingScheme {
-						if padding.UpdatePaddingScheme(rawScheme) {
+					if !clientDebugPaddingScheme {
+						// the scheme only replaces the one of the client of this session
+						if p := padding.NewPaddingFactory(rawScheme); p != nil {
+							s.padding.Store(p)
 							logrus.Infof("[Update padding succeed] %x\n", md5.Sum(rawScheme))
+							if s.onPaddingUpdate != nil {
+								s.onPaddingUpdate(p)
+							}
 						} else {
 							logrus.Warnf("[Update padding failed] %x\n", md5.Sum(rawScheme))
 						}
@@ -344,26 +575,94 @@ func (s *Session) recvLoop() error {
 					return err
 				}
 			case cmdHeartResponse:
-				// Active keepalive checking is not implemented yet
-				break
-			case cmdServerSettings:
+				s.heartResponse(sid)
+			case cmdGoAway: // client
+				s.draining.Store(true)
+				if !s.busy() {
+					return nil
+				}
+			case cmdServerSettings: // client
+				var buffer []byte
+				if hdr.Length() > 0 {
+					buffer = buf.Get(int(hdr.Length()))
+					if _, err := io.ReadFull(conn, buffer); err != nil {
+						buf.Put(buffer)
+						return err
+					}
+				}
+				state.settings = true
+				err := s.handleServerSettings(buffer)
+				if buffer != nil {
+					buf.Put(buffer)
+				}
+				if err != nil {
+					return s.violation(newViolation(ViolationInvalidSettings, "%s", err))
+				}
+				s.settingsDone()
+			case cmdBind: // server
+				var address string
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
-					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+					if _, err := io.ReadFull(conn, buffer); err != nil {
 						buf.Put(buffer)
 						return err
 					}
-					if s.isClient {
-						// check server's version
-						m := util.StringMapFromBytes(buffer)
-						if v, err := strconv.Atoi(m["v"]); err == nil {
-							s.peerVersion = byte(v)
-						}
+					address = string(buffer)
+					buf.Put(buffer)
+				}
+				s.handleBind(sid, address)
+			case cmdBindAck: // client
+				var err error
+				if hdr.Length() > 0 {
+					buffer := buf.Get(int(hdr.Length()))
+					if _, err := io.ReadFull(conn, buffer); err != nil {
+						buf.Put(buffer)
+						return err
 					}
+					err = fmt.Errorf("remote: %s", string(buffer))
 					buf.Put(buffer)
 				}
-			default:
-				// I don't know what command it is (can't have data)
+				s.bindResult(sid, err)
+			case cmdDatagram:
+				buffer := buf.NewSize(int(hdr.Length()))
+				if _, err := buffer.ReadFullFrom(conn, int(hdr.Length())); err != nil {
+					buffer.Release()
+					return err
+				}
+				if err := s.handleDatagram(sid, buffer); err != nil {
+					return err
+				}
+			case cmdDatagramClose: // server, or client with CapDatagramClose for a rejected association
+				s.handleDatagramClose(sid)
+			case cmdAck:
+				var received [4]byte
+				if _, err := io.ReadFull(conn, received[:]); err != nil {
+					return err
+				}
+				s.replay.ack(binary.BigEndian.Uint32(received[:]))
+			case cmdResume: // server, the first frame of a connection resuming another session
+				if state.settings {
+					return s.violation(newViolation(ViolationUnexpectedCommand, "resume after the settings"))
+				}
+				buffer := buf.Get(int(hdr.Length()))
+				if _, err := io.ReadFull(conn, buffer); err != nil {
+					buf.Put(buffer)
+					return err
+				}
+				err := s.handleResume(buffer)
+				buf.Put(buffer)
+				return err
+			}
+
+			if replayed(hdr.Cmd()) {
+				received := s.recvReplay.Add(1)
+				state.unacked += headerOverHeadSize + int(hdr.Length())
+				if state.unacked >= replayAckBytes && s.has(CapResume) {
+					state.unacked = 0
+					f := newFrame(cmdAck, 0)
+					f.data = binary.BigEndian.AppendUint32(nil, received)
+					s.writeFrame(f)
+				}
 			}
 		} else {
 			return err
@@ -376,107 +675,243 @@ func (s *Session) streamClosed(sid uint32) error {
 		return io.ErrClosedPipe
 	}
 	_, err := s.writeFrame(newFrame(cmdFIN, sid))
+	s.removeStream(sid)
+	s.notifyDrain()
+	return err
+}
+
+// removeStream forgets a stream of the session
+func (s *Session) removeStream(sid uint32) {
 	s.streamLock.Lock()
-	delete(s.streams, sid)
+	if _, ok := s.streams[sid]; ok {
+		delete(s.streams, sid)
+		s.memory.release(memoryStreams, streamMemory)
+	}
 	s.streamLock.Unlock()
-	return err
 }
 
+// rejectStream refuses a stream opened by the peer
+func (s *Session) rejectStream(sid uint32, err error) {
+	if s.has(CapSYNACK) {
+		f := newFrame(cmdSYNACK, sid)
+		if s.has(CapSYNACKCode) {
+			f.data = encodeSYNACK(CodeGeneralFailure, err.Error(), M.Socksaddr{})
+		} else {
+			f.data = []byte(err.Error())
+		}
+		s.writeFrame(f)
+	} else {
+		s.writeFrame(newFrame(cmdFIN, sid))
+	}
+}
+
+// writeFrame queues a control frame, it is sent before the pending stream data.
+// The caller does not wait for the frame to be sent.
 func (s *Session) writeFrame(frame frame) (int, error) {
-	dataLen := len(frame.data)
+	if err := s.queueFrame(frame, false); err != nil {
+		return 0, err
+	}
+	return len(frame.data), nil
+}
+
+// queueFrame queues a copy of a control frame, a held frame is sent together with the next one
+func (s *Session) queueFrame(frame frame, hold bool) error {
+	if len(frame.data) > maxFramePayloadSize {
+		return errFrameTooLarge
+	}
+	req := newOwnedWriteRequest(frame)
+	req.hold = hold
+	if err := s.sched.pushControl(req); err != nil {
+		req.release()
+		return err
+	}
+	return nil
+}
 
-	buffer := buf.NewSize(dataLen + headerOverHeadSize)
-	buffer.WriteByte(frame.cmd)
-	binary.BigEndian.PutUint32(buffer.Extend(4), frame.sid)
-	binary.BigEndian.PutUint16(buffer.Extend(2), uint16(dataLen))
-	buffer.Write(frame.data)
+// writeFrameWait queues a control frame and waits until it has been sent
+func (s *Session) writeFrameWait(frame frame) error {
+	if len(frame.data) > maxFramePayloadSize {
+		return errFrameTooLarge
+	}
+	done := make(chan error, 1)
+	req := newWriteRequest(frame, done)
+	if err := s.sched.pushControl(req); err != nil {
+		req.release()
+		return err
+	}
+	return <-done
+}
+
+// sendLoop is the only goroutine writing to the connection, it sends the frames
+// in the order decided by the scheduler
+func (s *Session) sendLoop() {
+	defer func() {
+		for _, req := range s.sched.close() {
+			req.finish(io.ErrClosedPipe)
+		}
+		s.sendLock.Lock()
+		defer s.sendLock.Unlock()
+		if s.encodeBuffer != nil {
+			s.encodeBuffer.Release()
+			s.encodeBuffer = nil
+		}
+		if s.buffer != nil {
+			s.buffer.Release()
+			s.buffer = nil
+		}
+	}()
 
+	for {
+		req := s.sched.next()
+		if req == nil {
+			select {
+			case <-s.sched.notify:
+				continue
+			case <-s.die:
+				return
+			}
+		}
+		s.sendLock.Lock()
+		conn, changed := s.currentConn(), s.connChanged
+		err := s.sendFrame(req.frame, req.hold)
+		s.sendLock.Unlock()
+		if err != nil && s.resumable() {
+			// the frame is sent again on the next connection if it is a stream frame,
+			// the others are lost with the connection
+			if replayed(req.frame.cmd) {
+				err = nil
+			}
+			req.finish(err)
+			conn.Close()
+			select {
+			case <-changed:
+				continue
+			case <-s.die:
+				return
+			}
+		}
+		req.finish(err)
+		if err != nil {
+			s.Close()
+			return
+		}
+	}
+}
+
+// sendFrame encodes and writes a frame, must only be called by sendLoop with sendLock held
+func (s *Session) sendFrame(frame frame, hold bool) error {
+	if replayed(frame.cmd) {
+		s.replay.record(frame)
+	}
+	if s.encodeBuffer == nil {
+		s.encodeBuffer = buf.NewSize(headerOverHeadSize + maxFramePayloadSize)
+	}
+	s.encodeBuffer.Reset()
+	frame.encodeTo(s.encodeBuffer)
+	if hold {
+		s.appendBuffer(s.encodeBuffer.Bytes())
+		return nil
+	}
 	// L.Limit.TryLimitSend(recorder)
-	n, err := s.writeConn(buffer.Bytes())
-	if err == nil {
+	n, err := s.writeConn(s.encodeBuffer.Bytes(), true)
+	if err != nil {
+		return err
+	}
+	if s.tracker != nil {
 		// rate
 		s.tracker.SendChan() <- uint64(n)
 	}
-	buffer.Release()
-	if err != nil {
-		return 0, err
-	}
-	return dataLen, nil
+	return nil
 }
 
-func (s *Session) writeConn(b []byte) (n int, err error) {
-	s.connLock.Lock()
-	defer s.connLock.Unlock()
-
-	if s.buffering {
-		s.buffer = slices.Concat(s.buffer, b)
-		return len(b), nil
-	} else if len(s.buffer) > 0 {
-		b = slices.Concat(s.buffer, b)
+// writeConn sends b with the padding scheme applied, must only be called with sendLock held.
+// With unlock, sendLock is released during the delays of the scheme, so that the receive loop
+// is not held up, otherwise nothing else is written to the connection until b is sent.
+func (s *Session) writeConn(b []byte, unlock bool) (n int, err error) {
+	conn := s.currentConn()
+	if s.buffer != nil {
+		s.appendBuffer(b)
+		// owned by this write, a new connection may drop the buffer during a delay
+		buffer := s.buffer
 		s.buffer = nil
+		defer buffer.Release()
+		b = buffer.Bytes()
 	}
 
 	// calulate & send padding
 	if s.sendPadding {
-		pkt := s.pktCounter.Add(1)
 		paddingF := s.padding.Load()
-		if pkt < paddingF.Stop {
-			pktSizes := paddingF.GenerateRecordPayloadSizes(pkt)
-			for _, l := range pktSizes {
-				remainPayloadLen := len(b)
-				if l == padding.CheckMark {
-					if remainPayloadLen == 0 {
-						break
-					} else {
+		if !s.isClient {
+			paddingF = paddingF.Down
+		}
+		if writes, ok := s.padder.Next(paddingF, len(b)); ok {
+			for _, w := range writes {
+				if w.Delay > 0 {
+					if !unlock {
+						s.paddingWait(w.Delay)
 						continue
 					}
-				}
-				// logrus.Debugln(pkt, "write", l, "len", remainPayloadLen, "remain", remainPayloadLen-l)
-				if remainPayloadLen > l { // this packet is all payload
-					_, err = s.conn.Write(b[:l])
-					if err != nil {
-						return 0, err
-					}
-					n += l
-					b = b[l:]
-				} else if remainPayloadLen > 0 { // this packet contains padding and the last part of payload
-					paddingLen := l - remainPayloadLen - headerOverHeadSize
-					if paddingLen > 0 {
-						padding := make([]byte, headerOverHeadSize+paddingLen)
-						padding[0] = cmdWaste
-						binary.BigEndian.PutUint32(padding[1:5], 0)
-						binary.BigEndian.PutUint16(padding[5:7], uint16(paddingLen))
-						b = slices.Concat(b, padding)
-					}
-					_, err = s.conn.Write(b)
-					if err != nil {
-						return 0, err
+					s.sendLock.Unlock()
+					s.paddingWait(w.Delay)
+					s.sendLock.Lock()
+					if s.currentConn() != conn {
+						// the session was resumed meanwhile, the rest of b is lost with the old connection
+						return n, net.ErrClosed
 					}
-					n += remainPayloadLen
-					b = nil
-				} else { // this packet is all padding
-					padding := make([]byte, headerOverHeadSize+l)
-					padding[0] = cmdWaste
-					binary.BigEndian.PutUint32(padding[1:5], 0)
-					binary.BigEndian.PutUint16(padding[5:7], uint16(l))
-					_, err = s.conn.Write(padding)
-					if err != nil {
-						return 0, err
-					}
-					b = nil
+					continue
 				}
+				if w.Waste > 0 {
+					record := buf.NewSize(w.Size())
+					record.Write(b[:w.Payload])
+					encodeWasteTo(record, w.Waste)
+					_, err = conn.Write(record.Bytes())
+					record.Release()
+				} else {
+					_, err = conn.Write(b[:w.Payload])
+				}
+				if err != nil {
+					return 0, err
+				}
+				n += w.Payload
+				b = b[w.Payload:]
 			}
-			// maybe still remain payload to write
-			if len(b) == 0 {
-				return
-			} else {
-				n2, err := s.conn.Write(b)
-				return n + n2, err
-			}
+			return
 		} else {
 			s.sendPadding = false
 		}
 	}
 
-	return s.conn.Write(b)
+	return conn.Write(b)
+}
+
+// newPadder numbers the writes to a new connection, the packet 0 of clients is their authentication
+// and the downstream section counts the writes of servers from 0
+func newPadder(isClient bool) padding.Padder {
+	if isClient {
+		return padding.NewPadder(1)
+	}
+	return padding.NewPadder(0)
+}
+
+// paddingWait waits for a delay directive of the padding scheme, or until the session is closed
+func (s *Session) paddingWait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.die:
+	}
+}
+
+// appendBuffer keeps b to be sent together with the next write, must only be called with sendLock held
+func (s *Session) appendBuffer(b []byte) {
+	if s.buffer == nil {
+		s.buffer = buf.NewSize(max(len(b), 1024))
+	} else if s.buffer.FreeLen() < len(b) {
+		grown := buf.NewSize(s.buffer.Len() + len(b))
+		grown.Write(s.buffer.Bytes())
+		s.buffer.Release()
+		s.buffer = grown
+	}
+	s.buffer.Write(b)
 }
@@ -0,0 +1,172 @@
+package session
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"anytls/proxy/padding"
+)
+
+// testPair connects a client session to a server session, the streams opened by the client
+// are reported as successful and sent to the returned channel
+func testPair(t *testing.T, config *ServerConfig) (client, server *Session, streams chan *Stream) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	streams = make(chan *Stream, 16)
+	server = NewServerSession(serverConn, func(stream *Stream) {
+		stream.HandshakeSuccess()
+		streams <- stream
+	}, padding.NewStorage(nil), config)
+	client = NewClientSession(clientConn, padding.NewStorage(nil))
+	go server.Run()
+	client.Run()
+	client.flushSettings()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	select {
+	case <-client.serverSettingsDone:
+	case <-time.After(time.Second):
+		t.Fatal("no server settings")
+	}
+	return client, server, streams
+}
+
+// acceptStream returns the next stream opened by the client
+func acceptStream(t *testing.T, streams chan *Stream) *Stream {
+	t.Helper()
+	select {
+	case stream := <-streams:
+		return stream
+	case <-time.After(time.Second):
+		t.Fatal("no stream opened")
+		return nil
+	}
+}
+
+// readFrame reads the next frame sent by a session
+func readFrame(r io.Reader) (frame, error) {
+	var hdr rawHeader
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	f := newFrame(hdr.Cmd(), hdr.StreamID())
+	f.data = make([]byte, hdr.Length())
+	_, err := io.ReadFull(r, f.data)
+	return f, err
+}
+
+// readAlert reads the frames sent by a session until its cmdAlert, and discards the next ones
+func readAlert(t *testing.T, r net.Conn) string {
+	t.Helper()
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			t.Fatal("no alert:", err)
+		}
+		if f.cmd == cmdAlert {
+			// the rest of the write is read, so that the session can close
+			r.SetReadDeadline(time.Time{})
+			go io.Copy(io.Discard, r)
+			return string(f.data)
+		}
+	}
+}
+
+// rawServer returns a server session and the connection of its client, which speaks raw frames
+func rawServer(t *testing.T, config *ServerConfig) (*Session, net.Conn) {
+	t.Helper()
+	conn, peer := net.Pipe()
+	server := NewServerSession(conn, func(stream *Stream) {
+		stream.HandshakeSuccess()
+	}, padding.NewStorage(nil), config)
+	go server.Run()
+	t.Cleanup(func() {
+		peer.Close()
+		server.Close()
+	})
+	return server, peer
+}
+
+// TestPaddingDelayUnlocked checks that the delays of the padding scheme do not hold sendLock
+func TestPaddingDelayUnlocked(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+	scheme := padding.NewPaddingFactory([]byte("stop=2\n0=30-30\n1=d500-500,100-100"))
+	if scheme == nil {
+		t.Fatal("invalid scheme")
+	}
+	client := NewClientSession(conn, padding.NewStorage(scheme))
+	client.Run()
+	defer client.Close()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.writeFrameWait(newFrame(cmdHeartRequest, 0))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		client.sendLock.Lock()
+		client.sendLock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("sendLock held during a delay of the padding scheme")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("written after %v, before the delay", elapsed)
+	}
+}
+
+// TestServerPaddingDown checks that servers pad their first writes with the downstream section
+// of the scheme, only for clients with CapPaddingDown
+func TestServerPaddingDown(t *testing.T) {
+	scheme := padding.NewPaddingFactory([]byte("stop=1\n0=30-30\ndown.stop=2\ndown.0=500-500\ndown.1=500-500"))
+	if scheme == nil || scheme.Down == nil {
+		t.Fatal("invalid scheme")
+	}
+	for _, padded := range []bool{true, false} {
+		conn, peer := net.Pipe()
+		server := NewServerSession(conn, func(stream *Stream) {
+			stream.HandshakeSuccess()
+		}, padding.NewStorage(scheme), nil)
+		go server.Run()
+		settings := newLocalSettings(scheme.Md5)
+		if !padded {
+			settings.Capabilities &^= CapPaddingDown
+		}
+		go peer.Write(encodeFrames(frameWithData(cmdSettings, 0, settings.Encode()), newFrame(cmdSYN, 1)))
+
+		// a read of the pipe returns a whole write of the session
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 65536)
+		for i := 0; i < 2; i++ {
+			n, err := peer.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hdr rawHeader
+			copy(hdr[:], b)
+			if padded && n != 500 {
+				t.Fatalf("padded write %d of %d bytes, want 500", i, n)
+			}
+			if !padded && (hdr.Cmd() == cmdWaste || n != headerOverHeadSize+int(hdr.Length())) {
+				t.Fatalf("write %d of %d bytes padded without padding-down", i, n)
+			}
+		}
+		peer.Close()
+		server.Close()
+	}
+}
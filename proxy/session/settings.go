@@ -0,0 +1,448 @@
+package session
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"anytls/util"
+)
+
+// protocolVersion is the version sent in cmdSettings and cmdServerSettings
+const protocolVersion = 7
+
+// Capabilities is a set of protocol features
+type Capabilities uint32
+
+const (
+	CapSYNACK         Capabilities = 1 << iota // cmdSYNACK reports the outbound result (version 2)
+	CapHeartbeat                               // cmdHeartRequest and cmdHeartResponse (version 2)
+	CapServerSettings                          // cmdServerSettings (version 2)
+	CapFlowControl                             // per-stream windows and cmdWindowUpdate (version 3)
+	CapHalfClose                               // cmdCloseWrite (version 4)
+	CapMaxStreams                              // max-streams limit (version 5)
+	CapGoAway                                  // cmdGoAway (version 6)
+	CapReverse                                 // reverse tunnels, cmdBind and cmdBindAck (version 7)
+	CapSYNACKCode                              // error codes and bound address in cmdSYNACK
+	CapDatagram                                // cmdDatagram and cmdDatagramClose
+	CapResume                                  // session tickets, cmdAck and cmdResume
+	CapPaddingDown                             // downstream section of the padding scheme, servers pad their writes
+	CapDatagramClose                           // servers reject associations with cmdDatagramClose
+)
+
+// capabilityNames are the names in the caps setting, in bit order
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapSYNACK, "synack"},
+	{CapHeartbeat, "heartbeat"},
+	{CapServerSettings, "server-settings"},
+	{CapFlowControl, "flow-control"},
+	{CapHalfClose, "half-close"},
+	{CapMaxStreams, "max-streams"},
+	{CapGoAway, "goaway"},
+	{CapReverse, "reverse"},
+	{CapSYNACKCode, "synack-code"},
+	{CapDatagram, "datagram"},
+	{CapResume, "resume"},
+	{CapPaddingDown, "padding-down"},
+	{CapDatagramClose, "datagram-close"},
+}
+
+// localCapabilities are the features implemented by this package
+const localCapabilities = CapSYNACK | CapHeartbeat | CapServerSettings | CapFlowControl |
+	CapHalfClose | CapMaxStreams | CapGoAway | CapReverse | CapSYNACKCode | CapDatagram | CapResume | CapPaddingDown | CapDatagramClose
+
+// offeredCapabilities are the features offered to the peer, servers without
+// a datagram handler do not offer CapDatagram, and without a ResumeStore CapResume
+func (s *Session) offeredCapabilities() Capabilities {
+	caps := localCapabilities
+	if !s.isClient && s.config.OnPacketConn == nil {
+		caps &^= CapDatagram
+	}
+	if !s.isClient && s.config.Resume == nil {
+		caps &^= CapResume
+	}
+	return caps
+}
+
+// versionCapabilities returns the features implied by a protocol version,
+// for peers which do not send the caps setting
+func versionCapabilities(version int) Capabilities {
+	var caps Capabilities
+	if version >= 2 {
+		caps |= CapSYNACK | CapHeartbeat | CapServerSettings
+	}
+	if version >= 3 {
+		caps |= CapFlowControl
+	}
+	if version >= 4 {
+		caps |= CapHalfClose
+	}
+	if version >= 5 {
+		caps |= CapMaxStreams
+	}
+	if version >= 6 {
+		caps |= CapGoAway
+	}
+	if version >= 7 {
+		caps |= CapReverse
+	}
+	return caps
+}
+
+// Has reports whether all features of c are in the set
+func (caps Capabilities) Has(c Capabilities) bool {
+	return caps&c == c
+}
+
+func (caps Capabilities) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if caps.Has(n.cap) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseCapabilities parses the caps setting, unknown names are features of newer versions and ignored
+func parseCapabilities(s string) Capabilities {
+	var caps Capabilities
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		for _, n := range capabilityNames {
+			if n.name == name {
+				caps |= n.cap
+				break
+			}
+		}
+	}
+	return caps
+}
+
+const (
+	minStreamWindow = 1024
+	maxStreamWindow = 1 << 30
+	maxMaxStreams   = 1 << 16
+)
+
+// Settings is sent by the client in cmdSettings
+type Settings struct {
+	Version      int
+	Client       string
+	PaddingMD5   string
+	Capabilities Capabilities
+	StreamWindow uint32
+}
+
+// ServerSettings is sent by the server in cmdServerSettings
+type ServerSettings struct {
+	Version      int
+	Capabilities Capabilities
+	StreamWindow uint32
+	// MaxStreams is the limit of concurrent streams of a session, zero means unlimited
+	MaxStreams uint32
+	// Ticket resumes the session with CapResume, it is valid for ResumeTimeout after the connection breaks
+	Ticket        []byte
+	ResumeTimeout time.Duration
+}
+
+func newLocalSettings(paddingMD5 string) *Settings {
+	return &Settings{
+		Version:      protocolVersion,
+		Client:       util.ProgramVersionName,
+		PaddingMD5:   paddingMD5,
+		Capabilities: localCapabilities,
+		StreamWindow: defaultStreamWindow,
+	}
+}
+
+// Encode returns the cmdSettings payload, keys are sorted so the encoding is deterministic
+func (s *Settings) Encode() []byte {
+	m := util.StringMap{
+		"v":             strconv.Itoa(s.Version),
+		"client":        s.Client,
+		"padding-md5":   s.PaddingMD5,
+		"caps":          s.Capabilities.String(),
+		"stream-window": strconv.FormatUint(uint64(s.StreamWindow), 10),
+	}
+	return m.ToBytes()
+}
+
+// ParseSettings decodes and validates a cmdSettings payload
+func ParseSettings(b []byte) (*Settings, error) {
+	m := util.StringMapFromBytes(b)
+	s := &Settings{
+		Client:     m["client"],
+		PaddingMD5: m["padding-md5"],
+	}
+	var err error
+	if s.Version, s.Capabilities, err = parseVersionCapabilities(m); err != nil {
+		return nil, err
+	}
+	if s.PaddingMD5 != "" {
+		if b, err := hex.DecodeString(s.PaddingMD5); err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("invalid padding-md5 %q", s.PaddingMD5)
+		}
+	}
+	if s.StreamWindow, err = parseUint32Setting(m, "stream-window", defaultStreamWindow, minStreamWindow, maxStreamWindow); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Encode returns the cmdServerSettings payload, keys are sorted so the encoding is deterministic
+func (s *ServerSettings) Encode() []byte {
+	m := util.StringMap{
+		"v":             strconv.Itoa(s.Version),
+		"caps":          s.Capabilities.String(),
+		"stream-window": strconv.FormatUint(uint64(s.StreamWindow), 10),
+	}
+	if s.MaxStreams > 0 {
+		m["max-streams"] = strconv.FormatUint(uint64(s.MaxStreams), 10)
+	}
+	if s.Ticket != nil {
+		m["ticket"] = hex.EncodeToString(s.Ticket)
+		m["resume-timeout"] = strconv.Itoa(int(s.ResumeTimeout / time.Second))
+	}
+	return m.ToBytes()
+}
+
+// ParseServerSettings decodes and validates a cmdServerSettings payload
+func ParseServerSettings(b []byte) (*ServerSettings, error) {
+	m := util.StringMapFromBytes(b)
+	s := &ServerSettings{}
+	var err error
+	if s.Version, s.Capabilities, err = parseVersionCapabilities(m); err != nil {
+		return nil, err
+	}
+	if s.StreamWindow, err = parseUint32Setting(m, "stream-window", defaultStreamWindow, minStreamWindow, maxStreamWindow); err != nil {
+		return nil, err
+	}
+	if s.MaxStreams, err = parseUint32Setting(m, "max-streams", 0, 0, maxMaxStreams); err != nil {
+		return nil, err
+	}
+	if ticket, ok := m["ticket"]; ok {
+		if s.Ticket, err = hex.DecodeString(ticket); err != nil || len(s.Ticket) != ticketSize {
+			return nil, fmt.Errorf("invalid ticket %q", ticket)
+		}
+		// the session can not be resumed without it
+		if _, ok := m["resume-timeout"]; !ok {
+			return nil, fmt.Errorf("ticket without resume-timeout")
+		}
+		timeout, err := parseUint32Setting(m, "resume-timeout", 0, 1, uint32(maxResumeTimeout/time.Second))
+		if err != nil {
+			return nil, err
+		}
+		s.ResumeTimeout = time.Duration(timeout) * time.Second
+	}
+	return s, nil
+}
+
+// parseVersionCapabilities reads v and caps, the capabilities follow the version when caps is absent
+func parseVersionCapabilities(m util.StringMap) (int, Capabilities, error) {
+	version := 1
+	if v, ok := m["v"]; ok {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			return 0, 0, fmt.Errorf("invalid v %q", v)
+		}
+	}
+	if caps, ok := m["caps"]; ok {
+		return version, parseCapabilities(caps), nil
+	}
+	return version, versionCapabilities(version), nil
+}
+
+func parseUint32Setting(m util.StringMap, key string, defaultValue, minValue, maxValue uint32) (uint32, error) {
+	v, ok := m[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || uint32(n) < minValue || uint32(n) > maxValue {
+		return 0, fmt.Errorf("invalid %s %q", key, v)
+	}
+	return uint32(n), nil
+}
+
+// negotiated is the outcome of the settings exchange.
+// It is replaced as a whole when the peer settings arrive, so readers never see a partial update.
+type negotiated struct {
+	version int
+	// features supported by both sides
+	caps Capabilities
+	// stream window of the peer
+	streamWindow uint32
+	// stream limit of the server, zero means unlimited
+	maxStreams uint32
+	// ticket of a session with CapResume, which may be resumed within resumeTimeout
+	ticket        []byte
+	resumeTimeout time.Duration
+}
+
+// defaultNegotiated is used until the peer settings arrive, as a version 1 peer
+var defaultNegotiated = &negotiated{
+	version:      1,
+	streamWindow: defaultStreamWindow,
+}
+
+func (s *Session) negotiated() *negotiated {
+	if n := s.peer.Load(); n != nil {
+		return n
+	}
+	return defaultNegotiated
+}
+
+// has reports whether both sides support the features
+func (s *Session) has(c Capabilities) bool {
+	return s.negotiated().caps.Has(c)
+}
+
+// Capabilities returns the features negotiated with the peer
+func (s *Session) Capabilities() Capabilities {
+	return s.negotiated().caps
+}
+
+// PeerVersion returns the protocol version of the peer, 1 until its settings are received
+func (s *Session) PeerVersion() int {
+	return s.negotiated().version
+}
+
+// setNegotiated applies the peer settings, the send windows of the streams
+// already opened with the default one are adjusted
+func (s *Session) setNegotiated(n *negotiated) {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	old := s.negotiated()
+	s.peer.Store(n)
+	if delta := int64(n.streamWindow) - int64(old.streamWindow); delta != 0 {
+		for _, stream := range s.streams {
+			stream.addSendWindow(delta)
+		}
+	}
+}
+
+// handleSettings is called by the server for cmdSettings
+func (s *Session) handleSettings(b []byte) error {
+	settings, err := ParseSettings(b)
+	if err != nil {
+		return err
+	}
+
+	caps := settings.Capabilities & s.offeredCapabilities()
+	paddingF := s.padding.Load()
+	if caps.Has(CapPaddingDown) && paddingF.Down != nil {
+		// the writes from now on are padded
+		s.sendLock.Lock()
+		s.sendPadding = true
+		s.sendLock.Unlock()
+	}
+
+	// clients without CapPaddingDown get the scheme without its downstream section
+	rawScheme, md5 := paddingF.UpstreamScheme, paddingF.UpstreamMd5
+	if caps.Has(CapPaddingDown) {
+		rawScheme, md5 = paddingF.RawScheme, paddingF.Md5
+	}
+	if settings.PaddingMD5 != md5 {
+		// logrus.Debugln("remote md5 is", settings.PaddingMD5)
+		f := newFrame(cmdUpdatePaddingScheme, 0)
+		f.data = rawScheme
+		if _, err := s.writeFrame(f); err != nil {
+			return err
+		}
+	}
+
+	n := &negotiated{
+		version:      settings.Version,
+		caps:         caps,
+		streamWindow: settings.StreamWindow,
+	}
+	if caps.Has(CapResume | CapServerSettings) {
+		n.ticket = s.config.Resume.issue(s)
+		n.resumeTimeout = s.config.Resume.timeout
+	} else {
+		s.disableReplay()
+	}
+	s.setNegotiated(n)
+
+	if caps.Has(CapServerSettings) {
+		serverSettings := &ServerSettings{
+			Version:      protocolVersion,
+			Capabilities: s.offeredCapabilities(),
+			StreamWindow: defaultStreamWindow,
+		}
+		if s.config.MaxStreams > 0 {
+			serverSettings.MaxStreams = uint32(s.config.MaxStreams)
+		}
+		serverSettings.Ticket = n.ticket
+		serverSettings.ResumeTimeout = n.resumeTimeout
+		f := newFrame(cmdServerSettings, 0)
+		f.data = serverSettings.Encode()
+		if _, err := s.writeFrame(f); err != nil {
+			return err
+		}
+		if caps.Has(CapGoAway) && s.draining.Load() {
+			// drained before the capabilities were known
+			s.writeFrame(newFrame(cmdGoAway, 0))
+		}
+	}
+	return nil
+}
+
+// settingsDone wakes up the waiters for cmdServerSettings, it is called when the settings are received
+// or when a stream has waited serverSettingsTimeout for them: the server is then taken as version 1,
+// so the next streams do not wait again. Settings arriving later still apply.
+func (s *Session) settingsDone() {
+	s.serverSettingsOnce.Do(func() {
+		close(s.serverSettingsDone)
+	})
+}
+
+// settingsTimedOut is called when a stream has waited serverSettingsTimeout for cmdServerSettings,
+// a version 1 server can not resume the session so the frames are not kept for it
+func (s *Session) settingsTimedOut() {
+	s.disableReplay()
+	s.settingsDone()
+}
+
+// settingsPending reports whether a client still waits for the settings of its server
+func (s *Session) settingsPending() bool {
+	if !s.isClient {
+		return false
+	}
+	select {
+	case <-s.serverSettingsDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// handleServerSettings is called by the client for cmdServerSettings
+func (s *Session) handleServerSettings(b []byte) error {
+	settings, err := ParseServerSettings(b)
+	if err != nil {
+		return err
+	}
+	n := &negotiated{
+		version:      settings.Version,
+		caps:         settings.Capabilities & localCapabilities,
+		streamWindow: settings.StreamWindow,
+	}
+	if n.caps.Has(CapMaxStreams) {
+		n.maxStreams = settings.MaxStreams
+	}
+	if n.caps.Has(CapResume) && settings.Ticket != nil {
+		n.ticket = settings.Ticket
+		n.resumeTimeout = settings.ResumeTimeout
+	} else {
+		s.disableReplay()
+	}
+	s.setNegotiated(n)
+	return nil
+}
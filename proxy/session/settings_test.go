@@ -0,0 +1,76 @@
+package session
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// FuzzParseSettings checks that valid settings are encoded back to the same settings
+func FuzzParseSettings(f *testing.F) {
+	f.Add(newLocalSettings("0123456789abcdef0123456789abcdef").Encode())
+	f.Add([]byte("v=1"))
+	f.Add([]byte("v=2\nclient=sing-box/1.10\npadding-md5=0123456789abcdef0123456789abcdef"))
+	f.Add([]byte("v=7\ncaps=synack, datagram,unknown\nstream-window=1024"))
+	f.Add([]byte("v=0\nstream-window=1073741825\npadding-md5=zz"))
+	f.Add([]byte(""))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s, err := ParseSettings(b)
+		if err != nil {
+			return
+		}
+		if s.Version < 1 || s.StreamWindow < minStreamWindow || s.StreamWindow > maxStreamWindow {
+			t.Fatalf("invalid settings accepted: %+v", s)
+		}
+		if s.Capabilities&^localCapabilities != 0 {
+			t.Fatalf("unknown capabilities %b", s.Capabilities)
+		}
+		encoded := s.Encode()
+		again, err := ParseSettings(encoded)
+		if err != nil {
+			t.Fatalf("encoded settings %q can not be parsed: %s", encoded, err)
+		}
+		if !reflect.DeepEqual(s, again) {
+			t.Fatalf("%+v encoded as %q is parsed as %+v", s, encoded, again)
+		}
+	})
+}
+
+// FuzzParseServerSettings checks that valid server settings are encoded back to the same settings
+func FuzzParseServerSettings(f *testing.F) {
+	f.Add((&ServerSettings{
+		Version:       protocolVersion,
+		Capabilities:  localCapabilities,
+		StreamWindow:  defaultStreamWindow,
+		MaxStreams:    64,
+		Ticket:        bytes.Repeat([]byte{7}, ticketSize),
+		ResumeTimeout: time.Minute,
+	}).Encode())
+	f.Add([]byte("v=2"))
+	f.Add([]byte("v=6\ncaps=goaway,max-streams\nmax-streams=65536\nstream-window=4096"))
+	f.Add([]byte("v=7\nticket=00\nresume-timeout=0"))
+	f.Add([]byte("v=x\nmax-streams=-1"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s, err := ParseServerSettings(b)
+		if err != nil {
+			return
+		}
+		if s.Version < 1 || s.StreamWindow < minStreamWindow || s.StreamWindow > maxStreamWindow || s.MaxStreams > maxMaxStreams {
+			t.Fatalf("invalid settings accepted: %+v", s)
+		}
+		if s.Ticket != nil && (len(s.Ticket) != ticketSize || s.ResumeTimeout <= 0 || s.ResumeTimeout > maxResumeTimeout) {
+			t.Fatalf("invalid ticket accepted: %+v", s)
+		}
+		encoded := s.Encode()
+		again, err := ParseServerSettings(encoded)
+		if err != nil {
+			t.Fatalf("encoded settings %q can not be parsed: %s", encoded, err)
+		}
+		if !reflect.DeepEqual(s, again) {
+			t.Fatalf("%+v encoded as %q is parsed as %+v", s, encoded, again)
+		}
+	})
+}
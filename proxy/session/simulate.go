@@ -0,0 +1,90 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// WritePattern returns the lengths of the writes of a session to its connection for a pattern
+// of comma separated items, for the padding simulator of cmd/padding:
+//
+//	open:ADDR    first write of a client, its cmdSettings with the cmdSYN and cmdPSH of the address of the first stream
+//	update       cmdUpdatePaddingScheme of the server, carrying the scheme p
+//	settings     cmdServerSettings of the server, with a ticket for resumption
+//	synack       cmdSYNACK of a stream, synack:ADDR reports the bound address
+//	N            N bytes of a stream in cmdPSH frames, with the suffixes k and m for KiB and MiB
+//	raw:N        a write of N bytes
+func WritePattern(pattern string, p *padding.PaddingFactory) ([]int, error) {
+	var sizes []int
+	for _, item := range strings.Split(pattern, ",") {
+		item = strings.TrimSpace(item)
+		name, arg, _ := strings.Cut(item, ":")
+		switch name {
+		case "open":
+			destination := M.ParseSocksaddr(arg)
+			if !destination.IsValid() {
+				return nil, fmt.Errorf("%s: invalid address", item)
+			}
+			settings := newLocalSettings(p.Md5).Encode()
+			sizes = append(sizes, 3*headerOverHeadSize+len(settings)+M.SocksaddrSerializer.AddrPortLen(destination))
+		case "update":
+			sizes = append(sizes, headerOverHeadSize+len(p.RawScheme))
+		case "settings":
+			settings := &ServerSettings{
+				Version:       protocolVersion,
+				Capabilities:  localCapabilities,
+				StreamWindow:  defaultStreamWindow,
+				Ticket:        make([]byte, ticketSize),
+				ResumeTimeout: time.Minute,
+			}
+			sizes = append(sizes, headerOverHeadSize+len(settings.Encode()))
+		case "synack":
+			size := headerOverHeadSize
+			if arg != "" {
+				bound := M.ParseSocksaddr(arg)
+				if !bound.IsValid() {
+					return nil, fmt.Errorf("%s: invalid address", item)
+				}
+				size += len(encodeSYNACK(CodeSuccess, "", bound))
+			}
+			sizes = append(sizes, size)
+		case "raw":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("%s: invalid length", item)
+			}
+			sizes = append(sizes, n)
+		default:
+			n, err := parseByteSize(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: unknown item", item)
+			}
+			for n > 0 {
+				chunk := min(n, maxFramePayloadSize)
+				sizes = append(sizes, headerOverHeadSize+chunk)
+				n -= chunk
+			}
+		}
+	}
+	return sizes, nil
+}
+
+// parseByteSize parses a positive number of bytes with an optional k or m suffix
+func parseByteSize(s string) (int, error) {
+	unit := 1
+	if v, ok := strings.CutSuffix(s, "k"); ok {
+		s, unit = v, 1<<10
+	} else if v, ok := strings.CutSuffix(s, "m"); ok {
+		s, unit = v, 1<<20
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
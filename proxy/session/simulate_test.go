@@ -0,0 +1,121 @@
+package session
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"anytls/proxy/padding"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// simulatedSizes returns the lengths of the writes to the connection simulated for a pattern
+func simulatedSizes(t *testing.T, p *padding.PaddingFactory, pattern string, first uint32) (sizes []int) {
+	t.Helper()
+	writes, err := WritePattern(pattern, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range padding.Simulate(p, writes, first) {
+		for _, step := range w.Writes {
+			if step.Delay == 0 {
+				sizes = append(sizes, step.Size())
+			}
+		}
+	}
+	return
+}
+
+// readSizes reads up to n writes of a session, a read of the pipe returns a whole write
+func readSizes(conn net.Conn, n int) (sizes []int) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1<<17)
+	for len(sizes) < n {
+		l, err := conn.Read(b)
+		if err != nil {
+			break
+		}
+		sizes = append(sizes, l)
+	}
+	return
+}
+
+// TestSimulateClient checks that Simulate predicts the writes of a client session
+func TestSimulateClient(t *testing.T) {
+	const pattern = "open:www.example.com:443,517,3k,100k,10,10,10,10"
+	scheme := padding.DefaultPaddingFactory()
+	want := simulatedSizes(t, scheme.WithSeed(3), pattern, 1)
+
+	conn, peer := net.Pipe()
+	client := NewClientSession(conn, padding.NewStorage(scheme.WithSeed(3)))
+	client.Run()
+	t.Cleanup(func() {
+		peer.Close()
+		client.Close()
+	})
+	got := make(chan []int, 1)
+	go func() {
+		got <- readSizes(peer, len(want))
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := M.SocksaddrSerializer.WriteAddrPort(stream, M.ParseSocksaddr("www.example.com:443")); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{517, 3 << 10, 100 << 10, 10, 10, 10, 10} {
+		if _, err := stream.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sizes := <-got; !slices.Equal(sizes, want) {
+		t.Fatalf("session wrote %v, simulated %v", sizes, want)
+	}
+}
+
+// TestSimulateServer checks that Simulate predicts the writes of a server session with the downstream section
+func TestSimulateServer(t *testing.T) {
+	const pattern = "settings,synack,3k,100k,10,10"
+	scheme := padding.DefaultPaddingFactory()
+	want := simulatedSizes(t, scheme.WithSeed(5).Down, pattern, 0)
+
+	conn, peer := net.Pipe()
+	streams := make(chan *Stream, 1)
+	server := NewServerSession(conn, func(stream *Stream) {
+		stream.HandshakeSuccess()
+		streams <- stream
+	}, padding.NewStorage(scheme.WithSeed(5)), &ServerConfig{
+		Resume:       NewResumeStore(time.Minute),
+		OnPacketConn: func(conn *PacketConn) {},
+	})
+	go server.Run()
+	t.Cleanup(func() {
+		peer.Close()
+		server.Close()
+	})
+	got := make(chan []int, 1)
+	go func() {
+		got <- readSizes(peer, len(want))
+	}()
+
+	settings := frameWithData(cmdSettings, 0, newLocalSettings(scheme.Md5).Encode())
+	go peer.Write(encodeFrames(settings, newFrame(cmdSYN, 1)))
+	var stream *Stream
+	select {
+	case stream = <-streams:
+	case <-time.After(time.Second):
+		t.Fatal("no stream opened")
+	}
+	for _, n := range []int{3 << 10, 100 << 10, 10, 10} {
+		if _, err := stream.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sizes := <-got; !slices.Equal(sizes, want) {
+		t.Fatalf("session wrote %v, simulated %v", sizes, want)
+	}
+}
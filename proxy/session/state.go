@@ -0,0 +1,253 @@
+package session
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ViolationKind classifies the frames which break the protocol
+type ViolationKind uint8
+
+const (
+	// ViolationUnexpectedCommand is a command the peer may not send in its role or with the negotiated capabilities
+	ViolationUnexpectedCommand ViolationKind = iota
+	// ViolationBeforeSettings is a stream command from a client before its cmdSettings
+	ViolationBeforeSettings
+	// ViolationDuplicateSettings is a second cmdSettings or cmdServerSettings
+	ViolationDuplicateSettings
+	// ViolationInvalidSettings is a cmdSettings or cmdServerSettings which can not be parsed
+	ViolationInvalidSettings
+	// ViolationInvalidStream is a stream id which was never opened, or opened twice
+	ViolationInvalidStream
+	// ViolationInvalidPayload is a payload of the wrong length for its command
+	ViolationInvalidPayload
+	// ViolationUnknownCommand is a command of a newer version, its payload is skipped and the session goes on
+	ViolationUnknownCommand
+	// ViolationFlowControl is stream data over the window granted to the peer
+	ViolationFlowControl
+
+	violationKindCount
+)
+
+var violationNames = [violationKindCount]string{
+	ViolationUnexpectedCommand: "unexpected-command",
+	ViolationBeforeSettings:    "before-settings",
+	ViolationDuplicateSettings: "duplicate-settings",
+	ViolationInvalidSettings:   "invalid-settings",
+	ViolationInvalidStream:     "invalid-stream",
+	ViolationInvalidPayload:    "invalid-payload",
+	ViolationUnknownCommand:    "unknown-command",
+	ViolationFlowControl:       "flow-control",
+}
+
+func (k ViolationKind) String() string {
+	if k < violationKindCount {
+		return violationNames[k]
+	}
+	return "unknown"
+}
+
+var violationCounters [violationKindCount]atomic.Uint64
+
+// ViolationCounts returns the violations detected by all sessions of the process, by kind
+func ViolationCounts() map[string]uint64 {
+	counts := make(map[string]uint64, violationKindCount)
+	for k := range violationCounters {
+		counts[ViolationKind(k).String()] = violationCounters[k].Load()
+	}
+	return counts
+}
+
+// protocolViolation closes the session after cmdAlert reports it to the peer
+type protocolViolation struct {
+	kind   ViolationKind
+	reason string
+}
+
+func (v *protocolViolation) Error() string {
+	return "protocol violation (" + v.kind.String() + "): " + v.reason
+}
+
+func newViolation(kind ViolationKind, format string, args ...any) *protocolViolation {
+	return &protocolViolation{kind: kind, reason: fmt.Sprintf(format, args...)}
+}
+
+// roles of the sender of a command
+const (
+	fromClient = 1 << iota
+	fromServer
+	fromBoth = fromClient | fromServer
+)
+
+type payloadRule uint8
+
+const (
+	payloadAny payloadRule = iota
+	payloadNone
+	payloadUint32
+)
+
+type streamRule uint8
+
+const (
+	// the id is not a stream, or not checked
+	streamAny streamRule = iota
+	// the peer opens a stream, ids of a side increase
+	streamNew
+	// a stream opened before by either side, it may have been closed since
+	streamKnown
+	// a stream opened before by this side
+	streamLocal
+)
+
+// frameRule is what a session accepts for a command
+type frameRule struct {
+	from    uint8
+	payload payloadRule
+	stream  streamRule
+	// servers accept the command only after cmdSettings
+	afterSettings bool
+	// the command is only sent between peers with these features
+	caps Capabilities
+	// stream frames are counted, and sent again after the session is resumed
+	replay bool
+}
+
+var frameRules = [...]frameRule{
+	cmdWaste:               {from: fromBoth},
+	cmdSYN:                 {from: fromBoth, payload: payloadNone, stream: streamNew, afterSettings: true, replay: true},
+	cmdPSH:                 {from: fromBoth, stream: streamKnown, afterSettings: true, replay: true},
+	cmdFIN:                 {from: fromBoth, payload: payloadNone, stream: streamKnown, afterSettings: true, replay: true},
+	cmdSettings:            {from: fromClient},
+	cmdAlert:               {from: fromBoth},
+	cmdUpdatePaddingScheme: {from: fromServer},
+	cmdSYNACK:              {from: fromBoth, stream: streamLocal, afterSettings: true, replay: true},
+	cmdHeartRequest:        {from: fromBoth, payload: payloadNone},
+	cmdHeartResponse:       {from: fromBoth, payload: payloadNone},
+	cmdServerSettings:      {from: fromServer},
+	cmdWindowUpdate:        {from: fromBoth, payload: payloadUint32, stream: streamKnown, afterSettings: true, replay: true},
+	cmdCloseWrite:          {from: fromBoth, payload: payloadNone, stream: streamKnown, afterSettings: true, replay: true},
+	cmdGoAway:              {from: fromServer, payload: payloadNone, replay: true},
+	cmdBind:                {from: fromClient, afterSettings: true, replay: true},
+	cmdBindAck:             {from: fromServer, replay: true},
+	cmdDatagram:            {from: fromBoth, afterSettings: true, caps: CapDatagram},
+	cmdDatagramClose:       {from: fromBoth, payload: payloadNone, afterSettings: true, caps: CapDatagram},
+	cmdAck:                 {from: fromBoth, payload: payloadUint32, afterSettings: true, caps: CapResume},
+	cmdResume:              {from: fromClient},
+}
+
+// replayed reports whether a command is a stream frame, kept for resumption
+func replayed(cmd byte) bool {
+	return int(cmd) < len(frameRules) && frameRules[cmd].replay
+}
+
+// recvState is the protocol state of the receiving side of a session, only used by recvLoop
+type recvState struct {
+	// cmdSettings received by a server, or cmdServerSettings received by a client
+	settings bool
+	// the last stream opened by the peer
+	lastPeerStream uint32
+	// bytes of stream frames received since the last cmdAck
+	unacked int
+}
+
+// isLocalStream reports whether this side opened the stream id: clients open odd ids,
+// servers open even ids, and only to clients with CapReverse, which open odd ids
+func (s *Session) isLocalStream(sid uint32) bool {
+	if s.isClient {
+		return sid%2 == 1
+	}
+	return sid%2 == 0 && s.has(CapReverse)
+}
+
+// checkFrame validates a received frame header against the role and the state of the session.
+// Unknown commands are reported with ViolationUnknownCommand, the caller skips them.
+func (s *Session) checkFrame(state *recvState, hdr rawHeader) *protocolViolation {
+	cmd := hdr.Cmd()
+	if int(cmd) >= len(frameRules) {
+		return newViolation(ViolationUnknownCommand, "unknown command %d", cmd)
+	}
+	rule := frameRules[cmd]
+
+	var from uint8 = fromClient
+	if s.isClient {
+		from = fromServer
+	}
+	if rule.from&from == 0 {
+		return newViolation(ViolationUnexpectedCommand, "command %d from the wrong side", cmd)
+	}
+	if cmd == cmdSYN && s.isClient && !s.has(CapReverse) {
+		return newViolation(ViolationUnexpectedCommand, "stream %d opened without reverse tunnels", hdr.StreamID())
+	}
+	if cmd == cmdDatagramClose && s.isClient && !s.has(CapDatagramClose) {
+		return newViolation(ViolationUnexpectedCommand, "command %d from the wrong side", cmd)
+	}
+
+	switch {
+	case rule.afterSettings && !s.isClient && !state.settings:
+		return newViolation(ViolationBeforeSettings, "command %d before the settings", cmd)
+	case cmd == cmdSettings && !s.isClient || cmd == cmdServerSettings && s.isClient:
+		if state.settings {
+			return newViolation(ViolationDuplicateSettings, "settings received twice")
+		}
+	}
+	if rule.caps != 0 && !s.has(rule.caps) {
+		return newViolation(ViolationUnexpectedCommand, "command %d without %s", cmd, rule.caps)
+	}
+
+	switch length := hdr.Length(); rule.payload {
+	case payloadNone:
+		if length != 0 {
+			return newViolation(ViolationInvalidPayload, "command %d with %d bytes of data", cmd, length)
+		}
+	case payloadUint32:
+		if length != 4 {
+			return newViolation(ViolationInvalidPayload, "command %d with %d bytes of data", cmd, length)
+		}
+	}
+
+	sid := hdr.StreamID()
+	switch rule.stream {
+	case streamNew:
+		if sid == 0 || s.isLocalStream(sid) || sid <= state.lastPeerStream {
+			return newViolation(ViolationInvalidStream, "stream %d can not be opened", sid)
+		}
+	case streamKnown:
+		if !s.knownStream(state, sid) {
+			return newViolation(ViolationInvalidStream, "command %d for stream %d which was never opened", cmd, sid)
+		}
+	case streamLocal:
+		if !s.isLocalStream(sid) || !s.knownStream(state, sid) {
+			return newViolation(ViolationInvalidStream, "command %d for stream %d which was not opened by this side", cmd, sid)
+		}
+	}
+	return nil
+}
+
+// knownStream reports whether the stream id has been opened by either side
+func (s *Session) knownStream(state *recvState, sid uint32) bool {
+	if sid == 0 {
+		return false
+	}
+	if s.isLocalStream(sid) {
+		return sid <= s.streamId.Load()
+	}
+	return sid <= state.lastPeerStream
+}
+
+// violation counts a violation and reports it to the peer with cmdAlert.
+// Only unknown commands let the session go on, it returns nil for them.
+func (s *Session) violation(v *protocolViolation) error {
+	violationCounters[v.kind].Add(1)
+	if v.kind == ViolationUnknownCommand {
+		logrus.Debugln("[Session]", v, s.currentConn().RemoteAddr())
+		return nil
+	}
+	logrus.Warnln("[Session]", v, s.currentConn().RemoteAddr())
+	f := newFrame(cmdAlert, 0)
+	f.data = []byte(v.Error())
+	s.writeFrameWait(f)
+	return v
+}
@@ -0,0 +1,179 @@
+package session
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"anytls/proxy/padding"
+)
+
+func testHeader(cmd byte, sid uint32, length int) rawHeader {
+	var hdr rawHeader
+	f := newFrame(cmd, sid)
+	f.data = make([]byte, length)
+	f.encodeHeader(hdr[:])
+	return hdr
+}
+
+func frameWithData(cmd byte, sid uint32, data []byte) frame {
+	f := newFrame(cmd, sid)
+	f.data = data
+	return f
+}
+
+// encodeFrames returns the frames as they are sent on the connection
+func encodeFrames(fs ...frame) []byte {
+	var b []byte
+	for _, f := range fs {
+		hdr := make([]byte, headerOverHeadSize)
+		f.encodeHeader(hdr)
+		b = append(append(b, hdr...), f.data...)
+	}
+	return b
+}
+
+// testSession returns a session which has negotiated caps and opened localStreams streams
+func testSession(isClient bool, caps Capabilities, localStreams uint32) *Session {
+	s := &Session{isClient: isClient}
+	s.peer.Store(&negotiated{version: protocolVersion, caps: caps, streamWindow: defaultStreamWindow})
+	s.streamId.Store(localStreams)
+	return s
+}
+
+func TestCheckFrame(t *testing.T) {
+	const ok = ViolationKind(255)
+	settled := recvState{settings: true}
+	opened := recvState{settings: true, lastPeerStream: 3}
+	tests := []struct {
+		name     string
+		isClient bool
+		caps     Capabilities
+		local    uint32
+		state    recvState
+		hdr      rawHeader
+		want     ViolationKind
+	}{
+		{"settings", false, 0, 0, recvState{}, testHeader(cmdSettings, 0, 10), ok},
+		{"settings twice", false, 0, 0, settled, testHeader(cmdSettings, 0, 10), ViolationDuplicateSettings},
+		{"server settings twice", true, 0, 0, settled, testHeader(cmdServerSettings, 0, 10), ViolationDuplicateSettings},
+		{"settings from server", true, 0, 0, recvState{}, testHeader(cmdSettings, 0, 10), ViolationUnexpectedCommand},
+		{"server settings from client", false, 0, 0, settled, testHeader(cmdServerSettings, 0, 10), ViolationUnexpectedCommand},
+		{"syn before settings", false, 0, 0, recvState{}, testHeader(cmdSYN, 1, 0), ViolationBeforeSettings},
+		{"waste before settings", false, 0, 0, recvState{}, testHeader(cmdWaste, 0, 30), ok},
+		{"syn", false, 0, 0, settled, testHeader(cmdSYN, 1, 0), ok},
+		{"syn with data", false, 0, 0, settled, testHeader(cmdSYN, 1, 1), ViolationInvalidPayload},
+		{"syn stream 0", false, 0, 0, settled, testHeader(cmdSYN, 0, 0), ViolationInvalidStream},
+		{"syn reused", false, 0, 0, opened, testHeader(cmdSYN, 3, 0), ViolationInvalidStream},
+		{"syn lower", false, 0, 0, opened, testHeader(cmdSYN, 1, 0), ViolationInvalidStream},
+		{"syn even without reverse", false, 0, 0, settled, testHeader(cmdSYN, 2, 0), ok},
+		{"syn even with reverse", false, CapReverse, 0, settled, testHeader(cmdSYN, 2, 0), ViolationInvalidStream},
+		{"syn to client", true, 0, 1, settled, testHeader(cmdSYN, 2, 0), ViolationUnexpectedCommand},
+		{"reverse syn to client", true, CapReverse, 1, settled, testHeader(cmdSYN, 2, 0), ok},
+		{"psh", false, 0, 0, opened, testHeader(cmdPSH, 3, 100), ok},
+		{"psh never opened", false, 0, 0, opened, testHeader(cmdPSH, 5, 100), ViolationInvalidStream},
+		{"psh stream 0", false, 0, 0, opened, testHeader(cmdPSH, 0, 100), ViolationInvalidStream},
+		{"fin with data", false, 0, 0, opened, testHeader(cmdFIN, 3, 2), ViolationInvalidPayload},
+		{"synack of a local stream", true, 0, 3, settled, testHeader(cmdSYNACK, 3, 0), ok},
+		{"synack of a stream not opened", true, 0, 3, settled, testHeader(cmdSYNACK, 5, 0), ViolationInvalidStream},
+		{"synack of a peer stream", false, CapReverse, 0, opened, testHeader(cmdSYNACK, 3, 0), ViolationInvalidStream},
+		{"window update", false, CapFlowControl, 0, opened, testHeader(cmdWindowUpdate, 3, 4), ok},
+		{"short window update", false, CapFlowControl, 0, opened, testHeader(cmdWindowUpdate, 3, 2), ViolationInvalidPayload},
+		{"heartbeat with data", false, 0, 0, settled, testHeader(cmdHeartRequest, 0, 1), ViolationInvalidPayload},
+		{"goaway", true, CapGoAway, 0, settled, testHeader(cmdGoAway, 0, 0), ok},
+		{"goaway from client", false, CapGoAway, 0, settled, testHeader(cmdGoAway, 0, 0), ViolationUnexpectedCommand},
+		{"padding scheme from client", false, 0, 0, settled, testHeader(cmdUpdatePaddingScheme, 0, 10), ViolationUnexpectedCommand},
+		{"bind", false, CapReverse, 0, settled, testHeader(cmdBind, 1, 10), ok},
+		{"bind from server", true, CapReverse, 0, settled, testHeader(cmdBind, 1, 10), ViolationUnexpectedCommand},
+		{"datagram", false, CapDatagram, 0, settled, testHeader(cmdDatagram, 1, 10), ok},
+		{"datagram without caps", false, 0, 0, settled, testHeader(cmdDatagram, 1, 10), ViolationUnexpectedCommand},
+		{"datagram before settings", false, CapDatagram, 0, recvState{}, testHeader(cmdDatagram, 1, 10), ViolationBeforeSettings},
+		{"datagram close", false, CapDatagram, 0, settled, testHeader(cmdDatagramClose, 1, 0), ok},
+		{"datagram close with data", false, CapDatagram, 0, settled, testHeader(cmdDatagramClose, 1, 1), ViolationInvalidPayload},
+		{"datagram close to client", true, CapDatagram, 0, settled, testHeader(cmdDatagramClose, 1, 0), ViolationUnexpectedCommand},
+		{"datagram reject to client", true, CapDatagram | CapDatagramClose, 0, settled, testHeader(cmdDatagramClose, 1, 0), ok},
+		{"ack", true, CapResume, 0, settled, testHeader(cmdAck, 0, 4), ok},
+		{"ack without caps", true, 0, 0, settled, testHeader(cmdAck, 0, 4), ViolationUnexpectedCommand},
+		{"long ack", true, CapResume, 0, settled, testHeader(cmdAck, 0, 5), ViolationInvalidPayload},
+		{"resume from server", true, CapResume, 0, settled, testHeader(cmdResume, 0, 20), ViolationUnexpectedCommand},
+		{"unknown command", false, 0, 0, settled, testHeader(200, 0, 10), ViolationUnknownCommand},
+		{"first unknown command", false, 0, 0, settled, testHeader(byte(len(frameRules)), 0, 0), ViolationUnknownCommand},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSession(tt.isClient, tt.caps, tt.local)
+			state := tt.state
+			v := s.checkFrame(&state, tt.hdr)
+			switch {
+			case tt.want == ok && v != nil:
+				t.Fatalf("unexpected %v", v)
+			case tt.want != ok && v == nil:
+				t.Fatalf("no violation, want %s", tt.want)
+			case tt.want != ok && v.kind != tt.want:
+				t.Fatalf("%v, want %s", v, tt.want)
+			}
+		})
+	}
+}
+
+// FuzzRecvFrames feeds the bytes to the receive loop of a server or a client session,
+// which must neither panic nor hang whatever it receives
+func FuzzRecvFrames(f *testing.F) {
+	settings := frameWithData(cmdSettings, 0, newLocalSettings(padding.DefaultPaddingFactory().Md5).Encode())
+	serverSettings := frameWithData(cmdServerSettings, 0, (&ServerSettings{
+		Version:      protocolVersion,
+		Capabilities: localCapabilities,
+		StreamWindow: defaultStreamWindow,
+		MaxStreams:   4,
+	}).Encode())
+	f.Add(false, encodeFrames(settings, newFrame(cmdSYN, 1), frameWithData(cmdPSH, 1, []byte("hello")), newFrame(cmdFIN, 1)))
+	f.Add(false, encodeFrames(frameWithData(cmdSettings, 0, []byte("v=1")), newFrame(cmdSYN, 1), frameWithData(cmdPSH, 1, make([]byte, 100))))
+	f.Add(false, encodeFrames(settings, newFrame(cmdSYN, 1), frameWithData(cmdWindowUpdate, 1, []byte{0, 1, 0, 0}), newFrame(cmdCloseWrite, 1)))
+	f.Add(false, encodeFrames(settings, frameWithData(cmdDatagram, 1, []byte{1, 127, 0, 0, 1, 0, 53, 'x'}), newFrame(cmdDatagramClose, 1)))
+	f.Add(false, encodeFrames(settings, frameWithData(cmdBind, 1, []byte{1, 127, 0, 0, 1, 0, 80}), newFrame(cmdHeartRequest, 0)))
+	f.Add(false, encodeFrames(settings, frameWithData(cmdAck, 0, []byte{0, 0, 0, 1}), frameWithData(200, 0, []byte("newer"))))
+	f.Add(false, encodeFrames(newFrame(cmdSYN, 1), settings, settings))
+	f.Add(true, encodeFrames(serverSettings, frameWithData(cmdUpdatePaddingScheme, 0, []byte("stop=1\n0=10")), newFrame(cmdGoAway, 0)))
+	f.Add(true, encodeFrames(serverSettings, newFrame(cmdSYN, 2), frameWithData(cmdWindowUpdate, 2, []byte{0, 0, 4, 0}), frameWithData(cmdPSH, 2, []byte("x"))))
+	f.Add(true, encodeFrames(serverSettings, frameWithData(cmdBindAck, 1, nil), newFrame(cmdDatagramClose, 1), frameWithData(cmdAlert, 0, []byte("bye"))))
+
+	resume := NewResumeStore(time.Minute)
+	f.Fuzz(func(t *testing.T, isClient bool, data []byte) {
+		conn, peer := net.Pipe()
+		var s *Session
+		if isClient {
+			s = NewClientSession(conn, padding.NewStorage(nil))
+		} else {
+			s = NewServerSession(conn, func(stream *Stream) {
+				io.Copy(io.Discard, stream)
+				stream.Close()
+			}, padding.NewStorage(nil), &ServerConfig{
+				MaxStreams: 4,
+				Resume:     resume,
+				OnPacketConn: func(conn *PacketConn) {
+					conn.Close()
+				},
+			})
+		}
+		go io.Copy(io.Discard, peer)
+		go func() {
+			peer.Write(data)
+			peer.Close()
+		}()
+		go s.sendLoop()
+
+		// recvFrames is called without recvLoop, which would recover the panics
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.recvFrames(&recvState{})
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the session did not stop at the end of its input")
+		}
+		s.Close()
+	})
+}
@@ -2,11 +2,17 @@ package session
 
 import (
 	"anytls/proxy/pipe"
+	"context"
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"os"
 	"sync"
 	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+	M "github.com/sagernet/sing/common/metadata"
 )
 
 // Stream implements net.Conn
@@ -15,15 +21,42 @@ type Stream struct {
 
 	sess *Session
 
-	pipeR         *pipe.PipeReader
-	pipeW         *pipe.PipeWriter
+	pipe          *pipe.BufferedPipe
 	writeDeadline pipe.PipeDeadline
 
+	// send scheduling
+	writeLock sync.Mutex
+	writeDone chan error
+	priority  atomic.Uint32
+
+	// flow control
+	sendWindow       int64
+	sendWindowLock   sync.Mutex
+	sendWindowNotify chan struct{}
+	recvConsumed     atomic.Uint32
+	// recvWindow is the window granted to the peer and not used yet
+	recvWindow atomic.Int64
+	// the window is held back until the memory budget has room again
+	windowHeld atomic.Bool
+
+	// half close
+	closeWriteOnce    sync.Once
+	writeClosed       atomic.Bool
+	remoteWriteClosed atomic.Bool
+	readClosed        atomic.Bool
+
+	die     chan struct{}
 	dieOnce sync.Once
 	dieHook func()
 	dieErr  error
 
 	reportOnce sync.Once
+
+	// outbound result reported by the server
+	synack     chan struct{}
+	synackErr  error
+	synackOnce sync.Once
+	bound      M.Socksaddr
 }
 
 // newStream initiates a Stream struct
@@ -31,33 +64,256 @@ func newStream(id uint32, sess *Session) *Stream {
 	s := new(Stream)
 	s.id = id
 	s.sess = sess
-	s.pipeR, s.pipeW = pipe.Pipe()
+	s.pipe = pipe.NewBufferedPipe()
+	if sess.memory != nil {
+		s.pipe.OnRelease(func(n int) {
+			sess.memory.release(memoryReceive, n)
+		})
+	}
 	s.writeDeadline = pipe.MakePipeDeadline()
+	s.writeDone = make(chan error, maxQueuedFrames)
+	s.priority.Store(uint32(PriorityNormal))
+	s.sendWindow = int64(sess.negotiated().streamWindow)
+	s.sendWindowNotify = make(chan struct{}, 1)
+	s.recvWindow.Store(defaultStreamWindow)
+	s.die = make(chan struct{})
+	s.synack = make(chan struct{})
 	return s
 }
 
 // Read implements net.Conn
 func (s *Stream) Read(b []byte) (n int, err error) {
-	n, err = s.pipeR.Read(b)
+	n, err = s.pipe.Read(b)
+	if n > 0 {
+		s.consumeRecvWindow(n)
+	}
 	if n == 0 && s.dieErr != nil {
 		err = s.dieErr
 	}
 	return
 }
 
-// Write implements net.Conn
+// maxQueuedFrames limits the frames of one stream waiting in the send scheduler
+const maxQueuedFrames = 8
+
+// Write implements net.Conn.
+// The frames are queued to the session scheduler without copying b,
+// so Write returns only after all of them have been sent.
 func (s *Stream) Write(b []byte) (n int, err error) {
 	select {
 	case <-s.writeDeadline.Wait():
 		return 0, os.ErrDeadlineExceeded
 	default:
 	}
-	f := newFrame(cmdPSH, s.id)
-	f.data = b
-	n, err = s.sess.writeFrame(f)
+	if s.writeClosed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	// lengths of the queued frames, in the order they are reported
+	var queued [maxQueuedFrames]int
+	var head, count int
+	waitOne := func() {
+		if e := <-s.writeDone; e != nil {
+			if err == nil {
+				err = e
+			}
+		} else {
+			n += queued[head]
+		}
+		head = (head + 1) % maxQueuedFrames
+		count--
+	}
+
+	for len(b) > 0 && err == nil {
+		// over the memory budget, the frames are sent one at a time
+		if count == maxQueuedFrames || count > 0 && s.sess.memory.exhausted() {
+			waitOne()
+			continue
+		}
+		var l int
+		l, err = s.takeSendWindow(min(len(b), maxFramePayloadSize))
+		if err != nil {
+			break
+		}
+		f := newFrame(cmdPSH, s.id)
+		f.data = b[:l]
+		req := newWriteRequest(f, s.writeDone)
+		if err = s.sess.sched.pushStream(s.id, s.Priority(), req); err != nil {
+			req.release()
+			break
+		}
+		queued[(head+count)%maxQueuedFrames] = l
+		count++
+		b = b[l:]
+	}
+	for count > 0 {
+		waitOne()
+	}
 	return
 }
 
+// SetPriority sets the scheduling class of the data written to the stream,
+// the frames already queued are moved to the new class.
+func (s *Stream) SetPriority(priority Priority) {
+	if priority >= priorityCount {
+		priority = priorityCount - 1
+	}
+	s.priority.Store(uint32(priority))
+	s.sess.sched.setPriority(s.id, priority)
+}
+
+// Priority returns the scheduling class of the stream, PriorityNormal by default
+func (s *Stream) Priority() Priority {
+	return Priority(s.priority.Load())
+}
+
+// takeSendWindow reserves up to want bytes of the peer's receive window.
+// It blocks while the window is exhausted, unless the peer does not support flow control.
+// Until the server settings arrive, clients keep to the default window, the server may enforce it.
+func (s *Stream) takeSendWindow(want int) (int, error) {
+	for {
+		s.sendWindowLock.Lock()
+		pending := s.sess.settingsPending()
+		if !pending && !s.sess.has(CapFlowControl) {
+			// keep counting, the window applies again if the session is resumed
+			s.sendWindow -= int64(want)
+			s.sendWindowLock.Unlock()
+			return want, nil
+		}
+		if s.sendWindow > 0 {
+			n := int(min(int64(want), s.sendWindow))
+			s.sendWindow -= int64(n)
+			s.sendWindowLock.Unlock()
+			return n, nil
+		}
+		s.sendWindowLock.Unlock()
+
+		var settingsDone <-chan struct{}
+		var settingsTimeout <-chan time.Time
+		if pending {
+			settingsDone = s.sess.serverSettingsDone
+			timer := time.NewTimer(serverSettingsTimeout)
+			defer timer.Stop()
+			settingsTimeout = timer.C
+		}
+		select {
+		case <-s.sendWindowNotify:
+		case <-settingsDone:
+		case <-settingsTimeout:
+			// version 1 server
+			s.sess.settingsTimedOut()
+		case <-s.die:
+			return 0, io.ErrClosedPipe
+		case <-s.writeDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// addSendWindow is called when the peer grants more window to this stream
+func (s *Stream) addSendWindow(delta int64) {
+	s.sendWindowLock.Lock()
+	s.sendWindow += delta
+	s.sendWindowLock.Unlock()
+	select {
+	case s.sendWindowNotify <- struct{}{}:
+	default:
+	}
+}
+
+// consumeRecvWindow returns the window of data read by the application back to the peer
+func (s *Stream) consumeRecvWindow(n int) {
+	if !s.sess.has(CapFlowControl) {
+		return
+	}
+	consumed := s.recvConsumed.Add(uint32(n))
+	if consumed < defaultStreamWindow/2 {
+		return
+	}
+	if s.sess.memory.exhausted() {
+		// the peer stops sending to this stream when its window is used up,
+		// the other streams and the control frames of the session go on
+		if s.windowHeld.CompareAndSwap(false, true) {
+			go s.grantHeldWindow()
+		}
+		return
+	}
+	if s.recvConsumed.CompareAndSwap(consumed, 0) {
+		s.sendWindowUpdate(consumed)
+	}
+}
+
+// grantHeldWindow returns the window held back by consumeRecvWindow once the memory budget has room
+func (s *Stream) grantHeldWindow() {
+	s.sess.memory.wait(s.die)
+	s.windowHeld.Store(false)
+	select {
+	case <-s.die:
+		return
+	default:
+	}
+	if consumed := s.recvConsumed.Swap(0); consumed > 0 {
+		s.sendWindowUpdate(consumed)
+	}
+}
+
+// sendWindowUpdate grants more window to the peer, it is counted before the peer can use it
+func (s *Stream) sendWindowUpdate(increment uint32) {
+	s.recvWindow.Add(int64(increment))
+	f := newFrame(cmdWindowUpdate, s.id)
+	f.data = binary.BigEndian.AppendUint32(nil, increment)
+	s.sess.writeFrame(f)
+}
+
+// CloseWrite implements N.WriteCloser, it tells the peer that no more data will be written,
+// while data from the peer can still be read.
+// If the peer does not support half close, the stream is closed.
+func (s *Stream) CloseWrite() error {
+	if !s.sess.has(CapHalfClose) {
+		return s.Close()
+	}
+	var once bool
+	s.closeWriteOnce.Do(func() {
+		once = true
+	})
+	if !once {
+		return nil
+	}
+	s.writeClosed.Store(true)
+	_, err := s.sess.writeFrame(newFrame(cmdCloseWrite, s.id))
+	s.checkFullyClosed()
+	return err
+}
+
+// CloseRead implements N.ReadCloser, it discards all data received from now on.
+// Like TCP, the peer is not notified.
+func (s *Stream) CloseRead() error {
+	s.readClosed.Store(true)
+	s.pipe.Close()
+	if s.writeClosed.Load() {
+		return s.Close()
+	}
+	return nil
+}
+
+// remoteCloseWrite is called when the peer will not write to the stream anymore
+func (s *Stream) remoteCloseWrite() {
+	s.remoteWriteClosed.Store(true)
+	s.pipe.CloseWrite(io.EOF)
+	s.checkFullyClosed()
+}
+
+// checkFullyClosed releases the stream after both directions have been half closed,
+// without dropping the data not read yet
+func (s *Stream) checkFullyClosed() {
+	if s.writeClosed.Load() && s.remoteWriteClosed.Load() {
+		s.closeRemote()
+	}
+}
+
 // Close implements net.Conn
 func (s *Stream) Close() error {
 	return s.CloseWithError(io.ErrClosedPipe)
@@ -67,25 +323,42 @@ func (s *Stream) CloseWithError(err error) error {
 	// if err != io.ErrClosedPipe {
 	// 	logrus.Debugln(err)
 	// }
+	return s.closeWithError(err, true)
+}
+
+// closeRemote is called when the peer closed the stream,
+// the data already received can still be read before EOF
+func (s *Stream) closeRemote() error {
+	return s.closeWithError(io.EOF, false)
+}
+
+func (s *Stream) closeWithError(err error, dropReceived bool) error {
 	var once bool
 	s.dieOnce.Do(func() {
 		s.dieErr = err
-		s.pipeR.Close()
+		if dropReceived {
+			s.pipe.Close()
+		} else {
+			s.pipe.CloseWrite(err)
+		}
+		close(s.die)
 		once = true
 	})
 	if once {
+		err := s.sess.streamClosed(s.id)
+		// the hook sees the session without this stream
 		if s.dieHook != nil {
 			s.dieHook()
 			s.dieHook = nil
 		}
-		return s.sess.streamClosed(s.id)
+		return err
 	} else {
 		return s.dieErr
 	}
 }
 
 func (s *Stream) SetReadDeadline(t time.Time) error {
-	return s.pipeR.SetReadDeadline(t)
+	return s.pipe.SetReadDeadline(t)
 }
 
 func (s *Stream) SetWriteDeadline(t time.Time) error {
@@ -100,7 +373,7 @@ func (s *Stream) SetDeadline(t time.Time) error {
 
 // LocalAddr satisfies net.Conn interface
 func (s *Stream) LocalAddr() net.Addr {
-	if ts, ok := s.sess.conn.(interface {
+	if ts, ok := s.sess.currentConn().(interface {
 		LocalAddr() net.Addr
 	}); ok {
 		return ts.LocalAddr()
@@ -110,7 +383,7 @@ func (s *Stream) LocalAddr() net.Addr {
 
 // RemoteAddr satisfies net.Conn interface
 func (s *Stream) RemoteAddr() net.Addr {
-	if ts, ok := s.sess.conn.(interface {
+	if ts, ok := s.sess.currentConn().(interface {
 		RemoteAddr() net.Addr
 	}); ok {
 		return ts.RemoteAddr()
@@ -118,15 +391,89 @@ func (s *Stream) RemoteAddr() net.Addr {
 	return nil
 }
 
+// synackReceived records the outbound result reported by the server in cmdSYNACK
+func (s *Stream) synackReceived(err error, bound M.Socksaddr) {
+	s.synackOnce.Do(func() {
+		s.synackErr = err
+		s.bound = bound
+		close(s.synack)
+	})
+}
+
+// BoundAddr returns the local address of the outbound connection of the server,
+// if it was reported in cmdSYNACK
+func (s *Stream) BoundAddr() M.Socksaddr {
+	select {
+	case <-s.synack:
+		return s.bound
+	default:
+		return M.Socksaddr{}
+	}
+}
+
+// waitSYNACK waits until the server reports the outbound result of a client stream,
+// and returns the remote error. Servers which do not send cmdSYNACK report nothing,
+// the capabilities of a new session are known once cmdServerSettings arrives.
+func (s *Stream) waitSYNACK(ctx context.Context) error {
+	if !s.sess.has(CapSYNACK) {
+		timer := time.NewTimer(serverSettingsTimeout)
+		defer timer.Stop()
+		select {
+		case <-s.sess.serverSettingsDone:
+		case <-timer.C:
+			// version 1 server
+			s.sess.settingsTimedOut()
+			return nil
+		case <-s.die:
+			return s.synackResult()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !s.sess.has(CapSYNACK) {
+			return nil
+		}
+	}
+	select {
+	case <-s.synack:
+		return s.synackErr
+	case <-s.die:
+		return s.synackResult()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// synackResult returns the remote error of a closed stream
+func (s *Stream) synackResult() error {
+	select {
+	case <-s.synack:
+		if s.synackErr != nil {
+			return s.synackErr
+		}
+	default:
+	}
+	return io.ErrClosedPipe
+}
+
 // HandshakeFailure should be called when Server fail to create outbound proxy
 func (s *Stream) HandshakeFailure(err error) error {
 	var once bool
 	s.reportOnce.Do(func() {
 		once = true
 	})
-	if once && err != nil && s.sess.peerVersion >= 2 {
+	if once && err != nil && s.sess.has(CapSYNACK) {
 		f := newFrame(cmdSYNACK, s.id)
-		f.data = []byte(err.Error())
+		message := err.Error()
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) {
+			// relayed from another peer
+			message = remoteErr.Message
+		}
+		if s.sess.has(CapSYNACKCode) {
+			f.data = encodeSYNACK(errorCode(err), message, M.Socksaddr{})
+		} else {
+			f.data = []byte(message)
+		}
 		if _, err := s.sess.writeFrame(f); err != nil {
 			return err
 		}
@@ -136,12 +483,22 @@ func (s *Stream) HandshakeFailure(err error) error {
 
 // HandshakeSuccess should be called when Server success to create outbound proxy
 func (s *Stream) HandshakeSuccess() error {
+	return s.HandshakeSuccessBound(M.Socksaddr{})
+}
+
+// HandshakeSuccessBound is HandshakeSuccess reporting the local address of the outbound connection,
+// which is only sent to peers with CapSYNACKCode
+func (s *Stream) HandshakeSuccessBound(bound M.Socksaddr) error {
 	var once bool
 	s.reportOnce.Do(func() {
 		once = true
 	})
-	if once && s.sess.peerVersion >= 2 {
-		if _, err := s.sess.writeFrame(newFrame(cmdSYNACK, s.id)); err != nil {
+	if once && s.sess.has(CapSYNACK) {
+		f := newFrame(cmdSYNACK, s.id)
+		if bound.IsValid() && s.sess.has(CapSYNACKCode) {
+			f.data = encodeSYNACK(CodeSuccess, "", bound)
+		}
+		if _, err := s.sess.writeFrame(f); err != nil {
 			return err
 		}
 	}
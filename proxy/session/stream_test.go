@@ -0,0 +1,316 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"anytls/proxy/padding"
+)
+
+// TestStreamWindow checks that a writer blocks when the window of the peer is used up,
+// and goes on when the reader returns the window with cmdWindowUpdate
+func TestStreamWindow(t *testing.T) {
+	client, _, streams := testPair(t, nil)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), defaultStreamWindow*3/16)
+	written := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(data)
+		written <- err
+	}()
+	peer := acceptStream(t, streams)
+
+	select {
+	case err := <-written:
+		t.Fatalf("write of %d bytes returned without window: %v", len(data), err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stream.sendWindowLock.Lock()
+	window := stream.sendWindow
+	stream.sendWindowLock.Unlock()
+	if window != 0 {
+		t.Fatalf("send window %d, want 0", window)
+	}
+	if buffered := peer.pipe.Buffered(); buffered != defaultStreamWindow {
+		t.Fatalf("%d bytes buffered by the peer, want %d", buffered, defaultStreamWindow)
+	}
+
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(peer, received); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("data corrupted")
+	}
+}
+
+// TestStreamWindowViolation checks that data over the window closes the session
+func TestStreamWindowViolation(t *testing.T) {
+	server, peer := rawServer(t, nil)
+	settings := frameWithData(cmdSettings, 0, newLocalSettings(padding.DefaultPaddingFactory().Md5).Encode())
+	frames := []frame{settings, newFrame(cmdSYN, 1)}
+	for sent := 0; sent <= defaultStreamWindow; sent += maxFramePayloadSize {
+		frames = append(frames, frameWithData(cmdPSH, 1, make([]byte, maxFramePayloadSize)))
+	}
+	go peer.Write(encodeFrames(frames...))
+
+	if alert := readAlert(t, peer); !strings.Contains(alert, "flow-control") {
+		t.Fatalf("alert %q", alert)
+	}
+	select {
+	case <-server.die:
+	case <-time.After(time.Second):
+		t.Fatal("session not closed")
+	}
+}
+
+// TestStreamWindowUpdate checks that the data sent within the window returned by cmdWindowUpdate is accepted
+func TestStreamWindowUpdate(t *testing.T) {
+	server, peer := rawServer(t, nil)
+	settings := frameWithData(cmdSettings, 0, newLocalSettings(padding.DefaultPaddingFactory().Md5).Encode())
+	go peer.Write(encodeFrames(settings, newFrame(cmdSYN, 1)))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		f, err := readFrame(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.cmd == cmdSYNACK {
+			break
+		}
+	}
+	server.streamLock.RLock()
+	stream := server.streams[1]
+	server.streamLock.RUnlock()
+
+	// the window is used up twice, the peer sends only within the window returned as the stream is read
+	const total = defaultStreamWindow * 2
+	granted := make(chan uint32, 64)
+	go func() {
+		defer close(granted)
+		for {
+			f, err := readFrame(peer)
+			if err != nil {
+				return
+			}
+			if f.cmd == cmdWindowUpdate {
+				granted <- binary.BigEndian.Uint32(f.data)
+			}
+		}
+	}()
+	updates := make(chan int, 1)
+	go func() {
+		window, count := uint32(defaultStreamWindow), 0
+		for sent := 0; sent < total; {
+			for window == 0 {
+				increment, ok := <-granted
+				if !ok {
+					return
+				}
+				window += increment
+				count++
+			}
+			n := min(maxFramePayloadSize, total-sent, int(window))
+			if _, err := peer.Write(encodeFrames(frameWithData(cmdPSH, 1, make([]byte, n)))); err != nil {
+				return
+			}
+			sent += n
+			window -= uint32(n)
+		}
+		updates <- count
+	}()
+	if _, err := io.ReadFull(stream, make([]byte, total)); err != nil {
+		t.Fatal(err)
+	}
+	if server.IsClosed() {
+		t.Fatal("session closed for data within the window")
+	}
+	if count := <-updates; count == 0 {
+		t.Fatal("no window update used")
+	}
+}
+
+// TestStreamWriteSplit checks that a write larger than a frame is sent in frames of maxFramePayloadSize
+func TestStreamWriteSplit(t *testing.T) {
+	server, peer := rawServer(t, nil)
+	settings := frameWithData(cmdSettings, 0, newLocalSettings(padding.DefaultPaddingFactory().Md5).Encode())
+	go peer.Write(encodeFrames(settings, newFrame(cmdSYN, 1)))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		f, err := readFrame(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.cmd == cmdSYNACK {
+			break
+		}
+	}
+	server.streamLock.RLock()
+	stream := server.streams[1]
+	server.streamLock.RUnlock()
+
+	data := make([]byte, maxFramePayloadSize*3+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(data)
+		written <- err
+	}()
+
+	var received []byte
+	var lengths []int
+	for len(received) < len(data) {
+		f, err := readFrame(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.cmd == cmdPSH && f.sid == 1 {
+			received = append(received, f.data...)
+			lengths = append(lengths, len(f.data))
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{maxFramePayloadSize, maxFramePayloadSize, maxFramePayloadSize, 100}; !slices.Equal(lengths, want) {
+		t.Fatalf("frames of %v bytes, want %v", lengths, want)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("data corrupted")
+	}
+}
+
+// hasStream reports whether the session still has the stream sid
+func hasStream(s *Session, sid uint32) bool {
+	s.streamLock.RLock()
+	defer s.streamLock.RUnlock()
+	_, ok := s.streams[sid]
+	return ok
+}
+
+// TestStreamHalfClose checks that the peer of CloseWrite reads EOF and can still write back,
+// and that the stream is removed only after both directions are closed
+func TestStreamHalfClose(t *testing.T) {
+	client, server, streams := testPair(t, nil)
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("x")); err == nil {
+		t.Fatal("write after CloseWrite")
+	}
+	peer := acceptStream(t, streams)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if request, err := io.ReadAll(peer); err != nil || string(request) != "request" {
+		t.Fatalf("read %q: %v", request, err)
+	}
+
+	if _, err := peer.Write([]byte("response")); err != nil {
+		t.Fatal("write after the peer closed its side:", err)
+	}
+	response := make([]byte, len("response"))
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(stream, response); err != nil || string(response) != "response" {
+		t.Fatalf("read %q: %v", response, err)
+	}
+	if !hasStream(client, stream.id) || !hasStream(server, stream.id) {
+		t.Fatal("stream removed with one direction open")
+	}
+
+	if err := peer.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %v, want EOF", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for hasStream(client, stream.id) || hasStream(server, stream.id) {
+		if time.Now().After(deadline) {
+			t.Fatal("stream not removed after both directions closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestStreamHalfCloseLegacy checks that CloseWrite closes the stream with a server older than version 4
+func TestStreamHalfCloseLegacy(t *testing.T) {
+	conn, peer := net.Pipe()
+	client := NewClientSession(conn, padding.NewStorage(nil))
+	client.Run()
+	t.Cleanup(func() {
+		peer.Close()
+		client.Close()
+	})
+	serverSettings := (&ServerSettings{Version: 3, Capabilities: versionCapabilities(3), StreamWindow: defaultStreamWindow}).Encode()
+	go peer.Write(encodeFrames(frameWithData(cmdServerSettings, 0, serverSettings)))
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	closed := make(chan []byte, 1)
+	go func() {
+		var cmds []byte
+		for {
+			f, err := readFrame(peer)
+			if err != nil {
+				closed <- nil
+				return
+			}
+			if f.sid == stream.id {
+				cmds = append(cmds, f.cmd)
+			}
+			if f.cmd == cmdSYN {
+				// the stream succeeds
+				go peer.Write(encodeFrames(newFrame(cmdSYNACK, f.sid)))
+			}
+			if f.cmd == cmdFIN || f.cmd == cmdCloseWrite {
+				closed <- cmds
+				return
+			}
+		}
+	}()
+	select {
+	case <-client.serverSettingsDone:
+	case <-time.After(time.Second):
+		t.Fatal("no server settings")
+	}
+	if client.has(CapHalfClose) {
+		t.Fatal("half-close with a version 3 server")
+	}
+
+	if _, err := stream.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseWrite()
+	if cmds := <-closed; !slices.Equal(cmds, []byte{cmdSYN, cmdPSH, cmdFIN}) {
+		t.Fatalf("sent %v, want SYN, PSH and FIN", cmds)
+	}
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Fatal("stream readable after CloseWrite with a version 3 server")
+	}
+	if hasStream(client, stream.id) {
+		t.Fatal("stream not removed")
+	}
+}
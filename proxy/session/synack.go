@@ -0,0 +1,148 @@
+package session
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// ErrorCode is the outbound result carried by cmdSYNACK between peers with CapSYNACKCode.
+// The values below 7 follow the SOCKS5 reply codes.
+type ErrorCode uint8
+
+const (
+	CodeSuccess            ErrorCode = 0
+	CodeGeneralFailure     ErrorCode = 1
+	CodeNotAllowed         ErrorCode = 2
+	CodeNetworkUnreachable ErrorCode = 3
+	CodeHostUnreachable    ErrorCode = 4
+	CodeConnectionRefused  ErrorCode = 5
+	CodeTimeout            ErrorCode = 6
+	CodeDNSFailure         ErrorCode = 7
+)
+
+// Outbound errors reported by the peer, a *RemoteError matches the one of its code with errors.Is.
+// Servers may also pass them to HandshakeFailure to report a code explicitly.
+var (
+	ErrGeneralFailure     = errors.New("general failure")
+	ErrNotAllowed         = errors.New("not allowed by policy")
+	ErrNetworkUnreachable = errors.New("network unreachable")
+	ErrHostUnreachable    = errors.New("host unreachable")
+	ErrConnectionRefused  = errors.New("connection refused")
+	ErrTimeout            = errors.New("connection timed out")
+	ErrDNSFailure         = errors.New("name resolution failed")
+)
+
+var codeErrors = map[ErrorCode]error{
+	CodeGeneralFailure:     ErrGeneralFailure,
+	CodeNotAllowed:         ErrNotAllowed,
+	CodeNetworkUnreachable: ErrNetworkUnreachable,
+	CodeHostUnreachable:    ErrHostUnreachable,
+	CodeConnectionRefused:  ErrConnectionRefused,
+	CodeTimeout:            ErrTimeout,
+	CodeDNSFailure:         ErrDNSFailure,
+}
+
+// RemoteError is an outbound error reported by the peer in cmdSYNACK
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Message
+}
+
+// Unwrap returns the sentinel error of the code
+func (e *RemoteError) Unwrap() error {
+	if err, ok := codeErrors[e.Code]; ok {
+		return err
+	}
+	return ErrGeneralFailure
+}
+
+// errorCode classifies an outbound error, errors relayed from another peer keep their code
+func errorCode(err error) ErrorCode {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.Code
+	}
+	for code, codeErr := range codeErrors {
+		if errors.Is(err, codeErr) {
+			return code
+		}
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return CodeDNSFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CodeConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return CodeNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return CodeHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return CodeTimeout
+	default:
+		return CodeGeneralFailure
+	}
+}
+
+// synackVersion is the version of the cmdSYNACK payload with CapSYNACKCode
+const synackVersion = 1
+
+// encodeSYNACK returns the cmdSYNACK payload with CapSYNACKCode:
+// version (1), code (1), message length (2), message, then the optional bound address
+func encodeSYNACK(code ErrorCode, message string, bound M.Socksaddr) []byte {
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	buffer := buf.NewSize(4 + len(message) + M.SocksaddrSerializer.AddrPortLen(bound))
+	defer buffer.Release()
+	buffer.WriteByte(synackVersion)
+	buffer.WriteByte(byte(code))
+	binary.BigEndian.PutUint16(buffer.Extend(2), uint16(len(message)))
+	buffer.WriteString(message)
+	if bound.IsValid() {
+		M.SocksaddrSerializer.WriteAddrPort(buffer, bound)
+	}
+	return append([]byte(nil), buffer.Bytes()...)
+}
+
+// decodeSYNACK parses a cmdSYNACK payload, without CapSYNACKCode a payload is the error message.
+// Fields appended by newer versions are ignored.
+func decodeSYNACK(b []byte, structured bool) (err error, bound M.Socksaddr) {
+	if !structured || len(b) < 4 || b[0] < synackVersion {
+		if len(b) == 0 {
+			return nil, M.Socksaddr{}
+		}
+		return &RemoteError{Code: CodeGeneralFailure, Message: string(b)}, M.Socksaddr{}
+	}
+	code := ErrorCode(b[1])
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	if 4+n > len(b) {
+		return &RemoteError{Code: CodeGeneralFailure, Message: "invalid SYNACK"}, M.Socksaddr{}
+	}
+	message := string(b[4 : 4+n])
+	if rest := b[4+n:]; len(rest) > 0 {
+		bound, _ = M.SocksaddrSerializer.ReadAddrPort(buf.As(rest))
+	}
+	if code == CodeSuccess {
+		return nil, bound
+	}
+	if message == "" {
+		if codeErr, ok := codeErrors[code]; ok {
+			message = codeErr.Error()
+		}
+	}
+	return &RemoteError{Code: code, Message: message}, bound
+}
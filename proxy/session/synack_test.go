@@ -0,0 +1,112 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestSYNACK(t *testing.T) {
+	bound := M.ParseSocksaddr("127.0.0.1:1080")
+	for _, test := range []struct {
+		code    ErrorCode
+		message string
+		err     error
+	}{
+		{CodeSuccess, "", nil},
+		{CodeGeneralFailure, "dial failed", ErrGeneralFailure},
+		{CodeNotAllowed, "", ErrNotAllowed},
+		{CodeNetworkUnreachable, "", ErrNetworkUnreachable},
+		{CodeHostUnreachable, "no route", ErrHostUnreachable},
+		{CodeConnectionRefused, "", ErrConnectionRefused},
+		{CodeTimeout, "", ErrTimeout},
+		{CodeDNSFailure, "no such host", ErrDNSFailure},
+		{200, "newer code", ErrGeneralFailure},
+	} {
+		t.Run(fmt.Sprint(test.code), func(t *testing.T) {
+			err, gotBound := decodeSYNACK(encodeSYNACK(test.code, test.message, bound), true)
+			if gotBound != bound {
+				t.Fatalf("bound %v, want %v", gotBound, bound)
+			}
+			if test.err == nil {
+				if err != nil {
+					t.Fatalf("error %v for success", err)
+				}
+				return
+			}
+			var remoteErr *RemoteError
+			if !errors.As(err, &remoteErr) || remoteErr.Code != test.code {
+				t.Fatalf("error %#v, want the code %d", err, test.code)
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error %v does not match %v", err, test.err)
+			}
+			if test.message != "" && remoteErr.Message != test.message {
+				t.Fatalf("message %q, want %q", remoteErr.Message, test.message)
+			}
+			if test.message == "" && remoteErr.Message != test.err.Error() {
+				t.Fatalf("message %q, want the one of the code", remoteErr.Message)
+			}
+			// a relayed error keeps its code
+			if code := errorCode(fmt.Errorf("relay: %w", err)); code != test.code {
+				t.Fatalf("relayed code %d, want %d", code, test.code)
+			}
+			if test.code < 200 {
+				if code := errorCode(test.err); code != test.code {
+					t.Fatalf("code of %v is %d", test.err, code)
+				}
+			}
+		})
+	}
+}
+
+func TestSYNACKLegacy(t *testing.T) {
+	// an empty SYNACK is a success, with or without CapSYNACKCode
+	for _, structured := range []bool{true, false} {
+		if err, _ := decodeSYNACK(nil, structured); err != nil {
+			t.Fatalf("empty SYNACK: %v", err)
+		}
+	}
+	// peers without CapSYNACKCode send the error text
+	err, bound := decodeSYNACK([]byte("dial tcp: connection refused"), false)
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != CodeGeneralFailure || remoteErr.Message != "dial tcp: connection refused" {
+		t.Fatalf("text SYNACK: %#v", err)
+	}
+	if bound.IsValid() {
+		t.Fatal("bound address in a text SYNACK")
+	}
+	// so do the structured payloads too short for the header
+	if err, _ := decodeSYNACK([]byte("no"), true); err == nil || err.Error() != "remote: no" {
+		t.Fatalf("short SYNACK: %v", err)
+	}
+	// and a message longer than the payload is invalid
+	if err, _ := decodeSYNACK([]byte{synackVersion, byte(CodeTimeout), 0, 10, 'x'}, true); !errors.Is(err, ErrGeneralFailure) {
+		t.Fatalf("truncated SYNACK: %v", err)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, CodeDNSFailure},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, CodeConnectionRefused},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, CodeNetworkUnreachable},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, CodeHostUnreachable},
+		{context.DeadlineExceeded, CodeTimeout},
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, CodeTimeout},
+		{errors.New("other"), CodeGeneralFailure},
+	} {
+		if code := errorCode(test.err); code != test.code {
+			t.Errorf("code of %v is %d, want %d", test.err, code, test.code)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"anytls/proxy/pipe"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// HTTP/2 carries the session in the bodies of a POST request and its response,
+// which are streamed in both directions at the same time. Several sessions to a server
+// share its HTTP/2 connection. Reverse proxies must not buffer the bodies.
+
+var errNotHTTP2 = errors.New("http2: the server did not answer with HTTP/2")
+
+// HTTP2Dialer opens sessions to one server as HTTP/2 requests
+type HTTP2Dialer struct {
+	url    string
+	host   string
+	client *http.Client
+}
+
+// NewHTTP2Dialer posts to path on server, host is sent as the Host header when not empty.
+// dialer connects to the server, the connection is then secured by tlsConfig.
+func NewHTTP2Dialer(server, host, path string, tlsConfig *tls.Config, dialer *net.Dialer) *HTTP2Dialer {
+	return &HTTP2Dialer{
+		url:  "https://" + server + path,
+		host: host,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				TLSClientConfig:   tlsConfig.Clone(),
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   time.Minute,
+			},
+		},
+	}
+}
+
+// Dial opens a request, ctx bounds the wait for the response headers
+func (d *HTTP2Dialer) Dial(ctx context.Context) (net.Conn, error) {
+	// the request lives as long as the connection, not as the dial
+	reqCtx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, d.url, reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if d.host != "" {
+		req.Host = d.host
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := d.client.Do(req)
+		done <- result{resp, err}
+	}()
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		cancel()
+		writer.Close()
+		return nil, ctx.Err()
+	}
+	if res.err != nil {
+		cancel()
+		writer.Close()
+		return nil, res.err
+	}
+	if res.resp.ProtoMajor != 2 || res.resp.StatusCode != http.StatusOK {
+		res.resp.Body.Close()
+		cancel()
+		writer.Close()
+		if res.resp.ProtoMajor != 2 {
+			return nil, errNotHTTP2
+		}
+		return nil, fmt.Errorf("http2: %s", res.resp.Status)
+	}
+
+	conn := newHTTP2Conn(res.resp.Body, writer, nil, M.ParseSocksaddr(req.URL.Host))
+	conn.close = func() {
+		writer.Close()
+		res.resp.Body.Close()
+		cancel()
+	}
+	return conn, nil
+}
+
+// HTTP2Handler accepts HTTP/2 POST requests on path and passes each of them to handle
+// as a connection, other requests get 404. The response ends when handle returns.
+func HTTP2Handler(path string, handle func(conn net.Conn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path || r.Method != http.MethodPost || r.ProtoMajor != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		controller := http.NewResponseController(w)
+		conn := newHTTP2Conn(r.Body, &flushWriter{w: w, flusher: flusher}, local, M.ParseSocksaddr(r.RemoteAddr))
+		conn.close = func() {
+			// unblock a write waiting for the flow control window, then wait for it,
+			// the deadline resets the stream so the response is only ended when no write is pending
+			if !conn.writeLock.TryLock() {
+				controller.SetWriteDeadline(time.Now())
+				conn.writeLock.Lock()
+			}
+			conn.closed = true
+			conn.writeLock.Unlock()
+			r.Body.Close()
+		}
+		defer conn.Close()
+		handle(conn)
+	})
+}
+
+// flushWriter sends every write right away
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err == nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// http2Conn implements net.Conn over a request and its response.
+// The bodies can not be interrupted, so they are read and written by goroutines of the connection:
+// a deadline fails the waiting Read or Write with os.ErrDeadlineExceeded and the connection stays usable.
+type http2Conn struct {
+	reader io.ReadCloser
+	writer io.Writer
+	local  net.Addr
+	remote net.Addr
+
+	readOnce     sync.Once
+	readLock     sync.Mutex
+	reads        chan http2Read
+	consumed     chan struct{}
+	unread       []byte
+	readErr      error
+	readDeadline pipe.PipeDeadline
+
+	writeOnce     sync.Once
+	writeCall     sync.Mutex // one Write at a time
+	writes        chan []byte
+	written       chan error // holds the result of the last write while no write is in progress
+	writeBuffer   []byte
+	writeDeadline pipe.PipeDeadline
+
+	// writes are not accepted anymore after close, the response is finished by then
+	writeLock sync.Mutex
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+	close     func()
+}
+
+// http2Read is a read of the body
+type http2Read struct {
+	b   []byte
+	err error
+}
+
+func newHTTP2Conn(reader io.ReadCloser, writer io.Writer, local, remote net.Addr) *http2Conn {
+	c := &http2Conn{
+		reader:        reader,
+		writer:        writer,
+		local:         local,
+		remote:        remote,
+		reads:         make(chan http2Read),
+		consumed:      make(chan struct{}, 1),
+		readDeadline:  pipe.MakePipeDeadline(),
+		writes:        make(chan []byte, 1),
+		written:       make(chan error, 1),
+		writeDeadline: pipe.MakePipeDeadline(),
+		done:          make(chan struct{}),
+	}
+	c.written <- nil
+	return c
+}
+
+// readLoop reads the body, the next read waits until the data of the previous one is consumed
+func (c *http2Conn) readLoop() {
+	b := make([]byte, 32*1024)
+	for {
+		n, err := c.reader.Read(b)
+		select {
+		case c.reads <- http2Read{b[:n], err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-c.consumed:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *http2Conn) Read(b []byte) (int, error) {
+	c.readOnce.Do(func() { go c.readLoop() })
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for len(c.unread) == 0 && c.readErr == nil {
+		select {
+		case r := <-c.reads:
+			c.unread, c.readErr = r.b, r.err
+			if len(r.b) == 0 && r.err == nil {
+				c.consumed <- struct{}{}
+			}
+		case <-c.readDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+	if len(c.unread) == 0 {
+		return 0, c.readErr
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	if len(c.unread) == 0 && c.readErr == nil {
+		c.consumed <- struct{}{}
+	}
+	return n, nil
+}
+
+// writeLoop writes to the body the data handed over by Write
+func (c *http2Conn) writeLoop() {
+	for {
+		select {
+		case b := <-c.writes:
+			c.writeLock.Lock()
+			err := net.ErrClosed
+			if !c.closed {
+				_, err = c.writer.Write(b)
+			}
+			c.writeLock.Unlock()
+			c.written <- err
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Write waits until b is written to the body. A write which times out is still written,
+// before the next ones, so it counts as written.
+func (c *http2Conn) Write(b []byte) (int, error) {
+	c.writeOnce.Do(func() { go c.writeLoop() })
+	c.writeCall.Lock()
+	defer c.writeCall.Unlock()
+	// wait for the previous write
+	select {
+	case err := <-c.written:
+		if err != nil {
+			c.written <- err
+			return 0, err
+		}
+	case <-c.writeDeadline.Wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+
+	// b is copied, it may be written after Write returns
+	c.writeBuffer = append(c.writeBuffer[:0], b...)
+	c.writes <- c.writeBuffer
+	select {
+	case err := <-c.written:
+		c.written <- err
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	case <-c.writeDeadline.Wait():
+		return len(b), os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *http2Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.close()
+	})
+	return nil
+}
+
+func (c *http2Conn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return &net.TCPAddr{}
+	}
+	return c.local
+}
+
+func (c *http2Conn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return &net.TCPAddr{}
+	}
+	return c.remote
+}
+
+func (c *http2Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	c.writeDeadline.Set(t)
+	return nil
+}
+
+func (c *http2Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+func (c *http2Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Set(t)
+	return nil
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// testHTTP2 starts an HTTP/2 server passing the requests on /h2 to handle, and returns a connection to it
+func testHTTP2(t *testing.T, handle func(conn net.Conn)) net.Conn {
+	t.Helper()
+	server := httptest.NewUnstartedServer(HTTP2Handler("/h2", handle))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	dialer := NewHTTP2Dialer(server.Listener.Addr().String(), "example.com", "/h2", &tls.Config{RootCAs: roots}, &net.Dialer{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := dialer.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHTTP2(t *testing.T) {
+	conn := testHTTP2(t, echo)
+	for _, n := range []int{1, 1000, 100000} {
+		data := bytes.Repeat([]byte{byte(n)}, n)
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		received := make([]byte, n)
+		if _, err := io.ReadFull(conn, received); err != nil {
+			t.Fatalf("read %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Fatalf("%d bytes corrupted", n)
+		}
+	}
+}
+
+// TestHTTP2ReadDeadline checks that a read deadline fails the read and keeps the connection
+func TestHTTP2ReadDeadline(t *testing.T) {
+	conn := testHTTP2(t, echo)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 16))
+	var netErr net.Error
+	if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("read error %v, want a timeout", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, 5)
+	if _, err := io.ReadFull(conn, received); err != nil || string(received) != "after" {
+		t.Fatalf("read %q after the deadline: %v", received, err)
+	}
+}
+
+// TestHTTP2WriteDeadline checks that a write deadline fails a write blocked by the flow control,
+// and that the data written before is still delivered in order
+func TestHTTP2WriteDeadline(t *testing.T) {
+	type result struct {
+		written int64
+		err     error
+	}
+	results := make(chan result, 1)
+	resume := make(chan struct{})
+	conn := testHTTP2(t, func(conn net.Conn) {
+		chunk := make([]byte, 64*1024)
+		var written int64
+		var err error
+		for {
+			for i := range chunk {
+				chunk[i] = byte(written + int64(i))
+			}
+			conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+			var n int
+			n, err = conn.Write(chunk)
+			written += int64(n)
+			if err != nil {
+				break
+			}
+		}
+		results <- result{written, err}
+		<-resume
+		// the connection is still usable
+		conn.SetWriteDeadline(time.Time{})
+		conn.Write([]byte{byte(written)})
+		conn.Close()
+	})
+
+	// nothing is read until the writes of the server block
+	conn.Write([]byte("start"))
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes never blocked")
+	}
+	if !errors.Is(res.err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write error %v, want a timeout", res.err)
+	}
+	close(resume)
+
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(received)) != res.written+1 {
+		t.Fatalf("received %d bytes, want %d", len(received), res.written+1)
+	}
+	for i, b := range received {
+		if b != byte(i) {
+			t.Fatalf("byte %d is %d", i, b)
+		}
+	}
+}
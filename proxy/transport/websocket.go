@@ -0,0 +1,332 @@
+package transport
+
+import (
+	std_bufio "bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket carries the session in the binary messages of a WebSocket (RFC 6455),
+// so it can pass reverse proxies and CDNs which forward WebSocket upgrades.
+// A message boundary means nothing, the payloads make a byte stream.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// maxControlPayload is the largest payload of a control frame
+const maxControlPayload = 125
+
+var errBadHandshake = errors.New("websocket: bad handshake")
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// DialWebSocket upgrades conn, usually a TLS connection to the server or a reverse proxy,
+// to a WebSocket on path. host is sent as the Host header.
+func DialWebSocket(ctx context.Context, conn net.Conn, host, path string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	requestURI, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        requestURI,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+		Host: host,
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := std_bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: %s", errBadHandshake, resp.Status)
+	}
+	if !headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, errBadHandshake
+	}
+	return newWebSocketConn(conn, reader, true), nil
+}
+
+// WebSocketHandler accepts WebSocket upgrades on path and passes each connection to handle,
+// other requests get 404. The connection is closed when handle returns.
+func WebSocketHandler(path string, handle func(conn net.Conn)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path || r.Method != http.MethodGet ||
+			!headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") ||
+			r.Header.Get("Sec-WebSocket-Version") != "13" || r.Header.Get("Sec-WebSocket-Key") == "" {
+			http.NotFound(w, r)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			websocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+		if err != nil {
+			conn.Close()
+			return
+		}
+		wsConn := newWebSocketConn(conn, rw.Reader, false)
+		defer wsConn.Close()
+		handle(wsConn)
+	})
+}
+
+// headerContains reports whether a comma separated header has the token, ignoring case
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketConn implements net.Conn over the binary messages of a WebSocket
+type webSocketConn struct {
+	net.Conn
+	reader *std_bufio.Reader
+	// clients mask the frames they send
+	isClient bool
+
+	// read side, only used by Read
+	remaining int64
+	mask      [4]byte
+	maskPos   int
+	masked    bool
+	readErr   error
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWebSocketConn(conn net.Conn, reader *std_bufio.Reader, isClient bool) *webSocketConn {
+	return &webSocketConn{
+		Conn:     conn,
+		reader:   reader,
+		isClient: isClient,
+	}
+}
+
+// Read returns the payload of the data frames, control frames are handled on the way
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	if c.masked {
+		for i := range b[:n] {
+			b[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+// nextFrame reads the header of the next frame, control frames are handled entirely
+func (c *webSocketConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.reader, hdr[:]); err != nil {
+		return err
+	}
+	fin := hdr[0]&0x80 != 0
+	opcode := hdr[0] & 0x0f
+	c.masked = hdr[1]&0x80 != 0
+	// RFC 6455 5.1: clients mask all their frames and servers none of theirs
+	if c.masked == c.isClient {
+		return c.protocolError("websocket: frame masking does not match the sender")
+	}
+	// RFC 6455 5.5: control frames are not fragmented
+	if opcode&0x8 != 0 && !fin {
+		return c.protocolError("websocket: fragmented control frame")
+	}
+	length := int64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		if length > maxControlPayload {
+			return c.protocolError("websocket: control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		if c.masked {
+			for i := range payload {
+				payload[i] ^= c.mask[i&3]
+			}
+		}
+		switch opcode {
+		case opClose:
+			c.closeWith(payload)
+			return io.EOF
+		case opPing:
+			c.writeFrame(opPong, payload)
+		}
+		return nil
+	default:
+		return c.protocolError(fmt.Sprintf("websocket: unknown opcode %d", opcode))
+	}
+}
+
+// protocolError closes the connection with the status 1002 after an invalid frame
+func (c *webSocketConn) protocolError(message string) error {
+	c.closeWith(binary.BigEndian.AppendUint16(nil, 1002))
+	c.Conn.Close()
+	return errors.New(message)
+}
+
+// Write sends b in one binary frame
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if c.isClient {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// closeWith sends a close frame once, echoing the status of the peer
+func (c *webSocketConn) closeWith(payload []byte) {
+	c.closeOnce.Do(func() {
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(opClose, payload)
+	})
+}
+
+// Close sends a close frame and closes the connection
+func (c *webSocketConn) Close() error {
+	c.closeWith(binary.BigEndian.AppendUint16(nil, 1000))
+	return c.Conn.Close()
+}
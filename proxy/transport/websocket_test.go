@@ -0,0 +1,99 @@
+package transport
+
+import (
+	std_bufio "bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echo copies what the connection reads back to it
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+func TestWebSocket(t *testing.T) {
+	server := httptest.NewServer(WebSocketHandler("/ws", echo))
+	defer server.Close()
+
+	raw, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := DialWebSocket(ctx, raw, "example.com", "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the payload lengths of the three length encodings
+	for _, n := range []int{1, 125, 126, 0xffff, 0x10000, 200000} {
+		data := bytes.Repeat([]byte{byte(n)}, n)
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		received := make([]byte, n)
+		if _, err := io.ReadFull(conn, received); err != nil {
+			t.Fatalf("read %d bytes: %v", n, err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Fatalf("%d bytes corrupted", n)
+		}
+	}
+
+	// other paths are not upgraded
+	raw, err = net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if _, err := DialWebSocket(ctx, raw, "example.com", "/other"); err == nil {
+		t.Fatal("upgraded on another path")
+	}
+}
+
+// TestWebSocketProtocolError checks that servers reject invalid frames with the status 1002
+func TestWebSocketProtocolError(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		frame []byte
+		err   string
+	}{
+		{"unmasked", []byte{0x82, 0x01, 'x'}, "masking"},
+		{"fragmented ping", []byte{0x09, 0x80, 0, 0, 0, 0}, "fragmented control frame"},
+		{"long ping", append([]byte{0x89, 0x80 | 126, 0, 126, 0, 0, 0, 0}, make([]byte, 126)...), "control frame too long"},
+		{"unknown opcode", []byte{0x83, 0x80, 0, 0, 0, 0}, "unknown opcode"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			ws := newWebSocketConn(conn, std_bufio.NewReader(conn), false)
+			defer ws.Close()
+
+			closed := make(chan []byte, 1)
+			go func() {
+				peer.Write(test.frame)
+				b, _ := io.ReadAll(peer)
+				closed <- b
+			}()
+			_, err := ws.Read(make([]byte, 16))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+			if _, err := ws.Read(make([]byte, 16)); err == nil {
+				t.Fatal("read after a protocol error")
+			}
+			if b := <-closed; !bytes.HasPrefix(b, []byte{0x80 | opClose, 2, 0x03, 0xea}) {
+				t.Fatalf("close frame % x, want the status 1002", b)
+			}
+		})
+	}
+}
@@ -1,15 +1,22 @@
 package util
 
 import (
+	"sort"
 	"strings"
 )
 
 type StringMap map[string]string
 
+// ToBytes encodes the map as key=value lines sorted by key, so the result is deterministic
 func (s StringMap) ToBytes() []byte {
-	var lines []string
-	for k, v := range s {
-		lines = append(lines, k+"="+v)
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(s))
+	for _, k := range keys {
+		lines = append(lines, k+"="+s[k])
 	}
 	return []byte(strings.Join(lines, "\n"))
 }